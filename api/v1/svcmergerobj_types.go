@@ -17,7 +17,9 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -28,18 +30,929 @@ type SvcMergerObjSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of SvcMergerObj. Edit svcmergerobj_types.go to remove/update
-	Services []string `json:"services"`
+	// Services lists the names of the member Services to merge
+	// +optional
+	Services []string `json:"services,omitempty"`
+
+	// ServiceSelector picks member Services by their labels, instead of or on top of Services. Services join
+	// and leave the merge as they are labeled, created or deleted. A merged member, whose Service is gone,
+	// stays as long as the labels kept in the snapshot of its Service match. Merged Services are never picked.
+	// +optional
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+
+	// Ports maps ports of the member Services onto ports of the merged Service.
+	// When empty, every port of every member is carried over with its own number, and ports
+	// that collide with a port of an earlier member are skipped and reported in the status.
+	// +optional
+	Ports []PortMapping `json:"ports,omitempty"`
+
+	// Strategy selects how the pods of the members are put behind the merged Service.
+	// Labels (the default) adds the merge label to the pod template of every member Deployment,
+	// which rolls them out. EndpointSlice leaves the workloads alone: the merged Service has no
+	// selector and the controller writes its EndpointSlices from the pods of the member Services.
+	// EndpointSlicePerPort does the same, but the endpoints of every merged port only hold the pods of
+	// the member the port was taken from, so no port reaches the pods of another member; a port colliding
+	// with the one of an earlier member is exposed on the next free number instead of skipped. Proxy puts a
+	// proxy deployed by the controller behind the merged Service, which routes by listening port, HTTP
+	// host and path or TLS server name to the members (see proxy), so that members using the same port
+	// number can be told apart.
+	// +kubebuilder:default=Labels
+	// +optional
+	Strategy MergeStrategy `json:"strategy,omitempty"`
+
+	// Mode decides what becomes of the member Services. Replace (the default) deletes them once the merged
+	// Service is in place and brings them back when they leave the merge. Aggregate adds the merged Service
+	// next to them and leaves them alone, so that clients can keep calling them by name; deleting the
+	// SvcMergerObj then only removes the merged Service and the merge labels. The mode can't be changed.
+	// +kubebuilder:default=Replace
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="mode can't be changed, create a new SvcMergerObj instead"
+	// +optional
+	Mode MergeMode `json:"mode,omitempty"`
+
+	// Aliases puts a Service in the place of every member Service the cutover deleted, so that in-cluster
+	// clients keep resolving the old names. ExternalName points the name at the merged Service through DNS,
+	// which only reaches the member ports the merged Service exposes under their original number. Endpoints
+	// keeps a selector-less Service with the original cluster IP and ports, whose EndpointSlices mirror the
+	// pods of the member. None (the default) leaves the names unresolved. Demerge swaps the aliases back for
+	// the original Services. Aggregate mode keeps the member Services and needs no aliases.
+	// +kubebuilder:default=None
+	// +optional
+	Aliases AliasType `json:"aliases,omitempty"`
+
+	// OwnerlessPods decides what happens to member pods that are not managed by any workload.
+	// Reject (the default) fails the member, Relabel puts the merge label on the pods themselves.
+	// +kubebuilder:default=Reject
+	// +optional
+	OwnerlessPods OwnerlessPodPolicy `json:"ownerlessPods,omitempty"`
+
+	// Cutover controls when the original member Services are removed once the merged Service is in place.
+	// By default an original is removed as soon as the merged Service has one ready endpoint of the member.
+	// +optional
+	Cutover *CutoverSpec `json:"cutover,omitempty"`
+
+	// Rollout brings new members into the merge progressively, in batches that each have to pass a health
+	// gate before the next one starts. Without it every new member is merged at once.
+	// +optional
+	Rollout *RolloutSpec `json:"rollout,omitempty"`
+
+	// RetryLimit is how many times in a row a step of a merge or update may fail before the steps already
+	// done are rolled back. A rolled back operation is only tried again once the spec changes.
+	// +kubebuilder:default=5
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	RetryLimit int32 `json:"retryLimit"`
+
+	// Priority decides which SvcMergerObj gets a member Service that several of them list and none has
+	// claimed yet: the highest priority claims it, equal priorities go to the oldest SvcMergerObj.
+	// A claim that is held is never taken away, the others stay in Conflict until it is released.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// MergedService configures the merged Service
+	// +optional
+	MergedService *MergedServiceSpec `json:"mergedService,omitempty"`
+
+	// ServiceTemplate shapes the merged Service: its name, labels and annotations and the parts of its spec
+	// that are not derived from the members. Changes are applied to the live Service in place, except for a
+	// new name, which creates the Service under that name and deletes the old one.
+	// +optional
+	ServiceTemplate *ServiceTemplate `json:"serviceTemplate,omitempty"`
+
+	// Routing generates an Ingress or Gateway API HTTPRoutes that route HTTP requests by host and path to
+	// the members, through a backend Service per member that selects only its pods. The merged Service
+	// is kept next to them.
+	// +optional
+	Routing *RoutingSpec `json:"routing,omitempty"`
+
+	// Proxy configures the proxy of the Proxy strategy
+	// +optional
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+
+	// Weights share the traffic out between the members, instead of by their number of ready pods. Members
+	// left out have a weight of 1, a weight of 0 takes a member out of the traffic. With the EndpointSlice
+	// strategy the merged EndpointSlices only hold as many ready endpoints of every member as its weight
+	// allows; HTTPRoute rules of spec.routing that match the same path are joined into one rule with
+	// weighted backends. The other strategies and the Ingress kind can't weight traffic.
+	// +listType=map
+	// +listMapKey=service
+	// +optional
+	Weights []MemberWeight `json:"weights,omitempty"`
+}
+
+// MemberWeight is the weight of a member in the traffic of the merge
+type MemberWeight struct {
+	// Service is the member the weight applies to
+	Service string `json:"service"`
+
+	// Weight of the member, relative to the weights of the other members
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000000
+	Weight int32 `json:"weight"`
+}
+
+// ProxySpec configures the proxy deployed for the Proxy strategy. It reaches every member through a
+// backend Service that selects only its pods, and reads its routing table from a ConfigMap the controller
+// writes, which it reloads without a restart.
+type ProxySpec struct {
+	// Image of the proxy, the one the controller is started with if unset
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Replicas of the proxy Deployment
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Listeners of the proxy, each one exposed as a port of the merged Service. Without listeners every
+	// merged port gets a TCP listener on its number, forwarding to the member port it was taken from.
+	// +optional
+	Listeners []ProxyListener `json:"listeners,omitempty"`
+}
+
+// ProxyListener is a port the proxy listens on and the routes of the connections or requests it accepts
+type ProxyListener struct {
+	// Name of the merged Service port, defaults to <protocol>-<port>
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Port the proxy listens on and the merged Service exposes
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+
+	// Protocol decides what the routes match on. TCP forwards every connection to its single route, HTTP
+	// matches the Host header and the path of every request, TLS matches the server name (SNI) the client
+	// asks for without terminating TLS.
+	// +kubebuilder:validation:Enum=TCP;HTTP;TLS
+	// +kubebuilder:default=TCP
+	// +optional
+	Protocol ProxyProtocol `json:"protocol,omitempty"`
+
+	// Routes send what they match to a member. Routes for a host take precedence over the ones without,
+	// among those the longest path prefix wins.
+	// +kubebuilder:validation:MinItems=1
+	Routes []ProxyRoute `json:"routes"`
+}
+
+// ProxyProtocol is the protocol a proxy listener routes on
+type ProxyProtocol string
+
+const (
+	// ProxyTCP forwards the connections as they are
+	ProxyTCP ProxyProtocol = "TCP"
+	// ProxyHTTP routes HTTP requests by host and path
+	ProxyHTTP ProxyProtocol = "HTTP"
+	// ProxyTLS routes TLS connections by server name
+	ProxyTLS ProxyProtocol = "TLS"
+)
+
+// ProxyRoute sends the connections or requests it matches to a port of a member
+type ProxyRoute struct {
+	// Host is the HTTP host or the TLS server name the route matches; empty matches any
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// PathPrefix matches the path and everything below it, segment by segment (/api matches /api/v1 but not
+	// /apis); HTTP listeners only
+	// +kubebuilder:validation:Pattern=`^/`
+	// +optional
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// Service is the member the route sends to
+	Service string `json:"service"`
+
+	// Port of the member Service, by name or number; its first port if unset
+	// +kubebuilder:validation:XIntOrString
+	// +optional
+	Port *intstr.IntOrString `json:"port,omitempty"`
+}
+
+// RoutingSpec describes the Ingress or HTTPRoutes generated for the members
+type RoutingSpec struct {
+	// Kind of the generated routing object
+	// +kubebuilder:validation:Enum=Ingress;HTTPRoute
+	Kind RoutingKind `json:"kind"`
+
+	// IngressClassName of the generated Ingress
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// ParentRefs are the Gateways the generated HTTPRoutes attach to, required for the HTTPRoute kind
+	// +optional
+	ParentRefs []GatewayRef `json:"parentRefs,omitempty"`
+
+	// Hostnames are matched by the rules that don't set a host of their own; no hostnames match any host
+	// +optional
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	// Rules send the requests they match to a member
+	// +kubebuilder:validation:MinItems=1
+	Rules []RouteRule `json:"rules"`
+}
+
+// RoutingKind is the kind of the generated routing object
+type RoutingKind string
+
+const (
+	// RoutingIngress generates a networking.k8s.io/v1 Ingress
+	RoutingIngress RoutingKind = "Ingress"
+	// RoutingHTTPRoute generates gateway.networking.k8s.io/v1beta1 HTTPRoutes, one per host
+	RoutingHTTPRoute RoutingKind = "HTTPRoute"
+)
+
+// GatewayRef references a Gateway, or a listener of it, that HTTPRoutes attach to
+type GatewayRef struct {
+	// Name of the Gateway
+	Name string `json:"name"`
+
+	// Namespace of the Gateway, the namespace of the SvcMergerObj by default
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// SectionName selects a listener of the Gateway
+	// +optional
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// RouteRule sends the requests matching a host and path to one member
+type RouteRule struct {
+	// Service is the member Service the requests go to
+	Service string `json:"service"`
+
+	// Port of the member Service, by name or number; the first port by default
+	// +kubebuilder:validation:XIntOrString
+	// +optional
+	Port *intstr.IntOrString `json:"port,omitempty"`
+
+	// Host the rule matches instead of spec.routing.hostnames
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// Path the rule matches
+	// +kubebuilder:default="/"
+	// +kubebuilder:validation:Pattern=`^/`
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// PathType tells whether Path is a prefix (the default) or has to match exactly
+	// +kubebuilder:default=Prefix
+	// +kubebuilder:validation:Enum=Prefix;Exact
+	// +optional
+	PathType RoutePathType `json:"pathType,omitempty"`
+}
+
+// RoutePathType tells how the path of a route rule is matched
+type RoutePathType string
+
+const (
+	// PathPrefix matches the path and everything below it
+	PathPrefix RoutePathType = "Prefix"
+	// PathExact matches the path only
+	PathExact RoutePathType = "Exact"
+)
+
+// ServiceTemplate is the template the merged Service is built from
+type ServiceTemplate struct {
+	// Metadata of the merged Service
+	// +optional
+	Metadata ServiceTemplateMetadata `json:"metadata,omitempty"`
+
+	// Spec holds the settings of the merged Service. Selector and ports are set by the controller.
+	// +optional
+	Spec ServiceTemplateSpec `json:"spec,omitempty"`
+}
+
+// ServiceTemplateMetadata is the metadata of the merged Service
+type ServiceTemplateMetadata struct {
+	// Name of the merged Service, defaults to the name of the SvcMergerObj
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[a-z]([-a-z0-9]*[a-z0-9])?$`
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Labels added to the merged Service
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations added to the merged Service
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ServiceTemplateSpec holds the fields of a ServiceSpec that can be set on the merged Service. Fields left
+// empty get the Kubernetes defaults.
+type ServiceTemplateSpec struct {
+	// Type of the merged Service, ClusterIP by default
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// SessionAffinity of the merged Service, None by default
+	// +kubebuilder:validation:Enum=None;ClientIP
+	// +optional
+	SessionAffinity corev1.ServiceAffinity `json:"sessionAffinity,omitempty"`
+
+	// SessionAffinityConfig of the merged Service
+	// +optional
+	SessionAffinityConfig *corev1.SessionAffinityConfig `json:"sessionAffinityConfig,omitempty"`
+
+	// ExternalTrafficPolicy of the merged Service, only used with the NodePort and LoadBalancer types
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy `json:"externalTrafficPolicy,omitempty"`
+
+	// InternalTrafficPolicy of the merged Service
+	// +kubebuilder:validation:Enum=Cluster;Local
+	// +optional
+	InternalTrafficPolicy *corev1.ServiceInternalTrafficPolicy `json:"internalTrafficPolicy,omitempty"`
+
+	// IPFamilyPolicy of the merged Service
+	// +kubebuilder:validation:Enum=SingleStack;PreferDualStack;RequireDualStack
+	// +optional
+	IPFamilyPolicy *corev1.IPFamilyPolicy `json:"ipFamilyPolicy,omitempty"`
+
+	// IPFamilies of the merged Service
+	// +optional
+	IPFamilies []corev1.IPFamily `json:"ipFamilies,omitempty"`
+
+	// LoadBalancerClass of the merged Service, it can't be changed once set
+	// +optional
+	LoadBalancerClass *string `json:"loadBalancerClass,omitempty"`
+
+	// LoadBalancerSourceRanges restricts the clients of a LoadBalancer merged Service
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// AllocateLoadBalancerNodePorts of a LoadBalancer merged Service
+	// +optional
+	AllocateLoadBalancerNodePorts *bool `json:"allocateLoadBalancerNodePorts,omitempty"`
+}
+
+// MergedServiceSpec configures the merged Service
+type MergedServiceSpec struct {
+	// Port is the port number the first port of the merged Service is exposed on. When empty and the
+	// controller is started with a port range, a port is allocated from it and kept in status.allocatedPort,
+	// so that it doesn't move; otherwise the first port keeps the number of its member port. Not used when
+	// spec.ports maps the ports explicitly.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+}
+
+// CutoverSpec controls the switch from the original member Services to the merged Service
+type CutoverSpec struct {
+	// MinReadyEndpoints is the number of ready endpoints of each member the EndpointSlices of the merged
+	// Service must hold before the original Service of the member is deleted. 0 does not wait at all.
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinReadyEndpoints int32 `json:"minReadyEndpoints"`
+
+	// DrainDelay keeps the original Services around for this long after the merged Service became ready,
+	// so that connections still going through them can finish
+	// +optional
+	DrainDelay *metav1.Duration `json:"drainDelay,omitempty"`
+}
+
+// RolloutSpec configures a progressive merge. Every batch of new members is put behind the merged Service,
+// watched by the health gate and then cut over, before the next batch starts. A batch failing its gate pauses
+// the rollout; it carries on once the spec changes, starting with the members that are not merged yet.
+type RolloutSpec struct {
+	// BatchSize is how many new members are brought in together
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	BatchSize int32 `json:"batchSize"`
+
+	// Paused holds the rollout before the next batch starts
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// Gate is the health check every batch has to pass
+	// +optional
+	Gate *HealthGate `json:"gate,omitempty"`
+}
+
+// HealthGate decides whether the members of a batch are healthy behind the merged Service. The checks are
+// repeated until they pass once StableFor is over; a batch whose checks don't pass within Timeout, or whose
+// pods restart more often than MaxRestarts, fails the gate.
+type HealthGate struct {
+	// MinReadyEndpoints is the number of ready endpoints of each member the merged Service must hold
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinReadyEndpoints int32 `json:"minReadyEndpoints"`
+
+	// MaxRestarts is how many container restarts the pods of a member may add while the gate watches them.
+	// Restarts are not checked when it is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxRestarts *int32 `json:"maxRestarts,omitempty"`
+
+	// HTTPGet is sent to every ready pod of the members, any status below 400 passes
+	// +optional
+	HTTPGet *GateHTTPGet `json:"httpGet,omitempty"`
+
+	// StableFor is how long the gate watches a batch, restarts included, before it can open
+	// +optional
+	StableFor *metav1.Duration `json:"stableFor,omitempty"`
+
+	// Timeout is how long the checks may fail before the gate fails and the rollout pauses. Defaults to 5m.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// GateHTTPGet is the HTTP request the health gate sends to the member pods
+type GateHTTPGet struct {
+	// Path of the request
+	// +kubebuilder:default="/"
+	// +kubebuilder:validation:Pattern=`^/`
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Port of the pods to send the request to, a container port number or name
+	Port intstr.IntOrString `json:"port"`
+}
+
+// OwnerlessPodPolicy decides what happens to member pods that are not managed by any workload
+// +kubebuilder:validation:Enum=Reject;Relabel
+type OwnerlessPodPolicy string
+
+const (
+	// OwnerlessPodsReject fails the member when one of its pods has no owning workload
+	OwnerlessPodsReject OwnerlessPodPolicy = "Reject"
+	// OwnerlessPodsRelabel puts the merge label directly on pods that have no owning workload
+	OwnerlessPodsRelabel OwnerlessPodPolicy = "Relabel"
+)
+
+// MergeStrategy selects how the pods of the members are put behind the merged Service
+// +kubebuilder:validation:Enum=Labels;EndpointSlice;EndpointSlicePerPort;Proxy
+type MergeStrategy string
+
+const (
+	// StrategyLabels relabels the pod templates of the member workloads and selects on the merge label
+	StrategyLabels MergeStrategy = "Labels"
+	// StrategyEndpointSlice manages the EndpointSlices of a selector-less merged Service, no workload is touched
+	StrategyEndpointSlice MergeStrategy = "EndpointSlice"
+	// StrategyEndpointSlicePerPort manages the EndpointSlices like StrategyEndpointSlice, with every port
+	// reaching the pods of its own member only
+	StrategyEndpointSlicePerPort MergeStrategy = "EndpointSlicePerPort"
+	// StrategyProxy puts a proxy behind the merged Service that routes to the members, no workload is touched
+	StrategyProxy MergeStrategy = "Proxy"
+)
+
+// MergeMode decides whether the merged Service replaces the member Services or is added next to them
+// +kubebuilder:validation:Enum=Replace;Aggregate
+type MergeMode string
+
+const (
+	// ModeReplace deletes the member Services once they are merged and restores them when they leave
+	ModeReplace MergeMode = "Replace"
+	// ModeAggregate keeps the member Services, the merged Service is added next to them
+	ModeAggregate MergeMode = "Aggregate"
+)
+
+// AliasType selects the kind of Service put in the place of a member Service deleted by the cutover
+// +kubebuilder:validation:Enum=None;ExternalName;Endpoints
+type AliasType string
+
+const (
+	// AliasNone leaves the name of a deleted member Service unresolved
+	AliasNone AliasType = "None"
+	// AliasExternalName creates an ExternalName Service pointing at the merged Service
+	AliasExternalName AliasType = "ExternalName"
+	// AliasEndpoints creates a selector-less Service whose EndpointSlices mirror the pods of the member
+	AliasEndpoints AliasType = "Endpoints"
+)
+
+// PortMapping maps one port of a member Service onto a port of the merged Service
+type PortMapping struct {
+	// Service is the name of the member Service the port belongs to
+	Service string `json:"service"`
+
+	// SourcePort selects the port of the member Service, either by its name or by its number
+	// +kubebuilder:validation:XIntOrString
+	SourcePort intstr.IntOrString `json:"sourcePort"`
+
+	// Port is the port number exposed on the merged Service
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+
+	// Name of the port on the merged Service. Defaults to <service>-<source port>
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// Condition types reported in SvcMergerObjStatus.Conditions
+const (
+	// ConditionReady is True once every member is merged behind the merged Service
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while a merge, update or demerge is in flight
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the last reconcile failed part way through
+	ConditionDegraded = "Degraded"
+	// ConditionPortCollision is True when member ports had to be left out of the merged Service because they collide
+	ConditionPortCollision = "PortCollision"
+	// ConditionDriftRepaired is True once the controller had to repair a difference between the merge and the
+	// cluster, e.g. a deleted merged Service; its message and transition time describe the last repair
+	ConditionDriftRepaired = "DriftRepaired"
+	// ConditionConflict is True while a member Service or one of its workloads is claimed by another
+	// SvcMergerObj; such members wait as Pending until the claim is released, the others are merged
+	ConditionConflict = "Conflict"
+	// ConditionSnapshotMissing is True while a merged member Service that was deleted has no snapshot, e.g. for
+	// merges made by older versions of the controller; its ports are left out of the merged Service and it is
+	// not created again on demerge. It stays True once such a member was demerged without being restored.
+	ConditionSnapshotMissing = "SnapshotMissing"
+	// ConditionRouteAccepted tells whether the routing objects of spec.routing were taken by the ingress
+	// controller or the Gateways; it is Unknown until they report back
+	ConditionRouteAccepted = "RouteAccepted"
+	// ConditionProxyReady is True once the proxy Deployment of the Proxy strategy has a ready replica, which
+	// the proxy only reports while it serves every listener of its routing table
+	ConditionProxyReady = "ProxyReady"
+)
+
+// MergePhase is the step of the merge lifecycle the SvcMergerObj is in
+// +kubebuilder:validation:Enum=Pending;Merging;RollingOut;Gating;Paused;CuttingOver;Draining;Merged;Demerging;RollingBack;RolledBack;Failed
+type MergePhase string
+
+const (
+	// PhasePending means the controller has not acted on the SvcMergerObj yet
+	PhasePending MergePhase = "Pending"
+	// PhaseMerging means member workloads are being relabeled and the merged Service set up
+	PhaseMerging MergePhase = "Merging"
+	// PhaseRollingOut means the controller waits for the member workloads to roll out their relabeled pods
+	PhaseRollingOut MergePhase = "RollingOut"
+	// PhaseGating means a batch of a progressive merge is being checked by the health gate
+	PhaseGating MergePhase = "Gating"
+	// PhasePaused means a progressive merge is held, by spec.rollout.paused or by a failed health gate
+	PhasePaused MergePhase = "Paused"
+	// PhaseCuttingOver means the controller waits for the merged Service to have ready endpoints of every new member
+	PhaseCuttingOver MergePhase = "CuttingOver"
+	// PhaseDraining means the merged Service is ready and the original Services are kept for the drain delay
+	PhaseDraining MergePhase = "Draining"
+	// PhaseMerged means every member is served by the merged Service
+	PhaseMerged MergePhase = "Merged"
+	// PhaseDemerging means the merge is being rolled back
+	PhaseDemerging MergePhase = "Demerging"
+	// PhaseRollingBack means an operation hit the retry limit and the steps it did are being undone
+	PhaseRollingBack MergePhase = "RollingBack"
+	// PhaseRolledBack means the last operation was rolled back, it is tried again once the spec changes
+	PhaseRolledBack MergePhase = "RolledBack"
+	// PhaseFailed means the last reconcile failed, see the Degraded condition
+	PhaseFailed MergePhase = "Failed"
+)
+
+// OperationType is the kind of change an operation makes to the merge
+// +kubebuilder:validation:Enum=Merge;Update;Demerge
+type OperationType string
+
+const (
+	// OperationMerge creates the merge
+	OperationMerge OperationType = "Merge"
+	// OperationUpdate adds or removes members of an existing merge
+	OperationUpdate OperationType = "Update"
+	// OperationDemerge rolls back the whole merge when the SvcMergerObj is deleted
+	OperationDemerge OperationType = "Demerge"
+)
+
+// OperationState is the state of an operation
+// +kubebuilder:validation:Enum=Running;Completed;RollingBack;RolledBack
+type OperationState string
+
+const (
+	// OperationRunning means steps of the operation are still to be done
+	OperationRunning OperationState = "Running"
+	// OperationCompleted means every step of the operation is done
+	OperationCompleted OperationState = "Completed"
+	// OperationRollingBack means the steps done so far are being undone
+	OperationRollingBack OperationState = "RollingBack"
+	// OperationRolledBack means the steps done were undone after the retry limit was hit
+	OperationRolledBack OperationState = "RolledBack"
+)
+
+// StepAction is what a journal step does
+// +kubebuilder:validation:Enum=Demerge;Label;Rollout;MergedService;Gate;Cutover;DeleteMergedService
+type StepAction string
+
+const (
+	// StepDemerge restores a member Service and frees its workloads
+	StepDemerge StepAction = "Demerge"
+	// StepLabel puts the merge labels on the workloads of a member
+	StepLabel StepAction = "Label"
+	// StepRollout waits for the relabeled workloads of a member to roll out
+	StepRollout StepAction = "Rollout"
+	// StepMergedService creates or updates the merged Service and its endpoints
+	StepMergedService StepAction = "MergedService"
+	// StepGate waits for a member of a progressive merge to pass the health gate
+	StepGate StepAction = "Gate"
+	// StepCutover snapshots and deletes the original Service of a member
+	StepCutover StepAction = "Cutover"
+	// StepDeleteMergedService deletes the merged Service
+	StepDeleteMergedService StepAction = "DeleteMergedService"
+)
+
+// StepState is the state of a journal step
+// +kubebuilder:validation:Enum=Pending;Done;Failed;RolledBack
+type StepState string
+
+const (
+	// StepPending means the step has not been done yet
+	StepPending StepState = "Pending"
+	// StepDone means the step is done and is skipped when the operation is resumed
+	StepDone StepState = "Done"
+	// StepFailed means the last attempt of the step failed, see Message
+	StepFailed StepState = "Failed"
+	// StepRolledBack means the step was undone
+	StepRolledBack StepState = "RolledBack"
+)
+
+// JournalStep is one step of an operation
+type JournalStep struct {
+	// Action of the step
+	Action StepAction `json:"action"`
+
+	// Service is the member Service the step works on, empty for steps on the merged Service
+	// +optional
+	Service string `json:"service,omitempty"`
+
+	// State of the step
+	State StepState `json:"state"`
+
+	// Created is set when the step created the object it works on, so that a rollback deletes it
+	// +optional
+	Created bool `json:"created,omitempty"`
+
+	// Message gives details about the last attempt of the step
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Batch of a progressive merge the step belongs to, counted from 1. Steps outside of the batches have none.
+	// +optional
+	Batch int32 `json:"batch,omitempty"`
+}
+
+// OperationStatus is the journal of the last merge, update or demerge. The steps are done in order;
+// a retry resumes from the first step that is not done.
+type OperationStatus struct {
+	// Type of the operation
+	Type OperationType `json:"type"`
+
+	// Generation of the spec the operation was planned for
+	Generation int64 `json:"generation"`
+
+	// State of the operation
+	State OperationState `json:"state"`
+
+	// Attempts counts the failed attempts in a row of the current step
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// StartedAt is when the operation was planned
+	StartedAt metav1.Time `json:"startedAt"`
+
+	// Steps of the operation, in the order they are done
+	// +optional
+	Steps []JournalStep `json:"steps,omitempty"`
+}
+
+// RolloutState is the state of a progressive merge
+// +kubebuilder:validation:Enum=Progressing;Gating;Paused;Completed
+type RolloutState string
+
+const (
+	// RolloutProgressing means a batch is being brought in
+	RolloutProgressing RolloutState = "Progressing"
+	// RolloutGating means the health gate is checking the current batch
+	RolloutGating RolloutState = "Gating"
+	// RolloutPaused means the rollout is held, see Message
+	RolloutPaused RolloutState = "Paused"
+	// RolloutCompleted means every batch passed its gate
+	RolloutCompleted RolloutState = "Completed"
+)
+
+// RolloutStatus reports the progress of a progressive merge
+type RolloutStatus struct {
+	// State of the rollout
+	State RolloutState `json:"state"`
+
+	// Batch is the batch being brought in, counted from 1
+	// +optional
+	Batch int32 `json:"batch,omitempty"`
+
+	// Batches is the number of batches of the rollout
+	Batches int32 `json:"batches"`
+
+	// Members is the number of members the rollout brings in
+	Members int32 `json:"members"`
+
+	// Passed is the number of members that passed their health gate
+	Passed int32 `json:"passed"`
+
+	// GateStartedAt is when the health gate started to check the current batch
+	// +optional
+	GateStartedAt *metav1.Time `json:"gateStartedAt,omitempty"`
+
+	// RestartBaseline holds the container restarts of the pods of every member of the current batch when the
+	// gate started, the restarts the gate allows are counted from there
+	// +optional
+	RestartBaseline map[string]int32 `json:"restartBaseline,omitempty"`
+
+	// Message gives details about the state, e.g. why the rollout is paused
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MemberState is the state of a single member Service of the merge
+// +kubebuilder:validation:Enum=Pending;Merged;Detaching;Failed
+type MemberState string
+
+const (
+	// MemberPending means the member is listed in the spec but not merged yet
+	MemberPending MemberState = "Pending"
+	// MemberMerged means the member's pods are served by the merged Service and the original Service is gone
+	MemberMerged MemberState = "Merged"
+	// MemberDetaching means the member is being taken out of the merge and its Service restored
+	MemberDetaching MemberState = "Detaching"
+	// MemberFailed means the last operation on this member failed, see Message
+	MemberFailed MemberState = "Failed"
+)
+
+// MemberStatus reports the state of one member Service
+type MemberStatus struct {
+	// Name of the member Service
+	Name string `json:"name"`
+
+	// State of the member in the merge lifecycle
+	State MemberState `json:"state"`
+
+	// Message gives details about the current state, mostly set on failures
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// ReadySince is when the merged Service first held enough ready endpoints of the member. The original
+	// Service is deleted once the drain delay has passed from then on.
+	// +optional
+	ReadySince *metav1.Time `json:"readySince,omitempty"`
+
+	// SharePercent is the share of the ready endpoints of the merged Service that belong to the member, and
+	// so of the connections it gets. It is reported for the Labels and EndpointSlice strategies.
+	// +optional
+	SharePercent *int32 `json:"sharePercent,omitempty"`
+
+	// Selector is the pod selector of the member, from its Service or from its snapshot once the Service is gone
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// MergedServiceStatus references the Service created by the merge
+type MergedServiceStatus struct {
+	// Name of the merged Service
+	Name string `json:"name"`
+
+	// ClusterIP assigned to the merged Service
+	// +optional
+	ClusterIP string `json:"clusterIP,omitempty"`
+
+	// Port is the first port exposed by the merged Service
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	// Ports lists every port of the merged Service and the member port it comes from
+	// +optional
+	Ports []MergedPortStatus `json:"ports,omitempty"`
+}
+
+// MergedPortStatus describes one port of the merged Service
+type MergedPortStatus struct {
+	// Name of the port on the merged Service
+	Name string `json:"name"`
+
+	// Port number on the merged Service
+	Port int32 `json:"port"`
+
+	// Protocol of the port
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// Service is the member Service the port was taken from
+	Service string `json:"service"`
+
+	// TargetPort the traffic is sent to on the member pods
+	// +optional
+	TargetPort intstr.IntOrString `json:"targetPort,omitempty"`
+
+	// ReadyEndpoints is the number of ready endpoints behind the port, reported when the controller writes
+	// the EndpointSlices of the merged Service
+	// +optional
+	ReadyEndpoints *int32 `json:"readyEndpoints,omitempty"`
 }
 
 // SvcMergerObjStatus defines the observed state of SvcMergerObj
 type SvcMergerObjStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ObservedGeneration is the generation of the spec last acted upon by the controller
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Phase is the step of the merge lifecycle the SvcMergerObj is in
+	// +optional
+	Phase MergePhase `json:"phase,omitempty"`
+
+	// Conditions holds the Ready, Progressing and Degraded conditions
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// MergedService references the Service created by the merge
+	// +optional
+	MergedService *MergedServiceStatus `json:"mergedService,omitempty"`
+
+	// AllocatedPort is the port the controller allocated for the first port of the merged Service when
+	// spec.mergedService.port is empty. It is kept until the SvcMergerObj is deleted.
+	// +optional
+	AllocatedPort int32 `json:"allocatedPort,omitempty"`
+
+	// KeysMigrated is set once nothing of the keys written by older versions of the controller is left
+	// +optional
+	KeysMigrated bool `json:"keysMigrated,omitempty"`
+
+	// ResolvedServices lists the member Services the spec resolves to: the listed ones in their order,
+	// followed by the ones picked by the service selector
+	// +optional
+	ResolvedServices []string `json:"resolvedServices,omitempty"`
+
+	// Routes reports the Ingress or HTTPRoutes generated from spec.routing
+	// +optional
+	Routes []RouteStatus `json:"routes,omitempty"`
+
+	// Proxy reports the proxy of the Proxy strategy
+	// +optional
+	Proxy *ProxyStatus `json:"proxy,omitempty"`
+
+	// Members lists every member Service and its state
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Members []MemberStatus `json:"members,omitempty"`
+
+	// Operation is the journal of the last merge, update or demerge
+	// +optional
+	Operation *OperationStatus `json:"operation,omitempty"`
+
+	// Rollout reports the progress of a progressive merge
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+}
+
+// RouteStatus reports one generated routing object
+type RouteStatus struct {
+	// Kind of the object, Ingress or HTTPRoute
+	Kind string `json:"kind"`
+
+	// Name of the object
+	Name string `json:"name"`
+
+	// Accepted is True once the ingress controller assigned an address to the Ingress, or every parent
+	// Gateway accepted the HTTPRoute; False if a Gateway refused it and Unknown until they report back
+	Accepted metav1.ConditionStatus `json:"accepted"`
+
+	// Addresses the Ingress is reachable on
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Message explains why the object is not accepted (yet)
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ProxyStatus reports the proxy deployed for the Proxy strategy
+type ProxyStatus struct {
+	// Deployment running the proxy
+	Deployment string `json:"deployment"`
+
+	// ConfigMap holding the routing table of the proxy
+	ConfigMap string `json:"configMap"`
+
+	// Listeners is the number of ports the proxy listens on
+	Listeners int32 `json:"listeners"`
+
+	// ReadyReplicas of the proxy Deployment
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Service",type=string,JSONPath=`.status.mergedService.name`
+//+kubebuilder:printcolumn:name="Cluster-IP",type=string,JSONPath=`.status.mergedService.clusterIP`
+//+kubebuilder:printcolumn:name="Port",type=integer,JSONPath=`.status.mergedService.port`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // SvcMergerObj is the Schema for the svcmergerobjs API
 type SvcMergerObj struct {
@@ -50,6 +963,28 @@ type SvcMergerObj struct {
 	Status SvcMergerObjStatus `json:"status,omitempty"`
 }
 
+// MemberServices returns every Service the SvcMergerObj lists or last resolved from its service selector
+func (r *SvcMergerObj) MemberServices() []string {
+	seen := make(map[string]bool)
+	var services []string
+	for _, svc := range append(append([]string(nil), r.Spec.Services...), r.Status.ResolvedServices...) {
+		if !seen[svc] {
+			seen[svc] = true
+			services = append(services, svc)
+		}
+	}
+	return services
+}
+
+// MergedServiceName returns the name of the merged Service, set by the service template or else the name
+// of the SvcMergerObj
+func (r *SvcMergerObj) MergedServiceName() string {
+	if r.Spec.ServiceTemplate != nil && r.Spec.ServiceTemplate.Metadata.Name != "" {
+		return r.Spec.ServiceTemplate.Metadata.Name
+	}
+	return r.Name
+}
+
 //+kubebuilder:object:root=true
 
 // SvcMergerObjList contains a list of SvcMergerObj
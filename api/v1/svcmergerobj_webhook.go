@@ -0,0 +1,574 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var svcmergerobjlog = logf.Log.WithName("svcmergerobj-resource")
+
+// SetupWebhookWithManager registers the validating webhook of SvcMergerObj with the manager
+func (r *SvcMergerObj) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&svcMergerObjValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-newproj-controller-proj-v1-svcmergerobj,mutating=false,failurePolicy=fail,sideEffects=None,groups=newproj.controller.proj,resources=svcmergerobjs,verbs=create;update,versions=v1,name=vsvcmergerobj.kb.io,admissionReviewVersions=v1
+
+// svcMergerObjValidator checks the member Services of a SvcMergerObj against the cluster, which is why it
+// needs a client and can't be implemented on the type itself
+type svcMergerObjValidator struct {
+	client.Client
+}
+
+var _ admission.CustomValidator = &svcMergerObjValidator{}
+
+// ValidateCreate implements admission.CustomValidator
+func (v *svcMergerObjValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	merger, ok := obj.(*SvcMergerObj)
+	if !ok {
+		return nil, fmt.Errorf("expected a SvcMergerObj but got a %T", obj)
+	}
+	svcmergerobjlog.Info("validate create", "name", merger.Name)
+	return v.validate(ctx, merger, nil)
+}
+
+// ValidateUpdate implements admission.CustomValidator
+func (v *svcMergerObjValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	merger, ok := newObj.(*SvcMergerObj)
+	if !ok {
+		return nil, fmt.Errorf("expected a SvcMergerObj but got a %T", newObj)
+	}
+	old, ok := oldObj.(*SvcMergerObj)
+	if !ok {
+		return nil, fmt.Errorf("expected a SvcMergerObj but got a %T", oldObj)
+	}
+	svcmergerobjlog.Info("validate update", "name", merger.Name)
+
+	// Updates that leave the spec alone (finalizers, labels, ...) are always let through, the controller
+	// has to be able to release an object whose members are gone
+	if reflect.DeepEqual(old.Spec, merger.Spec) || !merger.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return v.validate(ctx, merger, old)
+}
+
+// ValidateDelete implements admission.CustomValidator, deletes are not validated
+func (v *svcMergerObjValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate rejects member lists the controller can't merge and warns about the ones it will merge only
+// partially. On update, members that the old object already merged are allowed although their original
+// Service no longer exists.
+func (v *svcMergerObjValidator) validate(ctx context.Context, merger *SvcMergerObj, old *SvcMergerObj) (admission.Warnings, error) {
+	services_path := field.NewPath("spec").Child("services")
+	var all_errs field.ErrorList
+
+	if len(merger.Spec.Services) == 0 && merger.Spec.ServiceSelector == nil {
+		all_errs = append(all_errs, field.Required(services_path, "at least one member service or a service selector is needed"))
+	}
+
+	merged_members := make(map[string]bool)
+	if old != nil {
+		for _, member := range old.Status.Members {
+			if member.State == MemberMerged || member.State == MemberDetaching {
+				merged_members[member.Name] = true
+			}
+		}
+	}
+
+	merger_list := &SvcMergerObjList{}
+	if err := v.List(ctx, merger_list, client.InNamespace(merger.Namespace)); err != nil {
+		return nil, apierrors.NewInternalError(fmt.Errorf("not able to list SvcMergerObjs: %w", err))
+	}
+
+	seen := make(map[string]bool)
+	member_specs := make(map[string]*corev1.Service)
+	members := append([]string(nil), merger.Spec.Services...)
+	var claim_warnings admission.Warnings
+	for i, svc := range merger.Spec.Services {
+		path := services_path.Index(i)
+		if seen[svc] {
+			all_errs = append(all_errs, field.Duplicate(path, svc))
+			continue
+		}
+		seen[svc] = true
+
+		if svc == merger.MergedServiceName() {
+			all_errs = append(all_errs, field.Invalid(path, svc, "this is the merged service of the SvcMergerObj itself"))
+			continue
+		}
+		if other := mergedServiceOf(merger_list, merger.Name, svc); other != "" {
+			all_errs = append(all_errs, field.Forbidden(path, fmt.Sprintf("service %s is the merged service of SvcMergerObj %s", svc, other)))
+			continue
+		}
+		// Services listed by another SvcMergerObj are claimed by one of them, the other one waits in Conflict
+		listed_by := listedBy(merger_list, merger.Name, svc)
+		if len(listed_by) > 0 {
+			claim_warnings = append(claim_warnings, fmt.Sprintf("service %s is also listed by SvcMergerObj %s, the merge waits in Conflict while it is claimed there (see spec.priority)",
+				svc, strings.Join(listed_by, ", ")))
+		}
+
+		service := &corev1.Service{}
+		err := v.Get(ctx, types.NamespacedName{Name: svc, Namespace: merger.Namespace}, service)
+		if apierrors.IsNotFound(err) {
+			// gone because it is merged, here or by one of the SvcMergerObjs listing it as well
+			if !merged_members[svc] && len(listed_by) == 0 {
+				all_errs = append(all_errs, field.NotFound(path, svc))
+			}
+			continue
+		} else if err != nil {
+			return nil, apierrors.NewInternalError(fmt.Errorf("not able to fetch service %s: %w", svc, err))
+		}
+		member_specs[svc] = service
+	}
+
+	// Services picked by the selector are checked like listed ones, except that merged Services are left out
+	if merger.Spec.ServiceSelector != nil {
+		selector_path := field.NewPath("spec").Child("serviceSelector")
+		selector, err := metav1.LabelSelectorAsSelector(merger.Spec.ServiceSelector)
+		if err != nil {
+			all_errs = append(all_errs, field.Invalid(selector_path, merger.Spec.ServiceSelector, err.Error()))
+		} else {
+			picked, err := v.selectServices(ctx, merger, merger_list, selector, seen)
+			if err != nil {
+				return nil, apierrors.NewInternalError(err)
+			}
+			if selector.Empty() {
+				claim_warnings = append(claim_warnings, "spec.serviceSelector is empty and picks every service of the namespace")
+			} else if len(picked) == 0 {
+				claim_warnings = append(claim_warnings, "spec.serviceSelector matches no service yet, services join the merge as they are labeled")
+			}
+			for _, service := range picked {
+				if listed_by := listedBy(merger_list, merger.Name, service.Name); len(listed_by) > 0 {
+					claim_warnings = append(claim_warnings, fmt.Sprintf("service %s picked by the selector is also a member of SvcMergerObj %s, it is left out while it is claimed there",
+						service.Name, strings.Join(listed_by, ", ")))
+				}
+				member_specs[service.Name] = service
+				members = append(members, service.Name)
+			}
+		}
+	}
+
+	// Routing rules can only send requests to members
+	var routing_warnings admission.Warnings
+	if routing := merger.Spec.Routing; routing != nil {
+		routing_path := field.NewPath("spec").Child("routing")
+		if routing.Kind == RoutingHTTPRoute && len(routing.ParentRefs) == 0 {
+			all_errs = append(all_errs, field.Required(routing_path.Child("parentRefs"), "HTTPRoutes need at least one Gateway to attach to"))
+		}
+		is_member := make(map[string]bool)
+		for _, svc := range members {
+			is_member[svc] = true
+		}
+		for i, rule := range routing.Rules {
+			if is_member[rule.Service] {
+				continue
+			}
+			if merger.Spec.ServiceSelector == nil {
+				all_errs = append(all_errs, field.Invalid(routing_path.Child("rules").Index(i).Child("service"), rule.Service, "not a member service"))
+			} else {
+				routing_warnings = append(routing_warnings, fmt.Sprintf("service %s of spec.routing.rules[%d] is not a member yet, the rule is left out until the selector picks it", rule.Service, i))
+			}
+		}
+	}
+
+	// Proxy listeners route to members, TCP listeners have nothing to route on and take a single route
+	var proxy_warnings admission.Warnings
+	if proxy := merger.Spec.Proxy; proxy != nil {
+		listeners_path := field.NewPath("spec").Child("proxy", "listeners")
+		if merger.Spec.Strategy != StrategyProxy {
+			proxy_warnings = append(proxy_warnings, "spec.proxy is not used, the strategy is not Proxy")
+		}
+		is_member := make(map[string]bool)
+		for _, svc := range members {
+			is_member[svc] = true
+		}
+		ports := make(map[int32]bool)
+		for i, listener := range proxy.Listeners {
+			listener_path := listeners_path.Index(i)
+			if ports[listener.Port] {
+				all_errs = append(all_errs, field.Duplicate(listener_path.Child("port"), listener.Port))
+			}
+			ports[listener.Port] = true
+			if (listener.Protocol == "" || listener.Protocol == ProxyTCP) && len(listener.Routes) > 1 {
+				all_errs = append(all_errs, field.TooMany(listener_path.Child("routes"), len(listener.Routes), 1))
+			}
+			for j, route := range listener.Routes {
+				route_path := listener_path.Child("routes").Index(j)
+				if route.Host != "" && (listener.Protocol == "" || listener.Protocol == ProxyTCP) {
+					all_errs = append(all_errs, field.Invalid(route_path.Child("host"), route.Host, "TCP listeners can't match on a host"))
+				}
+				if route.PathPrefix != "" && listener.Protocol != ProxyHTTP {
+					all_errs = append(all_errs, field.Invalid(route_path.Child("pathPrefix"), route.PathPrefix, "only HTTP listeners can match on a path"))
+				}
+				if is_member[route.Service] {
+					continue
+				}
+				if merger.Spec.ServiceSelector == nil {
+					all_errs = append(all_errs, field.Invalid(route_path.Child("service"), route.Service, "not a member service"))
+				} else {
+					proxy_warnings = append(proxy_warnings, fmt.Sprintf("service %s of spec.proxy.listeners[%d].routes[%d] is not a member yet, the route is left out until the selector picks it", route.Service, i, j))
+				}
+			}
+		}
+	}
+
+	// Weights are applied by the EndpointSlice strategy and by HTTPRoutes only
+	var weight_warnings admission.Warnings
+	if len(merger.Spec.Weights) > 0 {
+		weights_path := field.NewPath("spec").Child("weights")
+		if merger.Spec.Strategy != StrategyEndpointSlice && (merger.Spec.Routing == nil || merger.Spec.Routing.Kind != RoutingHTTPRoute) {
+			weight_warnings = append(weight_warnings, fmt.Sprintf("spec.weights is not used, neither the strategy %s nor the routing can weight traffic", merger.Spec.Strategy))
+		}
+		is_member := make(map[string]bool)
+		for _, svc := range members {
+			is_member[svc] = true
+		}
+		weighted := make(map[string]bool)
+		for i, weight := range merger.Spec.Weights {
+			weighted[weight.Service] = true
+			if is_member[weight.Service] {
+				continue
+			}
+			if merger.Spec.ServiceSelector == nil {
+				all_errs = append(all_errs, field.Invalid(weights_path.Index(i).Child("service"), weight.Service, "not a member service"))
+			} else {
+				weight_warnings = append(weight_warnings, fmt.Sprintf("service %s of spec.weights[%d] is not a member yet", weight.Service, i))
+			}
+		}
+		total := int64(0)
+		for _, svc := range members {
+			if !weighted[svc] {
+				total++
+			}
+		}
+		for _, weight := range merger.Spec.Weights {
+			if is_member[weight.Service] {
+				total += int64(weight.Weight)
+			}
+		}
+		if total == 0 && len(members) > 0 {
+			weight_warnings = append(weight_warnings, "every member has a weight of 0, the merged service is left without endpoints")
+		}
+	}
+
+	// Port mappings are checked like the controller builds the merged ports, the listeners of the proxy
+	// take their place
+	var port_warnings admission.Warnings
+	if len(merger.Spec.Ports) > 0 && !proxyListeners(merger) {
+		port_errs, warnings := validatePortMappings(merger, members, member_specs)
+		all_errs = append(all_errs, port_errs...)
+		port_warnings = warnings
+	}
+
+	// A gate that times out before it can open fails on any check that fails late in the watch
+	var rollout_warnings admission.Warnings
+	if rollout := merger.Spec.Rollout; rollout != nil && rollout.Gate != nil && rollout.Gate.StableFor != nil {
+		timeout := 5 * time.Minute
+		if rollout.Gate.Timeout != nil {
+			timeout = rollout.Gate.Timeout.Duration
+		}
+		if timeout < rollout.Gate.StableFor.Duration {
+			rollout_warnings = append(rollout_warnings, fmt.Sprintf("spec.rollout.gate.timeout (%s) is shorter than spec.rollout.gate.stableFor (%s), a check failing after the timeout fails the gate",
+				timeout, rollout.Gate.StableFor.Duration))
+		}
+	}
+
+	// The merged Service can't take the name of another merged Service or of a member
+	if svc_name := merger.MergedServiceName(); svc_name != merger.Name {
+		name_path := field.NewPath("spec").Child("serviceTemplate", "metadata", "name")
+		if other := mergedServiceOf(merger_list, merger.Name, svc_name); other != "" {
+			all_errs = append(all_errs, field.Forbidden(name_path, fmt.Sprintf("service %s is the merged service of SvcMergerObj %s", svc_name, other)))
+		} else if listed_by := listedBy(merger_list, merger.Name, svc_name); len(listed_by) > 0 {
+			all_errs = append(all_errs, field.Forbidden(name_path, fmt.Sprintf("service %s is a member of SvcMergerObj %s", svc_name, strings.Join(listed_by, ", "))))
+		}
+	}
+
+	if len(all_errs) > 0 {
+		return nil, apierrors.NewInvalid(GroupVersion.WithKind("SvcMergerObj").GroupKind(), merger.Name, all_errs)
+	}
+
+	warnings := append(claim_warnings, routing_warnings...)
+	warnings = append(warnings, proxy_warnings...)
+	warnings = append(warnings, weight_warnings...)
+	warnings = append(warnings, rollout_warnings...)
+	warnings = append(warnings, port_warnings...)
+	// the listeners of the proxy take the place of the member ports, colliding or not
+	if !proxyListeners(merger) {
+		warnings = append(warnings, portCollisionWarnings(merger, members, member_specs)...)
+	}
+	if merger.Spec.MergedService != nil && merger.Spec.MergedService.Port != 0 && len(merger.Spec.Ports) > 0 {
+		warnings = append(warnings, "spec.mergedService.port is not used, spec.ports maps every port of the merged service")
+	}
+	if merger.Spec.Mode == ModeAggregate && merger.Spec.Aliases != "" && merger.Spec.Aliases != AliasNone {
+		warnings = append(warnings, "spec.aliases is not used, Aggregate mode keeps the member services")
+	}
+	selector_warnings, err := v.sharedSelectorWarnings(ctx, merger, members, member_specs)
+	if err != nil {
+		return nil, apierrors.NewInternalError(err)
+	}
+	return append(warnings, selector_warnings...), nil
+}
+
+// proxyListeners tells whether the listeners of the proxy take the place of the member ports
+func proxyListeners(merger *SvcMergerObj) bool {
+	return merger.Spec.Strategy == StrategyProxy && merger.Spec.Proxy != nil && len(merger.Spec.Proxy.Listeners) > 0
+}
+
+// mergedServiceOf returns the name of the other SvcMergerObj of the namespace whose merged Service is the named one
+func mergedServiceOf(merger_list *SvcMergerObjList, name string, svc string) string {
+	for _, other := range merger_list.Items {
+		if other.Name != name && other.MergedServiceName() == svc {
+			return other.Name
+		}
+	}
+	return ""
+}
+
+// selectServices returns the Services of the namespace the selector picks, sorted by name. Services listed by
+// name already (seen) and the merged Services of all SvcMergerObjs are left out.
+func (v *svcMergerObjValidator) selectServices(ctx context.Context, merger *SvcMergerObj, merger_list *SvcMergerObjList, selector labels.Selector, seen map[string]bool) ([]*corev1.Service, error) {
+	service_list := &corev1.ServiceList{}
+	if err := v.List(ctx, service_list, client.InNamespace(merger.Namespace)); err != nil {
+		return nil, fmt.Errorf("not able to list services: %w", err)
+	}
+	var picked []*corev1.Service
+	for i := range service_list.Items {
+		service := &service_list.Items[i]
+		if seen[service.Name] || service.Name == merger.MergedServiceName() || mergedServiceOf(merger_list, merger.Name, service.Name) != "" {
+			continue
+		}
+		if selector.Matches(labels.Set(service.Labels)) {
+			picked = append(picked, service)
+		}
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].Name < picked[j].Name })
+	return picked, nil
+}
+
+// listedBy returns the names of the other SvcMergerObjs of the namespace that have the Service as a member,
+// listed by name or picked by their selector
+func listedBy(merger_list *SvcMergerObjList, name string, svc string) []string {
+	var names []string
+	for _, other := range merger_list.Items {
+		if other.Name == name {
+			continue
+		}
+		for _, other_svc := range other.MemberServices() {
+			if other_svc == svc {
+				names = append(names, other.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// validatePortMappings checks spec.ports the way the controller builds the merged ports: every mapping has to
+// refer to a member and to one of its ports, and no merged port may be mapped twice. Members that are not
+// known yet (picked by the selector later, or gone because they are merged) are only warned about.
+func validatePortMappings(merger *SvcMergerObj, members []string, member_specs map[string]*corev1.Service) (field.ErrorList, admission.Warnings) {
+	ports_path := field.NewPath("spec").Child("ports")
+	var all_errs field.ErrorList
+	var warnings admission.Warnings
+	is_member := make(map[string]bool)
+	for _, svc := range members {
+		is_member[svc] = true
+	}
+	type port_key struct {
+		port     int32
+		protocol corev1.Protocol
+	}
+	taken := make(map[port_key]bool)
+	for i, mapping := range merger.Spec.Ports {
+		path := ports_path.Index(i)
+		protocol := corev1.ProtocolTCP
+		if !is_member[mapping.Service] {
+			if merger.Spec.ServiceSelector == nil {
+				all_errs = append(all_errs, field.Invalid(path.Child("service"), mapping.Service, "not a member service"))
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("service %s of spec.ports[%d] is not a member yet, the merge fails until the selector picks it", mapping.Service, i))
+		} else if spec, ok := member_specs[mapping.Service]; ok {
+			source, ok := FindServicePort(spec, mapping.SourcePort)
+			if !ok {
+				all_errs = append(all_errs, field.NotFound(path.Child("sourcePort"), mapping.SourcePort.String()))
+				continue
+			}
+			if source.Protocol != "" {
+				protocol = source.Protocol
+			}
+		}
+		key := port_key{port: mapping.Port, protocol: protocol}
+		if taken[key] {
+			all_errs = append(all_errs, field.Duplicate(path.Child("port"), mapping.Port))
+			continue
+		}
+		taken[key] = true
+	}
+	return all_errs, warnings
+}
+
+// FindServicePort looks up a port of the service by name or by number
+func FindServicePort(service *corev1.Service, source intstr.IntOrString) (*corev1.ServicePort, bool) {
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+		if source.Type == intstr.String && port.Name == source.StrVal {
+			return port, true
+		}
+		if source.Type == intstr.Int && port.Port == source.IntVal {
+			return port, true
+		}
+	}
+	return nil, false
+}
+
+// portCollisionWarnings lists the member ports that will be left out of the merged Service because an
+// earlier member already exposes them, or because the first port is moved onto their number by
+// spec.mergedService.port; it only applies when spec.ports is not set
+func portCollisionWarnings(merger *SvcMergerObj, members []string, member_specs map[string]*corev1.Service) admission.Warnings {
+	if len(merger.Spec.Ports) > 0 {
+		return nil
+	}
+	var warnings admission.Warnings
+	type port_key struct {
+		port     int32
+		protocol corev1.Protocol
+	}
+	taken := make(map[port_key]string)
+	var exposed *port_key
+	for _, svc := range members {
+		spec, ok := member_specs[svc]
+		if !ok {
+			continue
+		}
+		for _, port := range spec.Spec.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			key := port_key{port: port.Port, protocol: protocol}
+			if owner, ok := taken[key]; ok {
+				if merger.Spec.Strategy == StrategyEndpointSlicePerPort {
+					warnings = append(warnings, fmt.Sprintf("port %d/%s of service %s collides with service %s and will be exposed on another port number",
+						port.Port, protocol, svc, owner))
+					continue
+				}
+				warnings = append(warnings, fmt.Sprintf("port %d/%s of service %s collides with service %s and will be skipped",
+					port.Port, protocol, svc, owner))
+				continue
+			}
+			taken[key] = svc
+			if exposed == nil {
+				exposed = &port_key{protocol: protocol}
+				if merger.Spec.MergedService != nil {
+					exposed.port = merger.Spec.MergedService.Port
+				}
+			} else if key == *exposed {
+				warnings = append(warnings, fmt.Sprintf("port %d/%s of service %s collides with spec.mergedService.port and will be skipped",
+					port.Port, protocol, svc))
+			}
+		}
+	}
+	return warnings
+}
+
+// sharedSelectorWarnings lists the Deployments that are selected by more than one member, and the
+// Deployments of different members whose selectors match each other's pods. Merging them mixes up
+// which pods belong to which member.
+func (v *svcMergerObjValidator) sharedSelectorWarnings(ctx context.Context, merger *SvcMergerObj, members []string, member_specs map[string]*corev1.Service) (admission.Warnings, error) {
+	deployment_list := &appsv1.DeploymentList{}
+	if err := v.List(ctx, deployment_list, client.InNamespace(merger.Namespace)); err != nil {
+		return nil, fmt.Errorf("not able to list deployments: %w", err)
+	}
+
+	members_of := make(map[string][]string)
+	var member_deployments []appsv1.Deployment
+	for _, deployment := range deployment_list.Items {
+		template_labels := labels.Set(deployment.Spec.Template.Labels)
+		for _, svc := range members {
+			spec, ok := member_specs[svc]
+			if !ok || len(spec.Spec.Selector) == 0 {
+				continue
+			}
+			if labels.SelectorFromSet(spec.Spec.Selector).Matches(template_labels) {
+				members_of[deployment.Name] = append(members_of[deployment.Name], svc)
+			}
+		}
+		if len(members_of[deployment.Name]) > 0 {
+			member_deployments = append(member_deployments, deployment)
+		}
+	}
+
+	var warnings admission.Warnings
+	for _, deployment := range member_deployments {
+		if members := members_of[deployment.Name]; len(members) > 1 {
+			warnings = append(warnings, fmt.Sprintf("deployment %s is selected by more than one member: %s",
+				deployment.Name, strings.Join(members, ", ")))
+		}
+	}
+	for i, deployment := range member_deployments {
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil || selector.Empty() {
+			continue
+		}
+		for j, other := range member_deployments {
+			if i == j || sameMembers(members_of[deployment.Name], members_of[other.Name]) {
+				continue
+			}
+			if selector.Matches(labels.Set(other.Spec.Template.Labels)) {
+				warnings = append(warnings, fmt.Sprintf("selector of deployment %s (member %s) also matches the pods of deployment %s (member %s)",
+					deployment.Name, strings.Join(members_of[deployment.Name], ", "), other.Name, strings.Join(members_of[other.Name], ", ")))
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// sameMembers tells whether two lists hold the same members
+func sameMembers(a []string, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
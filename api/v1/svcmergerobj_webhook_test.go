@@ -0,0 +1,237 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestValidatePortMappings(t *testing.T) {
+	member_specs := map[string]*corev1.Service{
+		"web-1": {Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "http", Port: 80},
+			{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+		}}},
+		"web-2": {Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		}}},
+	}
+	tests := []struct {
+		name     string
+		mappings []PortMapping
+		selector bool
+		errs     []string // "<type> <field>"
+		warnings int
+	}{
+		{
+			name: "valid",
+			mappings: []PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("http"), Port: 8001},
+				{Service: "web-2", SourcePort: intstr.FromInt(80), Port: 8002},
+			},
+		},
+		{
+			name: "same port with another protocol",
+			mappings: []PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("dns"), Port: 8000},
+				{Service: "web-2", SourcePort: intstr.FromString("http"), Port: 8000},
+			},
+		},
+		{
+			name: "same port twice",
+			mappings: []PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("http"), Port: 8000},
+				{Service: "web-2", SourcePort: intstr.FromString("http"), Port: 8000},
+			},
+			errs: []string{"FieldValueDuplicate spec.ports[1].port"},
+		},
+		{
+			name: "not a member",
+			mappings: []PortMapping{
+				{Service: "other", SourcePort: intstr.FromInt(80), Port: 8000},
+			},
+			errs: []string{"FieldValueInvalid spec.ports[0].service"},
+		},
+		{
+			name:     "not a member yet with a selector",
+			selector: true,
+			mappings: []PortMapping{
+				{Service: "other", SourcePort: intstr.FromInt(80), Port: 8000},
+			},
+			warnings: 1,
+		},
+		{
+			name: "missing source port",
+			mappings: []PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("grpc"), Port: 8000},
+				{Service: "web-2", SourcePort: intstr.FromInt(8080), Port: 8001},
+			},
+			errs: []string{"FieldValueNotFound spec.ports[0].sourcePort", "FieldValueNotFound spec.ports[1].sourcePort"},
+		},
+		{
+			name: "merged member without a spec",
+			mappings: []PortMapping{
+				{Service: "gone", SourcePort: intstr.FromString("http"), Port: 8000},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merger := &SvcMergerObj{}
+			merger.Spec.Services = []string{"web-1", "web-2", "gone"}
+			merger.Spec.Ports = test.mappings
+			if test.selector {
+				merger.Spec.ServiceSelector = &metav1.LabelSelector{}
+			}
+			errs, warnings := validatePortMappings(merger, merger.Spec.Services, member_specs)
+			var got []string
+			for _, err := range errs {
+				got = append(got, string(err.Type)+" "+err.Field)
+			}
+			if len(got) != len(test.errs) {
+				t.Fatalf("errors = %v, want %v", got, test.errs)
+			}
+			for i := range got {
+				if got[i] != test.errs[i] {
+					t.Errorf("errors = %v, want %v", got, test.errs)
+				}
+			}
+			if len(warnings) != test.warnings {
+				t.Errorf("warnings = %v, want %d", warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	service := func(name string, port int32) client.Object {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: port}}},
+		}
+	}
+	other := func(name string, services ...string) client.Object {
+		return &SvcMergerObj{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       SvcMergerObjSpec{Services: services},
+		}
+	}
+	objs := []client.Object{service("web-1", 80), service("web-2", 81), service("web", 80), service("api", 80), other("api"), other("shop", "web-2")}
+
+	tests := []struct {
+		name     string
+		services []string
+		merged   []string
+		errs     []string
+		warnings []string
+	}{
+		{
+			name:     "members",
+			services: []string{"web-1", "web-2"},
+			warnings: []string{"service web-2 is also listed by SvcMergerObj shop"},
+		},
+		{
+			name: "empty service list",
+			errs: []string{"FieldValueRequired spec.services"},
+		},
+		{
+			name:     "duplicate member",
+			services: []string{"web-1", "web-1"},
+			errs:     []string{"FieldValueDuplicate spec.services[1]"},
+		},
+		{
+			name:     "unknown service",
+			services: []string{"web-1", "gone"},
+			errs:     []string{"FieldValueNotFound spec.services[1]"},
+		},
+		{
+			name:     "merged member",
+			services: []string{"web-1", "gone"},
+			merged:   []string{"gone"},
+		},
+		{
+			name:     "own merged service",
+			services: []string{"web-1", "web"},
+			errs:     []string{"FieldValueInvalid spec.services[1]"},
+		},
+		{
+			name:     "merged service of another SvcMergerObj",
+			services: []string{"web-1", "api"},
+			errs:     []string{"FieldValueForbidden spec.services[1]"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &svcMergerObjValidator{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+			merger := &SvcMergerObj{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+			merger.Spec.Services = test.services
+			var old *SvcMergerObj
+			if len(test.merged) > 0 {
+				old = merger.DeepCopy()
+				for _, svc := range test.merged {
+					old.Status.Members = append(old.Status.Members, MemberStatus{Name: svc, State: MemberMerged})
+				}
+			}
+
+			warnings, err := v.validate(context.Background(), merger, old)
+			var got []string
+			if err != nil {
+				status, ok := err.(*apierrors.StatusError)
+				if !ok || !apierrors.IsInvalid(err) {
+					t.Fatalf("validate() error = %v, want an Invalid status error", err)
+				}
+				for _, cause := range status.ErrStatus.Details.Causes {
+					got = append(got, string(cause.Type)+" "+cause.Field)
+				}
+			}
+			if len(got) != len(test.errs) {
+				t.Fatalf("errors = %v, want %v", got, test.errs)
+			}
+			for i := range got {
+				if got[i] != test.errs[i] {
+					t.Errorf("errors = %v, want %v", got, test.errs)
+				}
+			}
+			if len(warnings) != len(test.warnings) {
+				t.Fatalf("warnings = %v, want %v", warnings, test.warnings)
+			}
+			for i := range warnings {
+				if !strings.HasPrefix(warnings[i], test.warnings[i]) {
+					t.Errorf("warnings = %v, want %v", warnings, test.warnings)
+				}
+			}
+		})
+	}
+}
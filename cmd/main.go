@@ -52,11 +52,30 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var keyDomain string
+	var keysConfig string
+	var migrateLegacyKeys bool
+	var mergedPortRange string
+	var clusterDomain string
+	var proxyImage string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&keyDomain, "key-domain", controller.DefaultKeyDomain,
+		"The domain prefix of the label, annotation and finalizer keys written by the controller.")
+	flag.StringVar(&keysConfig, "keys-config", "",
+		"Path of a YAML file that sets keyDomain and/or single keys, on top of --key-domain.")
+	flag.BoolVar(&migrateLegacyKeys, "migrate-legacy-keys", true,
+		"Move merges made with the keys of older versions (merge, name, ...) over to the configured keys.")
+	flag.StringVar(&mergedPortRange, "merged-port-range", "",
+		"The range (<first>-<last>, e.g. 9000-9999) merged Service ports are allocated from when a SvcMergerObj doesn't set one. "+
+			"Without it the merged Service keeps the port numbers of its members.")
+	flag.StringVar(&clusterDomain, "cluster-domain", controller.DefaultClusterDomain,
+		"The DNS domain of the cluster, ExternalName aliases of deleted member Services point into it.")
+	flag.StringVar(&proxyImage, "proxy-image", "",
+		"The image of the proxy deployed for the Proxy strategy, e.g. the image of the manager, which holds /svcmerger-proxy.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,6 +84,20 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	keys, err := controller.LoadKeys(keyDomain, keysConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to load the label and annotation keys")
+		os.Exit(1)
+	}
+	var ports *controller.PortAllocator
+	if mergedPortRange != "" {
+		ports, err = controller.NewPortAllocator(mergedPortRange)
+		if err != nil {
+			setupLog.Error(err, "unable to set up the merged service port allocator")
+			os.Exit(1)
+		}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -90,12 +123,25 @@ func main() {
 	}
 
 	if err = (&controller.SvcMergerObjReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("svcmergerobj-controller"),
+
+		Keys:              keys,
+		MigrateLegacyKeys: migrateLegacyKeys,
+		Ports:             ports,
+		ClusterDomain:     clusterDomain,
+		ProxyImage:        proxyImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "SvcMergerObj")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&newprojv1.SvcMergerObj{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "SvcMergerObj")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
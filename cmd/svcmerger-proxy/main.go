@@ -0,0 +1,112 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// svcmerger-proxy is the proxy the controller deploys for the Proxy merge strategy. It serves the routing
+// table the controller writes into a ConfigMap, which is mounted as a file, and applies changes of the file
+// while it runs.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"controllerProj/internal/proxy"
+)
+
+var setupLog = ctrl.Log.WithName("setup")
+
+func main() {
+	var configPath string
+	var probeAddr string
+	var reloadInterval time.Duration
+	flag.StringVar(&configPath, "config", "/etc/svcmerger-proxy/"+proxy.ConfigKey, "The path of the routing table.")
+	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.DurationVar(&reloadInterval, "reload-interval", 2*time.Second, "How often the routing table is checked for changes.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	ctx := log.IntoContext(ctrl.SetupSignalHandler(), ctrl.Log.WithName("proxy"))
+
+	// ready is only set while every listener of the routing table is served
+	var ready atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "routing table not applied", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	probes := &http.Server{Addr: probeAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := probes.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			setupLog.Error(err, "unable to serve the probes")
+			os.Exit(1)
+		}
+	}()
+
+	server := proxy.NewServer()
+	setupLog.Info("starting proxy", "config", configPath)
+	watchConfig(ctx, server, configPath, reloadInterval, &ready)
+	server.Close()
+	probes.Shutdown(context.Background())
+}
+
+// watchConfig applies the routing table whenever the file changes, until the context is done. A table that
+// can't be read or parsed is reported and the last good one kept.
+func watchConfig(ctx context.Context, server *proxy.Server, path string, interval time.Duration, ready *atomic.Bool) {
+	l := log.FromContext(ctx)
+	var applied []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		config, raw, err := proxy.LoadConfig(path)
+		if err != nil {
+			l.Error(err, "not able to load the routing table, keeping the last one")
+		} else if applied == nil || !bytes.Equal(raw, applied) {
+			l.Info("applying routing table", "listeners", len(config.Listeners))
+			// a table that is not applied completely is applied again on the next tick
+			err := server.Apply(ctx, config)
+			if err != nil {
+				l.Error(err, "not able to apply the whole routing table")
+			} else {
+				applied = raw
+			}
+			ready.Store(err == nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// DefaultClusterDomain is the DNS domain ExternalName aliases point into when no other one is configured
+const DefaultClusterDomain = "cluster.local"
+
+// reasonAliasPortsUnreachable is the reason of the event written when an ExternalName alias can't reach every member port
+const reasonAliasPortsUnreachable = "AliasPortsUnreachable"
+
+// aliasType returns the kind of alias the SvcMergerObj puts in the place of deleted member Services
+func aliasType(obj *newprojv1.SvcMergerObj) newprojv1.AliasType {
+	if obj.Spec.Aliases == "" || keepsMemberServices(obj) {
+		return newprojv1.AliasNone
+	}
+	return obj.Spec.Aliases
+}
+
+// isAlias tells whether the Service is an alias the SvcMergerObj put in the place of one of its members
+func (r *SvcMergerObjReconciler) isAlias(obj *newprojv1.SvcMergerObj, service *corev1.Service) bool {
+	return service.Labels[r.Keys.AliasOf] == obj.Name
+}
+
+// aliasFor builds the alias of a member from the snapshot of its original Service, nil if there is to be none.
+// The alias carries the claim of the member, so that other SvcMergerObjs leave the name alone.
+func (r *SvcMergerObjReconciler) aliasFor(obj *newprojv1.SvcMergerObj, snapshot *corev1.Service) *corev1.Service {
+	alias := &corev1.Service{}
+	alias.Name = snapshot.Name
+	alias.Namespace = snapshot.Namespace
+	alias.Labels = map[string]string{r.Keys.AliasOf: obj.Name}
+	alias.Annotations = map[string]string{r.Keys.ClaimedBy: obj.Name}
+
+	switch aliasType(obj) {
+	case newprojv1.AliasExternalName:
+		alias.Spec.Type = corev1.ServiceTypeExternalName
+		alias.Spec.ExternalName = fmt.Sprintf("%s.%s.svc.%s", obj.MergedServiceName(), obj.Namespace, r.ClusterDomain)
+		for _, port := range snapshot.Spec.Ports {
+			port.NodePort = 0
+			alias.Spec.Ports = append(alias.Spec.Ports, port)
+		}
+	case newprojv1.AliasEndpoints:
+		// the original cluster IP is asked for again, clients that resolved the name before keep working
+		alias.Spec.Type = corev1.ServiceTypeClusterIP
+		alias.Spec.ClusterIP = snapshot.Spec.ClusterIP
+		alias.Spec.ClusterIPs = snapshot.Spec.ClusterIPs
+		alias.Spec.IPFamilies = snapshot.Spec.IPFamilies
+		alias.Spec.IPFamilyPolicy = snapshot.Spec.IPFamilyPolicy
+		for _, port := range snapshot.Spec.Ports {
+			port.NodePort = 0
+			alias.Spec.Ports = append(alias.Spec.Ports, port)
+		}
+	default:
+		return nil
+	}
+	return alias
+}
+
+// unreachableAliasPorts lists the ports of a member that an ExternalName alias can't reach, as the merged
+// Service doesn't expose them for the member under their original number
+func unreachableAliasPorts(obj *newprojv1.SvcMergerObj, snapshot *corev1.Service) []string {
+	var missing []string
+	for _, port := range snapshot.Spec.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		found := false
+		if obj.Status.MergedService != nil {
+			for _, merged_port := range obj.Status.MergedService.Ports {
+				if merged_port.Service == snapshot.Name && merged_port.Port == port.Port && merged_port.Protocol == string(protocol) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%d/%s", port.Port, protocol))
+		}
+	}
+	return missing
+}
+
+// syncAlias keeps the alias of a member whose original Service the cutover deleted in line with spec.aliases:
+// it is created once the original is gone, replaced when the kind of alias changes, pointed at a renamed merged
+// Service and removed when aliases are turned off. The EndpointSlices of an Endpoints alias follow the pods of
+// the member. It returns true while the original Service is still terminating and the alias has to wait.
+func (r *SvcMergerObjReconciler) syncAlias(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string) (bool, error) {
+	l := log.FromContext(ctx)
+	snapshot, ok := state.snapshots[svc]
+	if !ok {
+		return false, nil
+	}
+
+	live := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: svc, Namespace: obj.Namespace}, live)
+	if apierrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		l.Error(err, "not able to fetch alias of member service", "service", svc)
+		return false, err
+	} else if !r.isAlias(obj, live) {
+		// the original is on its way out, or was created again by hand and is taken care of by repairDrift
+		return !live.DeletionTimestamp.IsZero(), nil
+	}
+
+	desired := r.aliasFor(obj, snapshot)
+	if live != nil && (desired == nil || live.Spec.Type != desired.Spec.Type) {
+		if err := r.removeAlias(ctx, live); err != nil {
+			return false, err
+		}
+		live = nil
+	}
+	if desired == nil {
+		return false, nil
+	}
+
+	if live == nil {
+		l.Info("creating alias for member service", "service", svc, "type", aliasType(obj))
+		// restoreService falls back to a new cluster IP if the original one has been handed out
+		err := r.restoreService(ctx, desired)
+		if apierrors.IsAlreadyExists(err) {
+			return true, nil
+		}
+		if err != nil {
+			l.Error(err, "not able to create alias for member service", "service", svc)
+			return false, err
+		}
+		if missing := unreachableAliasPorts(obj, snapshot); aliasType(obj) == newprojv1.AliasExternalName && len(missing) > 0 && r.Recorder != nil {
+			r.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonAliasPortsUnreachable,
+				"the merged service doesn't expose ports %s of service %s under their own number, clients of the alias can't reach them",
+				strings.Join(missing, ", "), svc)
+		}
+		if err := r.Get(ctx, types.NamespacedName{Name: svc, Namespace: obj.Namespace}, desired); err != nil {
+			return false, err
+		}
+		live = desired
+	} else if live.Spec.ExternalName != desired.Spec.ExternalName {
+		live.Spec.ExternalName = desired.Spec.ExternalName
+		if err := r.Update(ctx, live); err != nil {
+			l.Error(err, "not able to update alias of member service", "service", svc)
+			return false, err
+		}
+	}
+
+	if aliasType(obj) != newprojv1.AliasEndpoints {
+		return false, nil
+	}
+	var ports []mergedPort
+	for i := range snapshot.Spec.Ports {
+		port := snapshot.Spec.Ports[i]
+		port.TargetPort = targetPortOf(&port)
+		ports = append(ports, mergedPort{ServicePort: port, service: svc})
+	}
+	groups, err := r.buildEndpointGroups(ctx, obj.Namespace, []string{svc}, map[string]*corev1.Service{svc: snapshot}, ports, false)
+	if err != nil {
+		return false, err
+	}
+	return false, r.syncEndpointSlices(ctx, live, groups)
+}
+
+// syncAliases brings the aliases of every merged member in line with the spec
+func (r *SvcMergerObjReconciler) syncAliases(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, merged []string) error {
+	for _, svc := range merged {
+		if _, err := r.syncAlias(ctx, obj, state, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAlias deletes an alias, so that the original Service can take its name again. Its EndpointSlices are
+// owned by it and go away with it.
+func (r *SvcMergerObjReconciler) removeAlias(ctx context.Context, alias *corev1.Service) error {
+	l := log.FromContext(ctx)
+	l.Info("removing alias of member service", "service", alias.Name)
+	if err := r.Delete(ctx, alias); client.IgnoreNotFound(err) != nil {
+		l.Error(err, "not able to delete alias of member service", "service", alias.Name)
+		return err
+	}
+	return nil
+}
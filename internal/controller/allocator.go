@@ -0,0 +1,203 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// reasonPortsExhausted is reported when the allocator has no free port left in its range
+const reasonPortsExhausted = "PortRangeExhausted"
+
+// PortAllocator hands out the port of the merged Service of every SvcMergerObj that doesn't set one. Ports are
+// unique across the cluster and don't collide with any Service of the namespace at the time they are handed
+// out. The status of the SvcMergerObjs is the record of what is assigned; the allocator only remembers the
+// ports it handed out itself, until they show up there.
+type PortAllocator struct {
+	min int32
+	max int32
+
+	mu       sync.Mutex
+	assigned map[int32]types.NamespacedName
+}
+
+// NewPortAllocator returns an allocator for a range written as <first>-<last>, e.g. 9000-9999
+func NewPortAllocator(port_range string) (*PortAllocator, error) {
+	first, last, found := strings.Cut(port_range, "-")
+	if !found {
+		return nil, fmt.Errorf("port range %q is not of the form <first>-<last>", port_range)
+	}
+	min, err := strconv.ParseInt(strings.TrimSpace(first), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("port range %q: %w", port_range, err)
+	}
+	max, err := strconv.ParseInt(strings.TrimSpace(last), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("port range %q: %w", port_range, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return nil, fmt.Errorf("port range %q has to lie within 1-65535 and start before it ends", port_range)
+	}
+	return &PortAllocator{
+		min:      int32(min),
+		max:      int32(max),
+		assigned: make(map[int32]types.NamespacedName),
+	}, nil
+}
+
+// allocate returns the port handed out to the owner before, or else the lowest port of the range that is
+// neither taken nor handed out to someone else
+func (a *PortAllocator) allocate(owner types.NamespacedName, taken map[int32]bool) (int32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for port, assigned_to := range a.assigned {
+		if assigned_to == owner && !taken[port] {
+			return port, nil
+		}
+	}
+	for port := a.min; port <= a.max; port++ {
+		if _, assigned := a.assigned[port]; assigned || taken[port] {
+			continue
+		}
+		a.releaseLocked(owner)
+		a.assigned[port] = owner
+		return port, nil
+	}
+	return 0, newReasonError(reasonPortsExhausted, fmt.Errorf("no free port left in the range %d-%d", a.min, a.max))
+}
+
+// reserve records a port the owner already has, e.g. one read back from its status
+func (a *PortAllocator) reserve(owner types.NamespacedName, port int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked(owner)
+	a.assigned[port] = owner
+}
+
+// release gives back the port of the owner
+func (a *PortAllocator) release(owner types.NamespacedName) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked(owner)
+}
+
+func (a *PortAllocator) releaseLocked(owner types.NamespacedName) {
+	for port, assigned_to := range a.assigned {
+		if assigned_to == owner {
+			delete(a.assigned, port)
+		}
+	}
+}
+
+// mergedServicePort returns the port the first port of the merged Service is exposed on: the one set in the
+// spec, else the one allocated before, else a new one from the allocator. Merges made before the allocator
+// existed keep the port their merged Service has. An allocated port is recorded in the status. Without a
+// port in the spec or an allocator it returns 0, the first port keeps the number of its member port.
+func (r *SvcMergerObjReconciler) mergedServicePort(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState) (int32, error) {
+	l := log.FromContext(ctx)
+	owner := types.NamespacedName{Name: obj.Name, Namespace: obj.Namespace}
+
+	if obj.Spec.MergedService != nil && obj.Spec.MergedService.Port != 0 {
+		if obj.Status.AllocatedPort != 0 {
+			if r.Ports != nil {
+				r.Ports.release(owner)
+			}
+			obj.Status.AllocatedPort = 0
+		}
+		return obj.Spec.MergedService.Port, nil
+	}
+	if r.Ports == nil {
+		// a port allocated while the controller had a range doesn't move
+		return obj.Status.AllocatedPort, nil
+	}
+	if obj.Status.AllocatedPort != 0 {
+		r.Ports.reserve(owner, obj.Status.AllocatedPort)
+		return obj.Status.AllocatedPort, nil
+	}
+	if merged_svc := state.mergedService; merged_svc != nil && len(merged_svc.Spec.Ports) > 0 {
+		obj.Status.AllocatedPort = merged_svc.Spec.Ports[0].Port
+		r.Ports.reserve(owner, obj.Status.AllocatedPort)
+		return obj.Status.AllocatedPort, nil
+	}
+
+	// Ports of every other merge in the cluster and of every Service in the namespace are taken
+	taken := make(map[int32]bool)
+	merger_list := &newprojv1.SvcMergerObjList{}
+	if err := r.List(ctx, merger_list); err != nil {
+		l.Error(err, "not able to list svcmergerobjs")
+		return 0, err
+	}
+	for _, other := range merger_list.Items {
+		if other.Name == obj.Name && other.Namespace == obj.Namespace {
+			continue
+		}
+		if other.Status.AllocatedPort != 0 {
+			taken[other.Status.AllocatedPort] = true
+		}
+		if other.Spec.MergedService != nil && other.Spec.MergedService.Port != 0 {
+			taken[other.Spec.MergedService.Port] = true
+		}
+	}
+	service_list := &corev1.ServiceList{}
+	if err := r.List(ctx, service_list, client.InNamespace(obj.Namespace)); err != nil {
+		l.Error(err, "not able to list services")
+		return 0, err
+	}
+	for _, service := range service_list.Items {
+		for _, port := range service.Spec.Ports {
+			taken[port.Port] = true
+		}
+	}
+
+	port, err := r.Ports.allocate(owner, taken)
+	if err != nil {
+		return 0, err
+	}
+	l.Info("allocated port for merged service", "port", port)
+	obj.Status.AllocatedPort = port
+	return port, nil
+}
+
+// exposeMergedPort moves the first merged port to the given number. A later port that uses the number
+// already is left out and returned as a collision.
+func exposeMergedPort(ports []mergedPort, number int32) ([]mergedPort, []string) {
+	if len(ports) == 0 {
+		return ports, nil
+	}
+	ports[0].Port = number
+	kept := ports[:1]
+	var collisions []string
+	for _, port := range ports[1:] {
+		if port.Port == number && port.Protocol == ports[0].Protocol {
+			collisions = append(collisions, fmt.Sprintf("port %d/%s of %s collides with the merged service port", number, port.Protocol, port.service))
+			continue
+		}
+		kept = append(kept, port)
+	}
+	return kept, collisions
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+func TestNewPortAllocator(t *testing.T) {
+	tests := []struct {
+		port_range string
+		min, max   int32
+		fails      bool
+	}{
+		{port_range: "9000-9999", min: 9000, max: 9999},
+		{port_range: " 80 - 80 ", min: 80, max: 80},
+		{port_range: "9000", fails: true},
+		{port_range: "a-b", fails: true},
+		{port_range: "0-10", fails: true},
+		{port_range: "9000-70000", fails: true},
+		{port_range: "9999-9000", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.port_range, func(t *testing.T) {
+			allocator, err := NewPortAllocator(test.port_range)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got the range %d-%d", allocator.min, allocator.max)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if allocator.min != test.min || allocator.max != test.max {
+				t.Errorf("range = %d-%d, want %d-%d", allocator.min, allocator.max, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestPortAllocatorAllocate(t *testing.T) {
+	owner := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+	allocator, err := NewPortAllocator("9000-9002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocate := func(name string, taken map[int32]bool, want int32) {
+		t.Helper()
+		port, err := allocator.allocate(owner(name), taken)
+		if err != nil {
+			t.Fatalf("allocate(%s) failed: %v", name, err)
+		}
+		if port != want {
+			t.Fatalf("allocate(%s) = %d, want %d", name, port, want)
+		}
+	}
+
+	// ports of the services of the namespace are skipped
+	allocate("a", map[int32]bool{9000: true}, 9001)
+	// the owner gets its port again
+	allocate("a", nil, 9001)
+	allocate("b", nil, 9000)
+	// a port read back from the status of another owner is not handed out
+	allocator.reserve(owner("c"), 9002)
+	_, err = allocator.allocate(owner("d"), nil)
+	var reason_err *reasonError
+	if !errors.As(err, &reason_err) || reason_err.reason != reasonPortsExhausted {
+		t.Fatalf("expected a %s error once the range is exhausted, got %v", reasonPortsExhausted, err)
+	}
+	// a released port is handed out again
+	allocator.release(owner("b"))
+	allocate("d", nil, 9000)
+	// reserving moves the owner over, its old port is free again
+	allocator.reserve(owner("a"), 9500)
+	allocate("e", nil, 9001)
+	// the port of an owner that got taken in the meantime is replaced, and the old one freed
+	allocator.release(owner("d"))
+	allocate("c", map[int32]bool{9002: true}, 9000)
+	allocate("f", nil, 9002)
+}
+
+func TestExposeMergedPort(t *testing.T) {
+	port := func(svc string, number int32, protocol corev1.Protocol) mergedPort {
+		return mergedPort{
+			ServicePort: corev1.ServicePort{Name: mergedPortName(svc, fmt.Sprint(number)), Port: number, Protocol: protocol},
+			service:     svc,
+		}
+	}
+	tests := []struct {
+		name       string
+		ports      []mergedPort
+		number     int32
+		want       []int32
+		collisions int
+	}{
+		{name: "no ports", number: 9000},
+		{
+			name:   "first port moved",
+			ports:  []mergedPort{port("web-1", 80, corev1.ProtocolTCP), port("web-2", 8080, corev1.ProtocolTCP)},
+			number: 9000,
+			want:   []int32{9000, 8080},
+		},
+		{
+			name:       "later port on the number is dropped and reported",
+			ports:      []mergedPort{port("web-1", 80, corev1.ProtocolTCP), port("web-2", 9000, corev1.ProtocolTCP)},
+			number:     9000,
+			want:       []int32{9000},
+			collisions: 1,
+		},
+		{
+			name:   "another protocol on the number is kept",
+			ports:  []mergedPort{port("web-1", 80, corev1.ProtocolTCP), port("web-2", 9000, corev1.ProtocolUDP)},
+			number: 9000,
+			want:   []int32{9000, 9000},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ports, collisions := exposeMergedPort(test.ports, test.number)
+			var got []int32
+			for _, port := range ports {
+				got = append(got, port.Port)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ports = %v, want %v", got, test.want)
+			}
+			if len(collisions) != test.collisions {
+				t.Errorf("collisions = %v, want %d", collisions, test.collisions)
+			}
+		})
+	}
+}
+
+func TestMergedServicePortWithoutRange(t *testing.T) {
+	r := &SvcMergerObjReconciler{}
+	state := &mergeState{}
+	tests := []struct {
+		name      string
+		spec      int32
+		allocated int32
+		want      int32
+	}{
+		{name: "carry over", want: 0},
+		{name: "set in the spec", spec: 8000, allocated: 9001, want: 8000},
+		{name: "allocated before", allocated: 9001, want: 9001},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj := &newprojv1.SvcMergerObj{}
+			if test.spec != 0 {
+				obj.Spec.MergedService = &newprojv1.MergedServiceSpec{Port: test.spec}
+			}
+			obj.Status.AllocatedPort = test.allocated
+			port, err := r.mergedServicePort(context.Background(), obj, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if port != test.want {
+				t.Errorf("port = %d, want %d", port, test.want)
+			}
+			if test.spec != 0 && obj.Status.AllocatedPort != 0 {
+				t.Errorf("the allocated port %d is kept next to the port of the spec", obj.Status.AllocatedPort)
+			}
+		})
+	}
+}
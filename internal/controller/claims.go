@@ -0,0 +1,285 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons of the Conflict condition
+const (
+	reasonServiceClaimed  = "ServiceClaimed"
+	reasonWorkloadClaimed = "WorkloadClaimed"
+	reasonOutranked       = "Outranked"
+	reasonNoConflict      = "NoConflict"
+)
+
+// claimPollInterval is how often a SvcMergerObj in conflict checks whether the claims it waits for were released.
+// Restored member Services are noticed through the watches already, released workloads are not.
+const claimPollInterval = 30 * time.Second
+
+// claimConflict is a member that can't be claimed because another SvcMergerObj holds it or outranks this one
+type claimConflict struct {
+	service string
+	holder  string
+	reason  string
+	message string
+}
+
+// outranks tells whether a SvcMergerObj comes before another one for a member both of them list: the higher
+// priority wins, then the older object, then the name
+func outranks(a *newprojv1.SvcMergerObj, b *newprojv1.SvcMergerObj) bool {
+	if a.Spec.Priority != b.Spec.Priority {
+		return a.Spec.Priority > b.Spec.Priority
+	}
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// activeHolder tells whether the named SvcMergerObj still holds its claim on the member: it exists and either
+// has it as a member, listed or picked by its selector, or still has it merged. A claim left behind by an object that is gone can be taken over.
+func (r *SvcMergerObjReconciler) activeHolder(ctx context.Context, obj *newprojv1.SvcMergerObj, holder string, svc string) (bool, error) {
+	if holder == "" || holder == obj.Name {
+		return false, nil
+	}
+	holder_obj := &newprojv1.SvcMergerObj{}
+	err := r.Get(ctx, types.NamespacedName{Name: holder, Namespace: obj.Namespace}, holder_obj)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if svc == "" {
+		return true, nil
+	}
+	for _, listed := range holder_obj.MemberServices() {
+		if listed == svc {
+			return true, nil
+		}
+	}
+	for _, member := range holder_obj.Status.Members {
+		if member.Name == svc && (member.State == newprojv1.MemberMerged || member.State == newprojv1.MemberDetaching) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// snapshotHolder finds the SvcMergerObj that merged a member Service which is gone, through the snapshot of
+// the Service it keeps. It returns an empty name if no other SvcMergerObj has it.
+func (r *SvcMergerObjReconciler) snapshotHolder(ctx context.Context, obj *newprojv1.SvcMergerObj, svc string) (string, error) {
+	merger_list := &newprojv1.SvcMergerObjList{}
+	err := r.List(ctx, merger_list, client.InNamespace(obj.Namespace), client.MatchingFields{servicesIndexKey: svc})
+	if err != nil {
+		return "", err
+	}
+	for i := range merger_list.Items {
+		other := &merger_list.Items[i]
+		if other.Name == obj.Name {
+			continue
+		}
+		snapshots, err := r.loadSnapshots(ctx, other)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := snapshots[svc]; ok {
+			return other.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// checkClaim tells whether the member can be claimed. It can't while the Service or one of its workloads is
+// claimed by another SvcMergerObj, or while it is unclaimed and listed by another SvcMergerObj that outranks
+// this one. A member this SvcMergerObj has claimed already is never in conflict.
+func (r *SvcMergerObjReconciler) checkClaim(ctx context.Context, obj *newprojv1.SvcMergerObj, service *corev1.Service) (*claimConflict, error) {
+	svc := service.Name
+	holder := service.Annotations[r.Keys.ClaimedBy]
+	if holder == obj.Name {
+		return nil, nil
+	}
+	active, err := r.activeHolder(ctx, obj, holder, svc)
+	if err != nil {
+		return nil, err
+	}
+	if active {
+		return &claimConflict{service: svc, holder: holder, reason: reasonServiceClaimed,
+			message: fmt.Sprintf("service %s is claimed by SvcMergerObj %s", svc, holder)}, nil
+	}
+
+	// The workloads of a Labels merge carry the merge they belong to
+	if relabelsWorkloads(obj) {
+		pods, err := r.getMemberPods(ctx, obj, svc, service)
+		if err != nil {
+			return nil, err
+		}
+		checked := make(map[workloadRef]bool)
+		for i := range pods {
+			ref, err := r.resolveWorkload(ctx, &pods[i])
+			if err != nil || checked[ref] {
+				// unsupported workloads are reported by the merge itself
+				continue
+			}
+			checked[ref] = true
+			workload := workloadResolvers[ref.Kind].newObject()
+			err = r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: obj.Namespace}, workload)
+			if apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			holder := workload.GetAnnotations()[r.Keys.MergedBy]
+			if template := workloadResolvers[ref.Kind].podTemplate(workload); holder == "" && template != nil {
+				holder = template.Labels[r.Keys.Group]
+			}
+			active, err := r.activeHolder(ctx, obj, holder, "")
+			if err != nil {
+				return nil, err
+			}
+			if active {
+				return &claimConflict{service: svc, holder: holder, reason: reasonWorkloadClaimed,
+					message: fmt.Sprintf("%s of service %s is merged by SvcMergerObj %s", ref.String(), svc, holder)}, nil
+			}
+		}
+	}
+
+	// Nobody holds the member, the SvcMergerObj that comes first gets it
+	merger_list := &newprojv1.SvcMergerObjList{}
+	err = r.List(ctx, merger_list, client.InNamespace(obj.Namespace), client.MatchingFields{servicesIndexKey: svc})
+	if err != nil {
+		return nil, err
+	}
+	for i := range merger_list.Items {
+		other := &merger_list.Items[i]
+		if other.Name == obj.Name || !other.DeletionTimestamp.IsZero() || other.Status.Phase == newprojv1.PhaseRolledBack {
+			continue
+		}
+		if outranks(other, obj) {
+			return &claimConflict{service: svc, holder: other.Name, reason: reasonOutranked,
+				message: fmt.Sprintf("service %s is also listed by SvcMergerObj %s, which comes first (priority %d)", svc, other.Name, other.Spec.Priority)}, nil
+		}
+	}
+	return nil, nil
+}
+
+// claimService marks the member Service as claimed by the SvcMergerObj. The claim is kept in the snapshot
+// once the Service is deleted by the cutover. The Service passed in is the one checkClaim looked at, so the
+// update fails if another SvcMergerObj claimed it in the meantime.
+func (r *SvcMergerObjReconciler) claimService(ctx context.Context, obj *newprojv1.SvcMergerObj, service *corev1.Service) error {
+	l := log.FromContext(ctx)
+	svc := service.Name
+	if service.Annotations[r.Keys.ClaimedBy] == obj.Name {
+		return nil
+	}
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[r.Keys.ClaimedBy] = obj.Name
+	if err := r.Update(ctx, service); err != nil {
+		l.Error(err, "not able to claim member service", "service", svc)
+		return err
+	}
+	return nil
+}
+
+// releaseClaim removes the claim of the SvcMergerObj from a member Service, if the Service exists and the claim is its own
+func (r *SvcMergerObjReconciler) releaseClaim(ctx context.Context, obj *newprojv1.SvcMergerObj, svc string) error {
+	l := log.FromContext(ctx)
+	service := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: svc, Namespace: obj.Namespace}, service)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if service.Annotations[r.Keys.ClaimedBy] != obj.Name {
+		return nil
+	}
+	delete(service.Annotations, r.Keys.ClaimedBy)
+	if err := r.Update(ctx, service); client.IgnoreNotFound(err) != nil {
+		l.Error(err, "not able to release claim on member service", "service", svc)
+		return err
+	}
+	return nil
+}
+
+// parkConflicts marks the members claimed elsewhere as Pending and records them in the Conflict condition.
+// It returns true if the condition changed.
+func (r *SvcMergerObjReconciler) parkConflicts(ctx context.Context, obj *newprojv1.SvcMergerObj, conflicts []claimConflict) bool {
+	l := log.FromContext(ctx)
+	var messages []string
+	for _, conflict := range conflicts {
+		setMemberState(obj, conflict.service, newprojv1.MemberPending, conflict.message)
+		messages = append(messages, conflict.message)
+	}
+	message := strings.Join(messages, "; ")
+	l.Info("waiting for claims held by other svcmergerobjs", "conflicts", message)
+
+	cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionConflict)
+	changed := cond == nil || cond.Status != metav1.ConditionTrue || cond.Message != message
+	if changed && r.Recorder != nil {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, conflicts[0].reason, message)
+	}
+	setCondition(obj, newprojv1.ConditionConflict, metav1.ConditionTrue, conflicts[0].reason, message)
+	return changed
+}
+
+// waitForClaims keeps the SvcMergerObj in the Conflict condition while every member is claimed elsewhere.
+// Nothing is changed on the cluster; the merge starts once a claim it waits for is released.
+func (r *SvcMergerObjReconciler) waitForClaims(ctx context.Context, obj *newprojv1.SvcMergerObj, conflicts []claimConflict) (ctrl.Result, error) {
+	r.parkConflicts(ctx, obj, conflicts)
+	message := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionConflict).Message
+	obj.Status.ObservedGeneration = obj.Generation
+	setPhase(obj, newprojv1.PhasePending)
+	setCondition(obj, newprojv1.ConditionReady, metav1.ConditionFalse, conflicts[0].reason, message)
+	setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, conflicts[0].reason, message)
+	if err := r.updateStatus(ctx, obj); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: claimPollInterval}, nil
+}
+
+// withoutMembers returns the services that are not in the given set, keeping their order
+func withoutMembers(services []string, members map[string]bool) []string {
+	var kept []string
+	for _, svc := range services {
+		if !members[svc] {
+			kept = append(kept, svc)
+		}
+	}
+	return kept
+}
+
+// clearConflict records that no member of the SvcMergerObj is claimed elsewhere
+func clearConflict(obj *newprojv1.SvcMergerObj) {
+	setCondition(obj, newprojv1.ConditionConflict, metav1.ConditionFalse, reasonNoConflict, "no member is claimed by another SvcMergerObj")
+}
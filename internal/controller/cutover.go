@@ -0,0 +1,153 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// cutoverPollInterval is how often the endpoints of the merged Service are checked during the cutover
+const cutoverPollInterval = 5 * time.Second
+
+// keepsMemberServices tells whether the member Services stay next to the merged Service, in which case
+// there is no cutover and nothing to restore
+func keepsMemberServices(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Spec.Mode == newprojv1.ModeAggregate
+}
+
+// minReadyEndpoints returns how many ready endpoints of every member the merged Service needs before the cutover
+func minReadyEndpoints(obj *newprojv1.SvcMergerObj) int32 {
+	if obj.Spec.Cutover == nil {
+		return 1
+	}
+	return obj.Spec.Cutover.MinReadyEndpoints
+}
+
+// drainDelay returns how long the original Services are kept once the merged Service is ready
+func drainDelay(obj *newprojv1.SvcMergerObj) time.Duration {
+	if obj.Spec.Cutover == nil || obj.Spec.Cutover.DrainDelay == nil {
+		return 0
+	}
+	return obj.Spec.Cutover.DrainDelay.Duration
+}
+
+// readyEndpointPods returns the names of the pods behind the ready endpoints of the merged Service. Every
+// EndpointSlice of the Service counts, whether it is written by Kubernetes or by the controller.
+func (r *SvcMergerObjReconciler) readyEndpointPods(ctx context.Context, merged_svc *corev1.Service) (map[string]bool, error) {
+	l := log.FromContext(ctx)
+	slice_list := &discoveryv1.EndpointSliceList{}
+	err := r.List(ctx, slice_list, client.InNamespace(merged_svc.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: merged_svc.Name,
+	})
+	if err != nil {
+		l.Error(err, "not able to list endpoint slices of merged service")
+		return nil, err
+	}
+	ready_pods := make(map[string]bool)
+	for _, slice := range slice_list.Items {
+		for _, endpoint := range slice.Endpoints {
+			// a missing ready condition means ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				ready_pods[endpoint.TargetRef.Name] = true
+			}
+		}
+	}
+	return ready_pods, nil
+}
+
+// cutoverMember removes the original Service of a new member once the merged Service holds enough ready
+// endpoints of it and the drain delay has passed. A snapshot of the Service is saved first so that it can be
+// restored exactly on demerge, and an alias is put in its place if the spec asks for one. While the member
+// has to wait, the time until the next check is returned.
+func (r *SvcMergerObjReconciler) cutoverMember(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string, spec *corev1.Service, ready_pods map[string]bool) (time.Duration, error) {
+	l := log.FromContext(ctx)
+
+	member := memberStatus(obj, svc)
+	// a member weighted out of the traffic has no endpoints in the merged service to wait for
+	if member.ReadySince == nil && weightedOut(obj, svc) {
+		now := metav1.Now()
+		member.ReadySince = &now
+	}
+	if member.ReadySince == nil {
+		min_ready := minReadyEndpoints(obj)
+		pods, err := r.getMemberPods(ctx, obj, svc, spec)
+		if err != nil {
+			return 0, err
+		}
+		ready := int32(0)
+		for _, pod := range pods {
+			if ready_pods[pod.Name] {
+				ready++
+			}
+		}
+		if ready < min_ready {
+			member.State = newprojv1.MemberPending
+			member.Message = fmt.Sprintf("%d of %d ready endpoints in the merged service", ready, min_ready)
+			return cutoverPollInterval, nil
+		}
+		now := metav1.Now()
+		member.ReadySince = &now
+	}
+
+	if remaining := time.Until(member.ReadySince.Add(drainDelay(obj))); remaining > 0 {
+		member.State = newprojv1.MemberPending
+		member.Message = fmt.Sprintf("draining the original service, deleted in %s", remaining.Round(time.Second))
+		return remaining, nil
+	}
+
+	service := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      svc,
+		Namespace: obj.Namespace,
+	}, service)
+	if err == nil && !r.isAlias(obj, service) && service.DeletionTimestamp.IsZero() {
+		if err := r.saveSnapshot(ctx, obj, service); err != nil {
+			return 0, err
+		}
+		state.snapshots[svc] = snapshotService(service)
+		err = r.Delete(ctx, service)
+	}
+	if client.IgnoreNotFound(err) != nil {
+		l.Error(err, "could not delete service", "service", svc)
+		return 0, err
+	}
+	waiting, err := r.syncAlias(ctx, obj, state, svc)
+	if err != nil {
+		return 0, err
+	}
+	if waiting {
+		member.State = newprojv1.MemberPending
+		member.Message = "waiting for the original service to go away to put the alias in its place"
+		return cutoverPollInterval, nil
+	}
+	member.ReadySince = nil
+	return 0, nil
+}
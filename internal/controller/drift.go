@@ -0,0 +1,143 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons of the events and the DriftRepaired condition written when the cluster drifted away from the merge
+const (
+	reasonMergedServiceRecreated = "MergedServiceRecreated"
+	reasonMergedServiceRepaired  = "MergedServiceRepaired"
+	reasonMemberServiceRemoved   = "MemberServiceRemoved"
+	reasonWorkloadRelabeled      = "WorkloadRelabeled"
+	reasonNoDrift                = "NoDrift"
+)
+
+// driftRepair is one difference between the merge and the cluster that was fixed during a reconcile
+type driftRepair struct {
+	reason  string
+	message string
+}
+
+// driftRepairs collects the repairs made during one reconcile
+type driftRepairs []driftRepair
+
+// recordRepair emits a warning event on the SvcMergerObj for the repair and keeps it for the DriftRepaired condition
+func (r *SvcMergerObjReconciler) recordRepair(ctx context.Context, obj *newprojv1.SvcMergerObj, repairs *driftRepairs, reason string, message string) {
+	l := log.FromContext(ctx)
+	l.Info("repairing drift", "reason", reason, "message", message)
+	if r.Recorder != nil {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, reason, message)
+	}
+	*repairs = append(*repairs, driftRepair{reason: reason, message: message})
+}
+
+// setDriftCondition records the repairs of this reconcile in the DriftRepaired condition. The condition is
+// replaced rather than updated, so that its transition time tells when the last repair happened.
+func setDriftCondition(obj *newprojv1.SvcMergerObj, repairs driftRepairs) {
+	if len(repairs) == 0 {
+		if meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionDriftRepaired) == nil {
+			setCondition(obj, newprojv1.ConditionDriftRepaired, metav1.ConditionFalse, reasonNoDrift, "no drift repaired so far")
+		}
+		return
+	}
+	var messages []string
+	for _, repair := range repairs {
+		messages = append(messages, repair.message)
+	}
+	meta.RemoveStatusCondition(&obj.Status.Conditions, newprojv1.ConditionDriftRepaired)
+	setCondition(obj, newprojv1.ConditionDriftRepaired, metav1.ConditionTrue, repairs[len(repairs)-1].reason, strings.Join(messages, "; "))
+}
+
+// memberMerged tells whether the status reports the member as completely merged
+func memberMerged(obj *newprojv1.SvcMergerObj, svc string) bool {
+	for _, member := range obj.Status.Members {
+		if member.Name == svc {
+			return member.State == newprojv1.MemberMerged
+		}
+	}
+	return false
+}
+
+// releaseDeletedMergedService lets a merged Service that was deleted by hand go away by dropping the
+// finalizer that holds it, so that it can be created again. It returns true if the Service is terminating.
+func (r *SvcMergerObjReconciler) releaseDeletedMergedService(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState) (bool, error) {
+	l := log.FromContext(ctx)
+	merged_svc := state.mergedService
+	if merged_svc == nil || merged_svc.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+	l.Info("merged service is being deleted, releasing it to create it again", "service", merged_svc.Name)
+	if controllerutil.RemoveFinalizer(merged_svc, r.Keys.mergedServiceFinalizerFor(obj.Name)) {
+		if err := r.Update(ctx, merged_svc); client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to remove finalizer from deleted merged service")
+			return true, err
+		}
+	}
+	state.mergedService = nil
+	return true, nil
+}
+
+// repairDrift puts back what was changed by hand on the members of a merge that is already in place: a member
+// Service that was created again is deleted (its snapshot is kept, so the original is still what gets restored),
+// and with the Labels strategy every workload of a member gets back its merge labels.
+func (r *SvcMergerObjReconciler) repairDrift(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, merged []string, recreated []string, member_specs map[string]*corev1.Service, repairs *driftRepairs) error {
+	l := log.FromContext(ctx)
+
+	for _, svc := range recreated {
+		service := &corev1.Service{}
+		err := r.Get(ctx, types.NamespacedName{Name: svc, Namespace: obj.Namespace}, service)
+		if err == nil {
+			err = r.Delete(ctx, service)
+		}
+		if client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to delete recreated member service", "service", svc)
+			return err
+		}
+		r.recordRepair(ctx, obj, repairs, reasonMemberServiceRemoved,
+			fmt.Sprintf("member service %s was created again and has been removed", svc))
+	}
+
+	if !relabelsWorkloads(obj) {
+		return nil
+	}
+	for _, svc := range merged {
+		relabeled, err := r.labelMemberWorkloads(ctx, obj, state, svc, member_specs[svc])
+		if err != nil {
+			return err
+		}
+		for _, ref := range relabeled {
+			r.recordRepair(ctx, obj, repairs, reasonWorkloadRelabeled,
+				fmt.Sprintf("merge labels of %s (member %s) were missing and have been put back", ref.String(), svc))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+const (
+	// maxEndpointsPerSlice matches the default of the kube-controller-manager
+	maxEndpointsPerSlice = 100
+
+	// endpointSliceResync is how often the EndpointSlices are rebuilt when nothing else triggers a reconcile
+	endpointSliceResync = 30 * time.Second
+)
+
+// useEndpointSlices tells whether the merge is done by writing EndpointSlices instead of relabeling workloads
+func useEndpointSlices(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Spec.Strategy == newprojv1.StrategyEndpointSlice || isolatePorts(obj)
+}
+
+// relabelsWorkloads tells whether the merge puts the merge labels on the member workloads, which only the
+// Labels strategy does
+func relabelsWorkloads(obj *newprojv1.SvcMergerObj) bool {
+	return !useEndpointSlices(obj) && !useProxy(obj)
+}
+
+// isolatePorts tells whether every merged port only reaches the pods of the member it was taken from
+func isolatePorts(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Spec.Strategy == newprojv1.StrategyEndpointSlicePerPort
+}
+
+// endpointGroup is a set of endpoints that share the same resolved ports, i.e. that fit into one EndpointSlice
+type endpointGroup struct {
+	addressType discoveryv1.AddressType
+	ports       []discoveryv1.EndpointPort
+	endpoints   []discoveryv1.Endpoint
+
+	// members maps the pods of the endpoints to the member they were found through
+	members map[string]string
+}
+
+// podReady tells whether the Ready condition of the pod is true
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// resolveTargetPort finds the container port a service port targets on the given pod. Named target ports are
+// looked up in the container ports of the pod, so members with different port names resolve correctly.
+func resolveTargetPort(pod *corev1.Pod, target intstr.IntOrString, protocol corev1.Protocol) (int32, bool) {
+	if target.Type == intstr.Int {
+		return target.IntVal, target.IntVal > 0
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			port_protocol := port.Protocol
+			if port_protocol == "" {
+				port_protocol = corev1.ProtocolTCP
+			}
+			if port.Name == target.StrVal && port_protocol == protocol {
+				return port.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// podEndpoint builds the endpoint of a pod the same way the EndpointSlice controller does
+func podEndpoint(pod *corev1.Pod) discoveryv1.Endpoint {
+	serving := podReady(pod)
+	terminating := pod.DeletionTimestamp != nil
+	ready := serving && !terminating
+	endpoint := discoveryv1.Endpoint{
+		Addresses: []string{pod.Status.PodIP},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       &ready,
+			Serving:     &serving,
+			Terminating: &terminating,
+		},
+		TargetRef: &corev1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			UID:       pod.UID,
+		},
+	}
+	if pod.Spec.NodeName != "" {
+		node_name := pod.Spec.NodeName
+		endpoint.NodeName = &node_name
+	}
+	return endpoint
+}
+
+// endpointSliceName gives every group chunk a stable name, so that slices are updated in place
+func endpointSliceName(service string, key string, chunk int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s#%d", key, chunk)
+	return fmt.Sprintf("%s-%08x", service, h.Sum32())
+}
+
+// buildEndpointGroups collects the pods selected by the given member services and groups their endpoints
+// by the ports they resolve to. The result is keyed by a string describing address type and ports. With
+// isolate set, the pods of a member only get the ports taken from that member; a pod selected by several
+// members then shows up once per member, with the ports of each.
+func (r *SvcMergerObjReconciler) buildEndpointGroups(ctx context.Context, namespace string, members []string, specs map[string]*corev1.Service, ports []mergedPort, isolate bool) (map[string]*endpointGroup, error) {
+	l := log.FromContext(ctx)
+	groups := make(map[string]*endpointGroup)
+	seen := make(map[string]bool)
+
+	for _, svc := range members {
+		spec, ok := specs[svc]
+		if !ok || len(spec.Spec.Selector) == 0 {
+			// services without selector have no pods we could find
+			continue
+		}
+		pod_list := &corev1.PodList{}
+		err := r.List(ctx, pod_list, client.InNamespace(namespace), client.MatchingLabels(spec.Spec.Selector))
+		if err != nil {
+			l.Error(err, "not able to list pods of member service", "service", svc)
+			return nil, err
+		}
+		for i := range pod_list.Items {
+			pod := &pod_list.Items[i]
+			seen_key := pod.Name
+			if isolate {
+				seen_key = svc + "/" + pod.Name
+			}
+			if seen[seen_key] || pod.Status.PodIP == "" ||
+				pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			seen[seen_key] = true
+
+			address_type := discoveryv1.AddressTypeIPv4
+			if ip := net.ParseIP(pod.Status.PodIP); ip != nil && ip.To4() == nil {
+				address_type = discoveryv1.AddressTypeIPv6
+			}
+
+			var endpoint_ports []discoveryv1.EndpointPort
+			key_parts := []string{string(address_type)}
+			for _, port := range ports {
+				if isolate && port.service != svc {
+					continue
+				}
+				number, ok := resolveTargetPort(pod, port.TargetPort, port.Protocol)
+				if !ok {
+					continue
+				}
+				port_name, protocol := port.Name, port.Protocol
+				endpoint_ports = append(endpoint_ports, discoveryv1.EndpointPort{
+					Name:        &port_name,
+					Port:        &number,
+					Protocol:    &protocol,
+					AppProtocol: port.AppProtocol,
+				})
+				key_parts = append(key_parts, fmt.Sprintf("%s=%d", port_name, number))
+			}
+			if len(endpoint_ports) == 0 {
+				continue
+			}
+
+			key := strings.Join(key_parts, ",")
+			group, ok := groups[key]
+			if !ok {
+				group = &endpointGroup{addressType: address_type, ports: endpoint_ports, members: make(map[string]string)}
+				groups[key] = group
+			}
+			group.endpoints = append(group.endpoints, podEndpoint(pod))
+			group.members[pod.Name] = svc
+		}
+	}
+	return groups, nil
+}
+
+// countReadyEndpoints records on every merged port how many ready endpoints the groups hold for it
+func countReadyEndpoints(groups map[string]*endpointGroup, ports []mergedPort) {
+	ready := make(map[string]int32)
+	for _, group := range groups {
+		count := int32(0)
+		for _, endpoint := range group.endpoints {
+			if endpoint.Conditions.Ready != nil && *endpoint.Conditions.Ready {
+				count++
+			}
+		}
+		for _, port := range group.ports {
+			ready[*port.Name] += count
+		}
+	}
+	for i := range ports {
+		count := ready[ports[i].Name]
+		ports[i].readyEndpoints = &count
+	}
+}
+
+// syncEndpointSlices writes the EndpointSlices of the merged Service so that they hold the endpoints of
+// the pods of every member, and removes the slices that are not needed anymore. The slices are owned
+// by the merged Service, so they go away together with it.
+func (r *SvcMergerObjReconciler) syncEndpointSlices(ctx context.Context, merged_svc *corev1.Service, groups map[string]*endpointGroup) error {
+	l := log.FromContext(ctx)
+
+	var keys []string
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	desired := make(map[string]*discoveryv1.EndpointSlice)
+	for _, key := range keys {
+		group := groups[key]
+		sort.Slice(group.endpoints, func(i, j int) bool {
+			return group.endpoints[i].TargetRef.Name < group.endpoints[j].TargetRef.Name
+		})
+		for chunk := 0; chunk*maxEndpointsPerSlice < len(group.endpoints); chunk++ {
+			end := (chunk + 1) * maxEndpointsPerSlice
+			if end > len(group.endpoints) {
+				end = len(group.endpoints)
+			}
+			slice := &discoveryv1.EndpointSlice{}
+			slice.Name = endpointSliceName(merged_svc.Name, key, chunk)
+			slice.Namespace = merged_svc.Namespace
+			slice.Labels = map[string]string{
+				discoveryv1.LabelServiceName: merged_svc.Name,
+				discoveryv1.LabelManagedBy:   r.Keys.EndpointSliceManagedBy,
+			}
+			slice.AddressType = group.addressType
+			slice.Ports = group.ports
+			slice.Endpoints = group.endpoints[chunk*maxEndpointsPerSlice : end]
+			if err := controllerutil.SetControllerReference(merged_svc, slice, r.Scheme); err != nil {
+				return err
+			}
+			desired[slice.Name] = slice
+		}
+	}
+
+	existing := &discoveryv1.EndpointSliceList{}
+	err := r.List(ctx, existing, client.InNamespace(merged_svc.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: merged_svc.Name,
+		discoveryv1.LabelManagedBy:   r.Keys.EndpointSliceManagedBy,
+	})
+	if err != nil {
+		l.Error(err, "not able to list endpoint slices of merged service")
+		return err
+	}
+
+	for i := range existing.Items {
+		slice := &existing.Items[i]
+		want, ok := desired[slice.Name]
+		if !ok {
+			if err := r.Delete(ctx, slice); client.IgnoreNotFound(err) != nil {
+				l.Error(err, "not able to delete stale endpoint slice", "endpointslice", slice.Name)
+				return err
+			}
+			continue
+		}
+		delete(desired, slice.Name)
+		if slice.AddressType == want.AddressType &&
+			equality.Semantic.DeepEqual(slice.Ports, want.Ports) &&
+			equality.Semantic.DeepEqual(slice.Endpoints, want.Endpoints) {
+			continue
+		}
+		if slice.AddressType != want.AddressType {
+			// the address type of a slice is immutable
+			if err := r.Delete(ctx, slice); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			desired[want.Name] = want
+			continue
+		}
+		slice.Ports = want.Ports
+		slice.Endpoints = want.Endpoints
+		if err := r.Update(ctx, slice); err != nil {
+			l.Error(err, "not able to update endpoint slice", "endpointslice", slice.Name)
+			return err
+		}
+	}
+
+	for _, slice := range desired {
+		if err := r.Create(ctx, slice); err != nil {
+			l.Error(err, "not able to create endpoint slice", "endpointslice", slice.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEndpointSlices removes the EndpointSlices the controller wrote for the merged Service
+func (r *SvcMergerObjReconciler) deleteEndpointSlices(ctx context.Context, merged_svc *corev1.Service) error {
+	return r.DeleteAllOf(ctx, &discoveryv1.EndpointSlice{}, client.InNamespace(merged_svc.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: merged_svc.Name,
+		discoveryv1.LabelManagedBy:   r.Keys.EndpointSliceManagedBy,
+	})
+}
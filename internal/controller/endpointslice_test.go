@@ -0,0 +1,232 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// testPod builds a ready pod of the member with the given address
+func testPod(name string, svc string, ip string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name = name
+	pod.Namespace = "default"
+	pod.Labels = map[string]string{"app": svc}
+	pod.Status.PodIP = ip
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	return pod
+}
+
+func TestBuildEndpointGroupsIsolatesPorts(t *testing.T) {
+	specs := map[string]*corev1.Service{
+		"web-1": testService("web-1", testPort("http", 80, corev1.ProtocolTCP, intstr.FromInt(8080))),
+		"web-2": testService("web-2", testPort("http", 81, corev1.ProtocolTCP, intstr.FromInt(8080))),
+	}
+	members := []string{"web-1", "web-2"}
+	obj := &newprojv1.SvcMergerObj{}
+	obj.Spec.Strategy = newprojv1.StrategyEndpointSlicePerPort
+
+	ports, collisions, err := buildMergedPorts(obj, members, specs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(collisions) > 0 {
+		t.Fatalf("unexpected collisions %v", collisions)
+	}
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		testPod("web-1-a", "web-1", "10.0.0.1"),
+		testPod("web-1-b", "web-1", "10.0.0.2"),
+		testPod("web-2-a", "web-2", "10.0.1.1"),
+	).Build()
+	r := &SvcMergerObjReconciler{Client: c}
+	groups, err := r.buildEndpointGroups(context.Background(), "default", members, specs, ports, isolatePorts(obj))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// every merged port holds the pods of its own member only
+	pods := make(map[string][]string)
+	for _, group := range groups {
+		for _, port := range group.ports {
+			for _, endpoint := range group.endpoints {
+				pods[*port.Name] = append(pods[*port.Name], endpoint.TargetRef.Name)
+			}
+		}
+	}
+	for _, names := range pods {
+		sort.Strings(names)
+	}
+	want := map[string][]string{
+		"web-1-http": {"web-1-a", "web-1-b"},
+		"web-2-http": {"web-2-a"},
+	}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("endpoints per port = %v, want %v", pods, want)
+	}
+
+	countReadyEndpoints(groups, ports)
+	for _, port := range ports {
+		if want := int32(len(want[port.Name])); port.readyEndpoints == nil || *port.readyEndpoints != want {
+			t.Errorf("ready endpoints of %s = %v, want %d", port.Name, port.readyEndpoints, want)
+		}
+	}
+}
+
+func TestBuildEndpointGroupsIsolatesCollidingPorts(t *testing.T) {
+	specs := map[string]*corev1.Service{
+		"web-1": testService("web-1", testPort("http", 80, corev1.ProtocolTCP, intstr.FromInt(8080))),
+		"web-2": testService("web-2", testPort("http", 80, corev1.ProtocolTCP, intstr.FromInt(8080))),
+	}
+	members := []string{"web-1", "web-2"}
+	obj := &newprojv1.SvcMergerObj{}
+	obj.Spec.Strategy = newprojv1.StrategyEndpointSlicePerPort
+
+	ports, collisions, err := buildMergedPorts(obj, members, specs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(collisions) > 0 {
+		t.Fatalf("no port may be skipped, got collisions %v", collisions)
+	}
+	numbers := make(map[string]int32)
+	for _, port := range ports {
+		numbers[port.service] = port.Port
+	}
+	if numbers["web-1"] == numbers["web-2"] {
+		t.Fatalf("both members are exposed on port %d", numbers["web-1"])
+	}
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		testPod("web-1-a", "web-1", "10.0.0.1"),
+		testPod("web-1-b", "web-1", "10.0.0.2"),
+		testPod("web-2-a", "web-2", "10.0.1.1"),
+	).Build()
+	r := &SvcMergerObjReconciler{Client: c}
+	groups, err := r.buildEndpointGroups(context.Background(), "default", members, specs, ports, isolatePorts(obj))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// every merged port holds the pods of its own member only
+	pods := make(map[string][]string)
+	for _, group := range groups {
+		for _, port := range group.ports {
+			for _, endpoint := range group.endpoints {
+				pods[*port.Name] = append(pods[*port.Name], endpoint.TargetRef.Name)
+			}
+		}
+	}
+	for _, names := range pods {
+		sort.Strings(names)
+	}
+	want := map[string][]string{
+		"web-1-http": {"web-1-a", "web-1-b"},
+		"web-2-http": {"web-2-a"},
+	}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("endpoints per port = %v, want %v", pods, want)
+	}
+
+	countReadyEndpoints(groups, ports)
+	for _, port := range ports {
+		if want := int32(len(want[port.Name])); port.readyEndpoints == nil || *port.readyEndpoints != want {
+			t.Errorf("ready endpoints of %s = %v, want %d", port.Name, port.readyEndpoints, want)
+		}
+	}
+}
+
+// endpointsByPort returns the ready addresses behind every port of the EndpointSlices the controller wrote for
+// the merged Service, sorted
+func endpointsByPort(c *testCluster, merged_svc string) map[string][]string {
+	c.t.Helper()
+	slices := &discoveryv1.EndpointSliceList{}
+	if err := c.client.List(context.Background(), slices, client.MatchingLabels{discoveryv1.LabelServiceName: merged_svc}); err != nil {
+		c.t.Fatal(err)
+	}
+	ports := make(map[string][]string)
+	for _, slice := range slices.Items {
+		if slice.Labels[discoveryv1.LabelManagedBy] == "endpointslice-controller.k8s.io" {
+			continue
+		}
+		for _, port := range slice.Ports {
+			for _, endpoint := range slice.Endpoints {
+				if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+					ports[*port.Name] = append(ports[*port.Name], endpoint.Addresses...)
+				}
+			}
+		}
+	}
+	for name := range ports {
+		sort.Strings(ports[name])
+	}
+	return ports
+}
+
+func TestEndpointSliceRoundTrip(t *testing.T) {
+	roundTrip(t, newprojv1.StrategyEndpointSlice, func(c *testCluster, obj *newprojv1.SvcMergerObj) {
+		merged_svc := &corev1.Service{}
+		c.get(obj.MergedServiceName(), merged_svc)
+		if len(merged_svc.Spec.Selector) > 0 {
+			t.Errorf("merged service selector = %v, want none", merged_svc.Spec.Selector)
+		}
+		all := []string{"10.0.80.1", "10.0.80.2", "10.0.81.1", "10.0.81.2"}
+		want := map[string][]string{"web-1-http": all, "web-2-http": all}
+		if got := endpointsByPort(c, merged_svc.Name); !reflect.DeepEqual(got, want) {
+			t.Errorf("endpoints = %v, want %v", got, want)
+		}
+		for _, svc := range []string{"web-1", "web-2"} {
+			deployment := &appsv1.Deployment{}
+			c.get(svc, deployment)
+			if want := (labels.Set{"app": svc, "tier": "web"}); !labels.Equals(deployment.Spec.Template.Labels, want) {
+				t.Errorf("pod template labels of %s = %v, want them untouched", svc, deployment.Spec.Template.Labels)
+			}
+		}
+	})
+}
+
+func TestEndpointSlicePerPortRoundTrip(t *testing.T) {
+	roundTrip(t, newprojv1.StrategyEndpointSlicePerPort, func(c *testCluster, obj *newprojv1.SvcMergerObj) {
+		want := map[string][]string{
+			"web-1-http": {"10.0.80.1", "10.0.80.2"},
+			"web-2-http": {"10.0.81.1", "10.0.81.2"},
+		}
+		if got := endpointsByPort(c, obj.MergedServiceName()); !reflect.DeepEqual(got, want) {
+			t.Errorf("endpoints = %v, want every port to reach its own member only: %v", got, want)
+		}
+		for _, port := range obj.Status.MergedService.Ports {
+			if port.ReadyEndpoints == nil || *port.ReadyEndpoints != 2 {
+				t.Errorf("ready endpoints of port %s = %v, want 2", port.Name, port.ReadyEndpoints)
+			}
+		}
+	})
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// mergeRun carries what the steps of an operation work with. It is rebuilt on every reconcile,
+// only the journal itself is persisted (in the status).
+type mergeRun struct {
+	state *mergeState
+
+	// services are the members listed in the spec, memberSpecs holds the spec of each of them
+	services    []string
+	memberSpecs map[string]*corev1.Service
+	ports       []mergedPort
+
+	// merged are the members whose original Service is gone, recreated those whose Service was created again by hand
+	merged    []string
+	recreated []string
+
+	repairs driftRepairs
+
+	// readyPods is loaded by the first gate or cutover step of a reconcile, see loadReadyPods
+	readyPods map[string]bool
+}
+
+// retryLimit returns how many failed attempts in a row a step may have before the operation is rolled back
+func retryLimit(obj *newprojv1.SvcMergerObj) int32 {
+	return obj.Spec.RetryLimit
+}
+
+// operationInFlight tells whether the journal holds an operation that still has to be carried on. A running
+// operation planned for an older generation of the spec is replaced, a rollback is always finished.
+func operationInFlight(obj *newprojv1.SvcMergerObj) bool {
+	op := obj.Status.Operation
+	if op == nil {
+		return false
+	}
+	if op.State == newprojv1.OperationRollingBack {
+		return true
+	}
+	return op.State == newprojv1.OperationRunning && op.Generation == obj.Generation
+}
+
+// startOperation replaces the journal with a new operation made of the given steps. The progress of an earlier
+// rollout goes with it.
+func startOperation(obj *newprojv1.SvcMergerObj, op_type newprojv1.OperationType, steps []newprojv1.JournalStep) {
+	obj.Status.Operation = &newprojv1.OperationStatus{
+		Type:       op_type,
+		Generation: obj.Generation,
+		State:      newprojv1.OperationRunning,
+		StartedAt:  metav1.Now(),
+		Steps:      steps,
+	}
+	obj.Status.Rollout = nil
+}
+
+// journalStep builds a pending step
+func journalStep(action newprojv1.StepAction, svc string) newprojv1.JournalStep {
+	return newprojv1.JournalStep{Action: action, Service: svc, State: newprojv1.StepPending}
+}
+
+// planMerge journals a merge or update: members that left the spec are demerged first, then the workloads of
+// the new members are relabeled and rolled out (Labels strategy only), the merged Service is set up, and
+// finally the original Services of the new members are cut over (Replace mode only). With spec.rollout the new
+// members go through these steps batch by batch, and every batch waits for the health gate before its cutover.
+func planMerge(obj *newprojv1.SvcMergerObj, op_type newprojv1.OperationType, to_add []string, to_delete []string) {
+	var steps []newprojv1.JournalStep
+	for _, svc := range to_delete {
+		steps = append(steps, journalStep(newprojv1.StepDemerge, svc))
+	}
+	gated := progressive(obj) && len(to_add) > 0
+	batches := [][]string{to_add}
+	if gated {
+		batches = splitBatches(to_add, batchSize(obj))
+	}
+	for i, batch := range batches {
+		first := len(steps)
+		if relabelsWorkloads(obj) {
+			for _, svc := range batch {
+				steps = append(steps, journalStep(newprojv1.StepLabel, svc))
+			}
+			for _, svc := range batch {
+				steps = append(steps, journalStep(newprojv1.StepRollout, svc))
+			}
+		}
+		steps = append(steps, journalStep(newprojv1.StepMergedService, ""))
+		if gated {
+			for _, svc := range batch {
+				steps = append(steps, journalStep(newprojv1.StepGate, svc))
+			}
+		}
+		if !keepsMemberServices(obj) {
+			for _, svc := range batch {
+				steps = append(steps, journalStep(newprojv1.StepCutover, svc))
+			}
+		}
+		if gated {
+			for j := first; j < len(steps); j++ {
+				steps[j].Batch = int32(i + 1)
+			}
+		}
+	}
+	startOperation(obj, op_type, steps)
+	if gated {
+		obj.Status.Rollout = &newprojv1.RolloutStatus{
+			State:   newprojv1.RolloutProgressing,
+			Batches: int32(len(batches)),
+			Members: int32(len(to_add)),
+		}
+	}
+}
+
+// planDemerge journals the rollback of the whole merge when the SvcMergerObj is deleted
+func planDemerge(obj *newprojv1.SvcMergerObj, members []string) {
+	var steps []newprojv1.JournalStep
+	for _, svc := range members {
+		steps = append(steps, journalStep(newprojv1.StepDemerge, svc))
+	}
+	steps = append(steps, journalStep(newprojv1.StepDeleteMergedService, ""))
+	startOperation(obj, newprojv1.OperationDemerge, steps)
+}
+
+// runOperation carries on with the journaled operation, starting at the first step that is not done. The
+// journal is written after every step, so a failed or restarted reconcile resumes where it stopped. Steps
+// that have to wait (rollouts, health gate, cutover) don't block the following steps of the same action and
+// batch, so that all members wait together. A batch of a rollout is not started while spec.rollout.paused is
+// set, and a paused rollout is not requeued as only a change of the spec resumes it. It returns true once
+// every step is done.
+func (r *SvcMergerObjReconciler) runOperation(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun) (bool, ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	op := obj.Status.Operation
+	if op.State == newprojv1.OperationRollingBack {
+		result, err := r.rollbackOperation(ctx, obj, run)
+		return false, result, err
+	}
+
+	var wait time.Duration
+	var waiting_action newprojv1.StepAction
+	var waiting_batch int32
+	for i := range op.Steps {
+		step := &op.Steps[i]
+		if step.State == newprojv1.StepDone {
+			continue
+		}
+		if waiting_action != "" && (step.Action != waiting_action || step.Batch != waiting_batch) {
+			break
+		}
+		if rollout := obj.Status.Rollout; rollout != nil && step.Batch > rollout.Batch {
+			if obj.Spec.Rollout != nil && obj.Spec.Rollout.Paused {
+				pauseRollout(obj, fmt.Sprintf("held by spec.rollout.paused before batch %d of %d", step.Batch, rollout.Batches))
+				l.Info("rollout paused by the spec", "batch", step.Batch)
+				setPhase(obj, newprojv1.PhasePaused)
+				setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutPaused, rollout.Message)
+				return false, ctrl.Result{}, r.updateStatus(ctx, obj)
+			}
+			l.Info("starting batch of the rollout", "batch", step.Batch, "batches", rollout.Batches)
+			startBatch(obj, step.Batch)
+		}
+		step_wait, err := r.runStep(ctx, obj, run, step)
+		if err != nil {
+			l.Error(err, "journal step failed", "action", step.Action, "service", step.Service)
+			result, err := r.failStep(ctx, obj, run, step, err)
+			return false, result, err
+		}
+		if step_wait > 0 {
+			if wait == 0 || step_wait < wait {
+				wait = step_wait
+			}
+			waiting_action, waiting_batch = step.Action, step.Batch
+			continue
+		}
+		step.State = newprojv1.StepDone
+		step.Message = ""
+		op.Attempts = 0
+		setRolloutProgress(obj)
+		if err := r.updateStatus(ctx, obj); err != nil {
+			return false, ctrl.Result{}, err
+		}
+	}
+
+	if rolloutPaused(obj) {
+		l.Info("rollout paused, waiting for the spec to change", "message", obj.Status.Rollout.Message)
+		setPhase(obj, newprojv1.PhasePaused)
+		setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutPaused, obj.Status.Rollout.Message)
+		return false, ctrl.Result{}, r.updateStatus(ctx, obj)
+	}
+	if wait > 0 {
+		phase, reason, message := newprojv1.PhaseRollingOut, reasonRollingOut, "waiting for member workloads to roll out"
+		if waiting_action == newprojv1.StepGate {
+			phase, reason = newprojv1.PhaseGating, reasonGating
+			message = fmt.Sprintf("waiting for batch %d of %d to pass the health gate", waiting_batch, obj.Status.Rollout.Batches)
+		}
+		if waiting_action == newprojv1.StepCutover {
+			phase, reason, message = newprojv1.PhaseDraining, reasonCuttingOver, "waiting to remove the original member services"
+			for _, step := range op.Steps {
+				if step.Action == newprojv1.StepCutover && step.State != newprojv1.StepDone &&
+					memberStatus(obj, step.Service).ReadySince == nil {
+					phase = newprojv1.PhaseCuttingOver
+				}
+			}
+		}
+		l.Info(message, "requeue_after", wait)
+		setPhase(obj, phase)
+		markProgressing(obj, reason, message)
+		if err := r.updateStatus(ctx, obj); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		return false, ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	op.State = newprojv1.OperationCompleted
+	completeRollout(obj)
+	return true, ctrl.Result{}, nil
+}
+
+// runStep does one step of the operation. Every step can be done again safely, as a step that failed may
+// have been done partly. While the step has to wait, the time until the next check is returned.
+func (r *SvcMergerObjReconciler) runStep(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun, step *newprojv1.JournalStep) (time.Duration, error) {
+	state := run.state
+	svc := step.Service
+
+	switch step.Action {
+	case newprojv1.StepDemerge:
+		if err := r.demergeMember(ctx, obj, state, svc); err != nil {
+			return 0, err
+		}
+		removeMember(obj, svc)
+
+	case newprojv1.StepLabel:
+		if _, err := r.labelMemberWorkloads(ctx, obj, state, svc, run.memberSpecs[svc]); err != nil {
+			return 0, err
+		}
+
+	case newprojv1.StepRollout:
+		message, err := r.memberRollout(ctx, obj, state, svc)
+		if err != nil {
+			return 0, err
+		}
+		if message != "" {
+			setMemberState(obj, svc, newprojv1.MemberPending, message)
+			return rolloutPollInterval, nil
+		}
+
+	case newprojv1.StepMergedService:
+		existed := state.mergedService != nil
+		merged_svc, err := r.ensureMergedService(ctx, obj, state, mergedServicePorts(obj, run.ports), &run.repairs)
+		if err != nil {
+			return 0, err
+		}
+		// recorded right away, so that a rollback deletes the service even if the rest of the step fails
+		step.Created = step.Created || !existed
+		if err := r.repairDrift(ctx, obj, state, run.merged, run.recreated, run.memberSpecs, &run.repairs); err != nil {
+			return 0, err
+		}
+		setMergedService(obj, merged_svc)
+		// the members of later batches of a rollout are left out until their batch comes
+		services := admittedServices(obj, run.services, step.Batch)
+		if _, err := r.syncMergedEndpoints(ctx, obj, state, services, run.memberSpecs, run.ports); err != nil {
+			return 0, err
+		}
+		if _, err := r.syncProxy(ctx, obj, services, run.memberSpecs, run.ports); err != nil {
+			return 0, err
+		}
+		setMergedPorts(obj, run.ports)
+		run.readyPods = nil
+
+	case newprojv1.StepGate:
+		wait, err := r.gateMember(ctx, obj, run, svc)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+
+	case newprojv1.StepCutover:
+		if state.mergedService == nil {
+			return 0, fmt.Errorf("merged service %s does not exist", obj.MergedServiceName())
+		}
+		if err := r.loadReadyPods(ctx, obj, run); err != nil {
+			return 0, err
+		}
+		wait, err := r.cutoverMember(ctx, obj, state, svc, run.memberSpecs[svc], run.readyPods)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+		setMemberState(obj, svc, newprojv1.MemberMerged, "")
+
+	case newprojv1.StepDeleteMergedService:
+		if err := r.deleteMergedService(ctx, obj, state); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, fmt.Errorf("unknown journal step %s", step.Action)
+	}
+	return 0, nil
+}
+
+// loadReadyPods loads the pods behind the ready endpoints of the merged Service, once per reconcile. With the
+// Proxy strategy the merged service has the proxy pods behind it, the members are behind the proxy.
+func (r *SvcMergerObjReconciler) loadReadyPods(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun) error {
+	if run.readyPods != nil {
+		return nil
+	}
+	if run.state.mergedService == nil {
+		return fmt.Errorf("merged service %s does not exist", obj.MergedServiceName())
+	}
+	var ready_pods map[string]bool
+	var err error
+	if useProxy(obj) {
+		ready_pods, err = r.proxyReadyPods(ctx, obj)
+	} else {
+		ready_pods, err = r.readyEndpointPods(ctx, run.state.mergedService)
+	}
+	if err != nil {
+		return err
+	}
+	run.readyPods = ready_pods
+	return nil
+}
+
+// failStep records a failed attempt of a step. Once a merge or update failed more often than the retry limit
+// allows, its steps are rolled back; a demerge is retried until it is done as there is nothing to go back to.
+func (r *SvcMergerObjReconciler) failStep(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun, step *newprojv1.JournalStep, err error) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	op := obj.Status.Operation
+	op.Attempts++
+	step.State = newprojv1.StepFailed
+	step.Message = err.Error()
+
+	if op.Type != newprojv1.OperationDemerge && op.Attempts > retryLimit(obj) {
+		l.Info("retry limit reached, rolling back the operation", "attempts", op.Attempts)
+		op.State = newprojv1.OperationRollingBack
+		return r.rollbackOperation(ctx, obj, run)
+	}
+	return ctrl.Result{}, r.failMember(ctx, obj, step.Service, err)
+}
+
+// rollbackOperation undoes the steps that were done (or partly done) in reverse order: original Services are
+// restored from their snapshots, a merged Service created by the operation is deleted and the workloads are
+// freed again. Demerged members are left alone, they have left the spec. The members that were being added
+// are marked as failed, and the operation is not tried again before the spec changes.
+func (r *SvcMergerObjReconciler) rollbackOperation(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	state := run.state
+	op := obj.Status.Operation
+	setPhase(obj, newprojv1.PhaseRollingBack)
+	markProgressing(obj, reasonRollingBack, "rolling back the operation")
+
+	rolled_back := make(map[string]bool)
+	for i := len(op.Steps) - 1; i >= 0; i-- {
+		step := &op.Steps[i]
+		if step.State != newprojv1.StepDone && step.State != newprojv1.StepFailed {
+			continue
+		}
+		svc := step.Service
+		var err error
+		switch step.Action {
+		case newprojv1.StepLabel:
+			err = r.unlabelMemberWorkloads(ctx, obj, state, svc)
+			rolled_back[svc] = true
+		case newprojv1.StepCutover:
+			err = r.undoCutover(ctx, obj, state, svc)
+			rolled_back[svc] = true
+		case newprojv1.StepMergedService:
+			if step.Created {
+				err = r.deleteMergedService(ctx, obj, state)
+				obj.Status.MergedService = nil
+			}
+		}
+		if err != nil {
+			l.Error(err, "not able to roll back journal step", "action", step.Action, "service", svc)
+			return ctrl.Result{}, r.failMember(ctx, obj, svc, err)
+		}
+		step.State = newprojv1.StepRolledBack
+		if err := r.updateStatus(ctx, obj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	for svc := range rolled_back {
+		if err := r.releaseClaim(ctx, obj, svc); err != nil {
+			return ctrl.Result{}, r.failMember(ctx, obj, svc, err)
+		}
+		delete(state.members, svc)
+		setMemberState(obj, svc, newprojv1.MemberFailed, "merge rolled back")
+	}
+	if err := r.syncMemberPorts(ctx, state); err != nil {
+		return ctrl.Result{}, r.failMember(ctx, obj, "", err)
+	}
+
+	op.State = newprojv1.OperationRolledBack
+	err := fmt.Errorf("%s rolled back after %d failed attempts, it is tried again once the spec changes", op.Type, op.Attempts)
+	markDegraded(obj, reasonRolledBack, err)
+	setPhase(obj, newprojv1.PhaseRolledBack)
+	setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, reasonRolledBack, err.Error())
+	if err := r.updateStatus(ctx, obj); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// undoCutover brings back the original Service of a member from its snapshot and forgets the snapshot
+func (r *SvcMergerObjReconciler) undoCutover(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string) error {
+	snapshot, ok := state.snapshots[svc]
+	if !ok {
+		return nil
+	}
+	service := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: svc, Namespace: obj.Namespace}, service)
+	if err == nil && r.isAlias(obj, service) {
+		if err := r.removeAlias(ctx, service); err != nil {
+			return err
+		}
+		err = apierrors.NewNotFound(corev1.Resource("services"), svc)
+	}
+	if apierrors.IsNotFound(err) {
+		err = r.restoreService(ctx, snapshot)
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.dropSnapshot(ctx, obj, svc); err != nil {
+		return err
+	}
+	delete(state.snapshots, svc)
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+var errInjected = errors.New("injected failure")
+
+// journalStepOf returns the step of the journal with the given action and service
+func journalStepOf(t *testing.T, obj *newprojv1.SvcMergerObj, action newprojv1.StepAction, svc string) *newprojv1.JournalStep {
+	t.Helper()
+	for i := range obj.Status.Operation.Steps {
+		step := &obj.Status.Operation.Steps[i]
+		if step.Action == action && step.Service == svc {
+			return step
+		}
+	}
+	t.Fatalf("no %s step for %q in the journal %+v", action, svc, obj.Status.Operation.Steps)
+	return nil
+}
+
+func TestLabelStepRolledBack(t *testing.T) {
+	merger := testMerger("merger", newprojv1.StrategyLabels, "web-1", "web-2")
+	merger.Spec.RetryLimit = 1
+	objs := []client.Object{merger}
+	objs = append(objs, testMember("web-1", 80, 1)...)
+	objs = append(objs, testMember("web-2", 81, 1)...)
+	c := newTestCluster(t, objs...)
+	c.fail = func(verb string, obj client.Object) error {
+		if _, ok := obj.(*appsv1.Deployment); ok && obj.GetName() == "web-2" && verb != "status" {
+			return errInjected
+		}
+		return nil
+	}
+
+	obj := c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool {
+		return obj.Status.Phase == newprojv1.PhaseRolledBack
+	})
+	op := obj.Status.Operation
+	if op.State != newprojv1.OperationRolledBack || op.Attempts != 2 {
+		t.Errorf("operation state = %s after %d attempts, want %s after 2", op.State, op.Attempts, newprojv1.OperationRolledBack)
+	}
+	for _, svc := range []string{"web-1", "web-2"} {
+		if step := journalStepOf(t, obj, newprojv1.StepLabel, svc); step.State != newprojv1.StepRolledBack {
+			t.Errorf("label step of %s is %s, want %s", svc, step.State, newprojv1.StepRolledBack)
+		}
+		if member := memberStatus(obj, svc); member == nil || member.State != newprojv1.MemberFailed {
+			t.Errorf("member %s = %+v, want it failed", svc, member)
+		}
+		if !c.get(svc, &corev1.Service{}) {
+			t.Errorf("service %s is gone", svc)
+		}
+	}
+	if cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionDegraded); cond == nil || cond.Reason != reasonRolledBack {
+		t.Errorf("degraded condition = %+v, want reason %s", cond, reasonRolledBack)
+	}
+	deployment := &appsv1.Deployment{}
+	c.get("web-1", deployment)
+	if want := (labels.Set{"app": "web-1", "tier": "web"}); !labels.Equals(deployment.Spec.Template.Labels, want) {
+		t.Errorf("pod template labels of web-1 = %v, want %v back", deployment.Spec.Template.Labels, want)
+	}
+	if c.get(obj.MergedServiceName(), &corev1.Service{}) {
+		t.Error("the merged service was created")
+	}
+
+	// a rolled back operation waits for the spec to change
+	c.fail = nil
+	c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool { return true })
+	if obj := c.merger("merger"); obj.Status.Phase != newprojv1.PhaseRolledBack || obj.Status.Operation.Attempts != 2 {
+		t.Errorf("phase = %s after %d attempts, want the operation left rolled back", obj.Status.Phase, obj.Status.Operation.Attempts)
+	}
+}
+
+func TestMergedServiceStepResumed(t *testing.T) {
+	objs := []client.Object{testMerger("merger", newprojv1.StrategyLabels, "web-1", "web-2")}
+	objs = append(objs, testMember("web-1", 80, 1)...)
+	objs = append(objs, testMember("web-2", 81, 1)...)
+	c := newTestCluster(t, objs...)
+
+	// the controller goes down right after the merged Service step, before the journal records it as done
+	crashed := false
+	c.fail = func(verb string, obj client.Object) error {
+		merger, ok := obj.(*newprojv1.SvcMergerObj)
+		if !ok || verb != "status" || crashed || merger.Status.Operation == nil {
+			return nil
+		}
+		for _, step := range merger.Status.Operation.Steps {
+			if step.Action == newprojv1.StepMergedService && step.State == newprojv1.StepDone {
+				crashed = true
+				return errInjected
+			}
+		}
+		return nil
+	}
+	c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool { return crashed })
+	obj := c.merger("merger")
+	if step := journalStepOf(t, obj, newprojv1.StepMergedService, ""); step.State == newprojv1.StepDone {
+		t.Fatal("the merged service step was recorded as done")
+	}
+	for _, svc := range []string{"web-1", "web-2"} {
+		if step := journalStepOf(t, obj, newprojv1.StepRollout, svc); step.State != newprojv1.StepDone {
+			t.Fatalf("rollout step of %s is %s, want it done before the crash", svc, step.State)
+		}
+	}
+	if !c.get(obj.MergedServiceName(), &corev1.Service{}) {
+		t.Fatal("the merged service was not created before the crash")
+	}
+
+	// the new controller carries on at the merged Service step and leaves the workloads alone
+	c.restart()
+	var relabeled []string
+	c.fail = func(verb string, obj client.Object) error {
+		if _, ok := obj.(*appsv1.Deployment); ok && verb != "status" {
+			relabeled = append(relabeled, obj.GetName())
+		}
+		return nil
+	}
+	obj = c.reconcileUntil("merger", merged)
+	if len(relabeled) > 0 {
+		t.Errorf("deployments %v were written again after the restart", relabeled)
+	}
+	for _, step := range obj.Status.Operation.Steps {
+		if step.State != newprojv1.StepDone {
+			t.Errorf("step %s of %q is %s, want it done", step.Action, step.Service, step.State)
+		}
+	}
+	merged_svc := &corev1.Service{}
+	if !c.get(obj.MergedServiceName(), merged_svc) || len(merged_svc.Spec.Ports) != 2 {
+		t.Errorf("merged service ports = %v, want the ports of both members", merged_svc.Spec.Ports)
+	}
+	for _, svc := range []string{"web-1", "web-2"} {
+		if c.get(svc, &corev1.Service{}) {
+			t.Errorf("service %s was not cut over", svc)
+		}
+	}
+}
+
+func TestDemergeRetried(t *testing.T) {
+	objs := []client.Object{testMerger("merger", newprojv1.StrategyLabels, "web-1", "web-2")}
+	objs = append(objs, testMember("web-1", 80, 1)...)
+	objs = append(objs, testMember("web-2", 81, 1)...)
+	c := newTestCluster(t, objs...)
+	obj := c.reconcileUntil("merger", merged)
+
+	// web-1 can't be restored for a while; a demerge has nothing to roll back to and keeps trying
+	c.fail = func(verb string, obj client.Object) error {
+		if _, ok := obj.(*corev1.Service); ok && verb == "create" && obj.GetName() == "web-1" {
+			return errInjected
+		}
+		return nil
+	}
+	if err := c.client.Delete(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+	obj = c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool {
+		return obj.Status.Operation != nil && obj.Status.Operation.Type == newprojv1.OperationDemerge &&
+			obj.Status.Operation.Attempts > retryLimit(obj)+2
+	})
+	if op := obj.Status.Operation; op.State != newprojv1.OperationRunning {
+		t.Errorf("demerge state = %s, want it still %s", op.State, newprojv1.OperationRunning)
+	}
+	if step := journalStepOf(t, obj, newprojv1.StepDemerge, "web-1"); step.State != newprojv1.StepFailed ||
+		!strings.Contains(step.Message, errInjected.Error()) {
+		t.Errorf("demerge step of web-1 = %+v, want it failed with the injected error", step)
+	}
+	if obj.Status.Phase == newprojv1.PhaseRolledBack {
+		t.Error("the demerge was rolled back")
+	}
+
+	c.fail = nil
+	c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool { return obj == nil })
+	for _, svc := range []string{"web-1", "web-2"} {
+		if !c.get(svc, &corev1.Service{}) {
+			t.Errorf("service %s was not restored", svc)
+		}
+	}
+	if c.get(obj.MergedServiceName(), &corev1.Service{}) {
+		t.Error("the merged service is left behind")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultKeyDomain is the prefix of the label, annotation and finalizer keys written by the controller
+const DefaultKeyDomain = "svcmerger.newproj.controller.proj"
+
+// Keys are the label, annotation and finalizer keys the controller writes. By default they all live under one
+// domain prefix (see NewKeys); each of them can be overridden from the keys config file (see LoadKeys).
+type Keys struct {
+	// Group is the pod template label holding the SvcMergerObj name, the merged Service selects on it
+	Group string `json:"group"`
+	// Member is the pod template label holding the name of the member Service
+	Member string `json:"member"`
+
+	// MergedBy is set on the merged Service and the objects generated for routing as a label and on member
+	// workloads as an annotation, all hold the SvcMergerObj name
+	MergedBy string `json:"mergedBy"`
+	// MemberAnnotation is set on member workloads and holds the name of the member Service they belong to
+	MemberAnnotation string `json:"memberAnnotation"`
+	// MemberPorts is set on the merged Service and holds a JSON map of member Service name to its original port
+	MemberPorts string `json:"memberPorts"`
+	// OriginalLabels is set on member workloads (and pods labeled directly) and holds, as JSON, the values the
+	// Group and Member labels had before the merge, null for labels that were not set
+	OriginalLabels string `json:"originalLabels"`
+	// ClaimedBy is set on member Services (and so kept in their snapshots) and holds the name of the
+	// SvcMergerObj that claimed them. Workloads are claimed through MergedBy.
+	ClaimedBy string `json:"claimedBy"`
+	// AppliedTemplate is set on the merged Service and holds, as JSON, the label and annotation keys set from
+	// the service template
+	AppliedTemplate string `json:"appliedTemplate"`
+	// AliasOf is set on the alias Services standing in for deleted member Services and holds the SvcMergerObj name
+	AliasOf string `json:"aliasOf"`
+	// ProxyOf is set on the pods of the proxy of the Proxy strategy and holds the SvcMergerObj name, the merged
+	// Service selects on it
+	ProxyOf string `json:"proxyOf"`
+	// EndpointSliceManagedBy is the managed-by label value of the EndpointSlices written by the controller
+	EndpointSliceManagedBy string `json:"endpointSliceManagedBy"`
+
+	// Finalizer protects the SvcMergerObj until the merge is rolled back
+	Finalizer string `json:"finalizer"`
+	// MergedServiceFinalizer protects the merged Service. A value ending in a slash is a prefix the
+	// SvcMergerObj name is appended to.
+	MergedServiceFinalizer string `json:"mergedServiceFinalizer"`
+}
+
+// NewKeys returns the keys under the given domain, e.g. <domain>/group for the Group label
+func NewKeys(domain string) Keys {
+	return Keys{
+		Group:                  domain + "/group",
+		Member:                 domain + "/member",
+		MergedBy:               domain + "/merged-by",
+		MemberAnnotation:       domain + "/member",
+		MemberPorts:            domain + "/member-ports",
+		OriginalLabels:         domain + "/original-labels",
+		ClaimedBy:              domain + "/claimed-by",
+		AppliedTemplate:        domain + "/applied-template",
+		AliasOf:                domain + "/alias-of",
+		ProxyOf:                domain + "/proxy-of",
+		EndpointSliceManagedBy: domain,
+		Finalizer:              domain + "/finalizer",
+		MergedServiceFinalizer: domain + "/merged-service",
+	}
+}
+
+// legacyKeys are the keys written by the first version of the controller, merges made with them are
+// moved over to the configured keys (see migrateLegacyKeys). That version wrote no annotations.
+var legacyKeys = Keys{
+	Group:                  "merge",
+	Member:                 "name",
+	Finalizer:              "finalizer.newproj.controller.proj",
+	MergedServiceFinalizer: "finalizer.newproj.controller.proj/",
+}
+
+// keysConfig is the format of the keys config file. Keys left out of the file are derived from the domain.
+type keysConfig struct {
+	KeyDomain string `json:"keyDomain,omitempty"`
+	Keys      Keys   `json:"keys,omitempty"`
+}
+
+// LoadKeys builds the keys under the given domain and applies the keys config file on top, if a path is given.
+// The file may set its own keyDomain and override single keys, e.g.
+//
+//	keyDomain: svcmerger.example.com
+//	keys:
+//	  group: example.com/merge-group
+func LoadKeys(domain string, path string) (Keys, error) {
+	keys := NewKeys(domain)
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return Keys{}, err
+		}
+		config := keysConfig{}
+		if err := yaml.Unmarshal(raw, &config); err != nil {
+			return Keys{}, fmt.Errorf("not able to parse keys config %s: %w", path, err)
+		}
+		if config.KeyDomain != "" {
+			keys = NewKeys(config.KeyDomain)
+		}
+		// unmarshal again on top of the defaults, so that only the keys in the file are overridden
+		config.Keys = keys
+		if err := yaml.Unmarshal(raw, &config); err != nil {
+			return Keys{}, fmt.Errorf("not able to parse keys config %s: %w", path, err)
+		}
+		keys = config.Keys
+	}
+	return keys, keys.validate()
+}
+
+// validate checks that every key is a valid qualified name
+func (k Keys) validate() error {
+	for field, key := range map[string]string{
+		"group":                  k.Group,
+		"member":                 k.Member,
+		"mergedBy":               k.MergedBy,
+		"memberAnnotation":       k.MemberAnnotation,
+		"memberPorts":            k.MemberPorts,
+		"originalLabels":         k.OriginalLabels,
+		"claimedBy":              k.ClaimedBy,
+		"appliedTemplate":        k.AppliedTemplate,
+		"aliasOf":                k.AliasOf,
+		"proxyOf":                k.ProxyOf,
+		"finalizer":              k.Finalizer,
+		"mergedServiceFinalizer": strings.TrimSuffix(k.MergedServiceFinalizer, "/"),
+	} {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("key %s %q is not valid: %s", field, key, strings.Join(errs, ", "))
+		}
+	}
+	if errs := validation.IsValidLabelValue(k.EndpointSliceManagedBy); len(errs) > 0 {
+		return fmt.Errorf("key endpointSliceManagedBy %q is not valid: %s", k.EndpointSliceManagedBy, strings.Join(errs, ", "))
+	}
+	if k.Group == k.Member {
+		return fmt.Errorf("the group and member labels have to differ, both are %q", k.Group)
+	}
+	return nil
+}
+
+// mergedServiceFinalizerFor returns the finalizer of the merged Service of the named SvcMergerObj
+func (k Keys) mergedServiceFinalizerFor(name string) string {
+	if strings.HasSuffix(k.MergedServiceFinalizer, "/") {
+		return k.MergedServiceFinalizer + name
+	}
+	return k.MergedServiceFinalizer
+}
+
+// addMergeLabels adds the merge labels to a label map, creating it if needed
+func (k Keys) addMergeLabels(labels map[string]string, name string, svc string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[k.Group] = name
+	labels[k.Member] = svc
+	return labels
+}
+
+// hasMergeLabels tells whether a label map carries the merge labels of the given member
+func (k Keys) hasMergeLabels(labels map[string]string, name string, svc string) bool {
+	return labels[k.Group] == name && labels[k.Member] == svc
+}
+
+// saveOriginalLabels records the values the merge labels have before the merge changes them, as JSON in the
+// original labels annotation; labels that are not set are recorded as null. Values saved earlier are kept, and
+// labels that already carry the merge (from a merge made before the values were saved) are not recorded.
+func (k Keys) saveOriginalLabels(annotations map[string]string, labels map[string]string, name string) map[string]string {
+	if _, ok := annotations[k.OriginalLabels]; ok || labels[k.Group] == name {
+		return annotations
+	}
+	original := map[string]*string{
+		k.Group:  nil,
+		k.Member: nil,
+	}
+	for key := range original {
+		if value, ok := labels[key]; ok {
+			original[key] = &value
+		}
+	}
+	raw, err := json.Marshal(original)
+	if err != nil {
+		return annotations
+	}
+	annotations[k.OriginalLabels] = string(raw)
+	return annotations
+}
+
+// restoreOriginalLabels puts back the label values recorded by saveOriginalLabels. Without a record only the
+// group label is removed, as older versions of the controller did.
+func (k Keys) restoreOriginalLabels(annotations map[string]string, labels map[string]string) map[string]string {
+	original := make(map[string]*string)
+	raw, ok := annotations[k.OriginalLabels]
+	if !ok || json.Unmarshal([]byte(raw), &original) != nil {
+		delete(labels, k.Group)
+		return labels
+	}
+	for key, value := range original {
+		if value == nil {
+			delete(labels, key)
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = *value
+	}
+	return labels
+}
+
+// checkSelectorLabels refuses to change a label the workload selects its pods on. The selector of most workloads
+// is immutable, and changing the label on the template would leave the workload without pods it recognizes.
+func (k Keys) checkSelectorLabels(ref workloadRef, selector *metav1.LabelSelector, labels map[string]string, name string, svc string) error {
+	if selector == nil {
+		return nil
+	}
+	selector_keys := make(map[string]bool)
+	for key := range selector.MatchLabels {
+		selector_keys[key] = true
+	}
+	for _, expression := range selector.MatchExpressions {
+		selector_keys[expression.Key] = true
+	}
+	desired := map[string]string{
+		k.Group:  name,
+		k.Member: svc,
+	}
+	for _, key := range []string{k.Group, k.Member} {
+		if selector_keys[key] && labels[key] != desired[key] {
+			return newReasonError(reasonSelectorLabel,
+				fmt.Errorf("label %q is part of the selector of %s, the merge would have to change it from %q to %q", key, ref.String(), labels[key], desired[key]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons used while the spec resolves to no member Service
+const (
+	reasonInvalidSelector = "InvalidSelector"
+	reasonNoMembers       = "NoMembers"
+)
+
+// resolveMembers returns the member Services of the SvcMergerObj: the listed ones in the order of the spec,
+// followed by the ones the service selector picks, sorted by name. A live Service is picked by its labels, a
+// member whose Service was deleted by the cutover by the labels kept in its snapshot. Merged Services, aliases and
+// Services claimed by another active SvcMergerObj are never picked; the latter join once they are released.
+func (r *SvcMergerObjReconciler) resolveMembers(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState) ([]string, error) {
+	l := log.FromContext(ctx)
+	services := append([]string(nil), obj.Spec.Services...)
+	if obj.Spec.ServiceSelector == nil {
+		return services, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(obj.Spec.ServiceSelector)
+	if err != nil {
+		return nil, newReasonError(reasonInvalidSelector, err)
+	}
+
+	resolved := make(map[string]bool)
+	for _, svc := range services {
+		resolved[svc] = true
+	}
+	var picked []string
+	service_list := &corev1.ServiceList{}
+	if err := r.List(ctx, service_list, client.InNamespace(obj.Namespace)); err != nil {
+		l.Error(err, "not able to list services")
+		return nil, err
+	}
+	for i := range service_list.Items {
+		service := &service_list.Items[i]
+		if resolved[service.Name] || !selector.Matches(labels.Set(service.Labels)) {
+			continue
+		}
+		if service.Name == obj.MergedServiceName() || service.Name == liveMergedServiceName(obj) ||
+			service.Labels[r.Keys.MergedBy] != "" || service.Labels[r.Keys.AliasOf] != "" {
+			continue
+		}
+		active, err := r.activeHolder(ctx, obj, service.Annotations[r.Keys.ClaimedBy], service.Name)
+		if err != nil {
+			return nil, err
+		}
+		if active {
+			continue
+		}
+		resolved[service.Name] = true
+		picked = append(picked, service.Name)
+	}
+	for svc, snapshot := range state.snapshots {
+		if !resolved[svc] && selector.Matches(labels.Set(snapshot.Labels)) {
+			resolved[svc] = true
+			picked = append(picked, svc)
+		}
+	}
+	sort.Strings(picked)
+	return append(services, picked...), nil
+}
+
+// reconcileNoMembers handles a spec that resolves to no member Service, e.g. a selector no Service is labeled
+// for yet. Whatever is merged is demerged and the merged Service deleted, then the SvcMergerObj waits in the
+// Pending phase for Services to show up.
+func (r *SvcMergerObjReconciler) reconcileNoMembers(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	op := obj.Status.Operation
+	if (len(state.memberNames()) > 0 || state.mergedService != nil) &&
+		(op == nil || op.Type != newprojv1.OperationDemerge || op.State != newprojv1.OperationRunning) {
+		l.Info("no member service left, rolling back the merge")
+		members := state.memberNames()
+		planDemerge(obj, members)
+		for _, svc := range members {
+			setMemberState(obj, svc, newprojv1.MemberDetaching, "")
+		}
+		setPhase(obj, newprojv1.PhaseDemerging)
+		markProgressing(obj, reasonDemerging, "no member service left, rolling back the merge")
+		if err := r.updateStatus(ctx, obj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if op := obj.Status.Operation; op != nil && op.Type == newprojv1.OperationDemerge && op.State == newprojv1.OperationRunning {
+		done, result, err := r.runOperation(ctx, obj, &mergeRun{state: state})
+		if !done {
+			return result, err
+		}
+	}
+
+	if _, err := r.syncRouting(ctx, obj, nil, nil); err != nil {
+		return ctrl.Result{}, r.failMember(ctx, obj, "", err)
+	}
+	if _, err := r.syncProxy(ctx, obj, nil, nil, nil); err != nil {
+		return ctrl.Result{}, r.failMember(ctx, obj, "", err)
+	}
+	for _, member := range append([]newprojv1.MemberStatus(nil), obj.Status.Members...) {
+		removeMember(obj, member.Name)
+	}
+	obj.Status.MergedService = nil
+	obj.Status.ObservedGeneration = obj.Generation
+	message := "no service matches the spec, waiting for member services"
+	if cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionReady); obj.Status.Phase != newprojv1.PhasePending ||
+		cond == nil || cond.Reason != reasonNoMembers {
+		l.Info(message)
+	}
+	setPhase(obj, newprojv1.PhasePending)
+	clearConflict(obj)
+	setCondition(obj, newprojv1.ConditionReady, metav1.ConditionFalse, reasonNoMembers, message)
+	setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, reasonNoMembers, message)
+	if err := r.updateStatus(ctx, obj); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// reasonMigratingKeys is the reason of the event written when a merge is moved over from the legacy keys
+const reasonMigratingKeys = "MigratingKeys"
+
+// hasLegacyKeys tells whether the merged Service still carries any of the legacy keys
+func hasLegacyKeys(merged_svc *corev1.Service, name string) bool {
+	return merged_svc.Spec.Selector[legacyKeys.Group] == name ||
+		controllerutil.ContainsFinalizer(merged_svc, legacyKeys.mergedServiceFinalizerFor(name))
+}
+
+// migrateLegacyKeys moves a merge made with the legacy keys over to the configured ones without taking the
+// merged Service down:
+//  1. the workloads get the new labels and annotations next to the legacy ones, and roll out
+//  2. once the rollouts are done, the merged Service selects on the new group label and carries the new keys
+//  3. the legacy labels and annotations are removed from the workloads, putting back the values they replaced
+//
+// Every step can be done again, so a migration that is interrupted simply carries on. It returns true once
+// nothing of the legacy keys is left.
+func (r *SvcMergerObjReconciler) migrateLegacyKeys(ctx context.Context, obj *newprojv1.SvcMergerObj) (bool, error) {
+	l := log.FromContext(ctx)
+	name := obj.Name
+	if r.Keys == legacyKeys {
+		return true, nil
+	}
+
+	// Finalizers can't be added to an object that is being deleted, reconcileDelete releases both then
+	if obj.DeletionTimestamp.IsZero() && controllerutil.RemoveFinalizer(obj, legacyKeys.Finalizer) {
+		controllerutil.AddFinalizer(obj, r.Keys.Finalizer)
+		if err := r.Update(ctx, obj); err != nil {
+			l.Error(err, "not able to move the finalizer to the new key")
+			return false, err
+		}
+	}
+
+	legacy_workloads, err := r.findMergedWorkloads(ctx, obj, legacyKeys)
+	if err != nil {
+		l.Error(err, "not able to find workloads merged with the legacy keys")
+		return false, err
+	}
+	merged_svc := &corev1.Service{}
+	err = r.Get(ctx, types.NamespacedName{Name: liveMergedServiceName(obj), Namespace: obj.Namespace}, merged_svc)
+	if apierrors.IsNotFound(err) {
+		merged_svc = nil
+	} else if err != nil {
+		l.Error(err, "not able to fetch merged service")
+		return false, err
+	}
+	legacy_svc := merged_svc != nil && hasLegacyKeys(merged_svc, name)
+	if len(legacy_workloads) == 0 && !legacy_svc {
+		return true, nil
+	}
+	l.Info("migrating merge from the legacy keys", "workloads", len(legacy_workloads))
+
+	// 1. new labels next to the legacy ones
+	waiting := false
+	for ref, svc := range legacy_workloads {
+		if svc == "" {
+			continue
+		}
+		updated, err := r.labelWorkload(ctx, obj, ref, svc)
+		if err != nil {
+			return false, err
+		}
+		if updated && r.Recorder != nil {
+			r.Recorder.Eventf(obj, corev1.EventTypeNormal, reasonMigratingKeys, "moving %s over to the label %s", ref.String(), r.Keys.Group)
+		}
+		done, _, err := r.workloadRollout(ctx, obj.Namespace, ref)
+		if err != nil {
+			return false, err
+		}
+		waiting = waiting || !done
+	}
+	if waiting {
+		return false, nil
+	}
+
+	// 2. switch the merged service
+	if legacy_svc {
+		if merged_svc.Spec.Selector[legacyKeys.Group] == name {
+			merged_svc.Spec.Selector = map[string]string{r.Keys.Group: name}
+		}
+		if merged_svc.Labels == nil {
+			merged_svc.Labels = make(map[string]string)
+		}
+		merged_svc.Labels[r.Keys.MergedBy] = name
+		if controllerutil.RemoveFinalizer(merged_svc, legacyKeys.mergedServiceFinalizerFor(name)) && merged_svc.DeletionTimestamp.IsZero() {
+			controllerutil.AddFinalizer(merged_svc, r.Keys.mergedServiceFinalizerFor(name))
+		}
+		if err := r.Update(ctx, merged_svc); err != nil {
+			l.Error(err, "not able to move the merged service to the new keys")
+			return false, err
+		}
+	}
+
+	// 3. drop the legacy labels
+	for ref := range legacy_workloads {
+		if err := r.unlabelWorkload(ctx, obj, ref, legacyKeys); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
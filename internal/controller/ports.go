@@ -0,0 +1,217 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// mergedPort is a port of the merged Service together with the member it comes from
+type mergedPort struct {
+	corev1.ServicePort
+	service string
+
+	// readyEndpoints is counted when the controller writes the EndpointSlices, nil otherwise
+	readyEndpoints *int32
+}
+
+// mergedPortName builds the name of a merged Service port. Port names have to be DNS labels of at most 63 characters.
+func mergedPortName(svc string, source string) string {
+	name := strings.ToLower(svc + "-" + source)
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// targetPortOf returns the target port of a member port, which defaults to the port number itself
+func targetPortOf(port *corev1.ServicePort) intstr.IntOrString {
+	if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+		return intstr.FromInt(int(port.Port))
+	}
+	return port.TargetPort
+}
+
+// buildMergedPorts works out the ports of the merged Service from the spec and the member Services.
+// With spec.ports set, only the mapped ports are exposed and any collision is an error. Otherwise every
+// port of every member is carried over; ports colliding with an earlier member are skipped and returned
+// as collision messages, unless every port reaches its own member only (see isolatePorts): then they are
+// exposed on another number (see freePortNumber).
+func buildMergedPorts(obj *newprojv1.SvcMergerObj, members []string, specs map[string]*corev1.Service) ([]mergedPort, []string, error) {
+	var ports []mergedPort
+	var collisions []string
+	taken := make(map[string]string) // "<port>/<protocol>" -> member service
+
+	if len(obj.Spec.Ports) > 0 {
+		for _, mapping := range obj.Spec.Ports {
+			service, ok := specs[mapping.Service]
+			if !ok {
+				return nil, nil, fmt.Errorf("port mapping refers to service %s which is not a member", mapping.Service)
+			}
+			source, ok := newprojv1.FindServicePort(service, mapping.SourcePort)
+			if !ok {
+				return nil, nil, fmt.Errorf("service %s has no port %s", mapping.Service, mapping.SourcePort.String())
+			}
+			protocol := source.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			key := fmt.Sprintf("%d/%s", mapping.Port, protocol)
+			if owner, ok := taken[key]; ok {
+				return nil, nil, fmt.Errorf("port %s is mapped for both %s and %s", key, owner, mapping.Service)
+			}
+			taken[key] = mapping.Service
+
+			port_name := mapping.Name
+			if port_name == "" {
+				port_name = mergedPortName(mapping.Service, mapping.SourcePort.String())
+			}
+			ports = append(ports, mergedPort{
+				ServicePort: corev1.ServicePort{
+					Name:        port_name,
+					Port:        mapping.Port,
+					Protocol:    protocol,
+					AppProtocol: source.AppProtocol,
+					TargetPort:  targetPortOf(source),
+				},
+				service: mapping.Service,
+			})
+		}
+		return ports, nil, nil
+	}
+
+	for _, svc := range members {
+		service, ok := specs[svc]
+		if !ok {
+			continue
+		}
+		for i := range service.Spec.Ports {
+			source := &service.Spec.Ports[i]
+			protocol := source.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			source_name := source.Name
+			if source_name == "" {
+				source_name = fmt.Sprint(source.Port)
+			}
+			name := mergedPortName(svc, source_name)
+			number := source.Port
+			key := fmt.Sprintf("%d/%s", number, protocol)
+			if owner, ok := taken[key]; ok {
+				if !isolatePorts(obj) {
+					collisions = append(collisions, fmt.Sprintf("port %s of %s collides with %s", key, svc, owner))
+					continue
+				}
+				number = freePortNumber(obj, name, number, protocol, taken)
+				key = fmt.Sprintf("%d/%s", number, protocol)
+			}
+			taken[key] = svc
+
+			ports = append(ports, mergedPort{
+				ServicePort: corev1.ServicePort{
+					Name:        name,
+					Port:        number,
+					Protocol:    protocol,
+					AppProtocol: source.AppProtocol,
+					TargetPort:  targetPortOf(source),
+				},
+				service: svc,
+			})
+		}
+	}
+	return ports, collisions, nil
+}
+
+// freePortNumber returns the number a port colliding with an earlier member is exposed on: the one the port
+// has in the status if that is still free, so that it doesn't move, else the next free number after it
+func freePortNumber(obj *newprojv1.SvcMergerObj, name string, number int32, protocol corev1.Protocol, taken map[string]string) int32 {
+	if obj.Status.MergedService != nil {
+		for _, port := range obj.Status.MergedService.Ports {
+			if port.Name == name && port.Protocol == string(protocol) {
+				if _, ok := taken[fmt.Sprintf("%d/%s", port.Port, protocol)]; !ok {
+					return port.Port
+				}
+			}
+		}
+	}
+	for {
+		number = number%65535 + 1
+		if _, ok := taken[fmt.Sprintf("%d/%s", number, protocol)]; !ok {
+			return number
+		}
+	}
+}
+
+// servicePorts strips the member information off the merged ports
+func servicePorts(ports []mergedPort) []corev1.ServicePort {
+	var service_ports []corev1.ServicePort
+	for _, port := range ports {
+		service_ports = append(service_ports, port.ServicePort)
+	}
+	return service_ports
+}
+
+// portsEqual compares the ports of a live Service against the desired ones, ignoring what the API server fills in
+func portsEqual(live []corev1.ServicePort, desired []corev1.ServicePort) bool {
+	if len(live) != len(desired) {
+		return false
+	}
+	for i := range live {
+		a, b := live[i], desired[i]
+		if a.Name != b.Name || a.Port != b.Port || a.Protocol != b.Protocol || a.TargetPort != b.TargetPort {
+			return false
+		}
+	}
+	return true
+}
+
+// setMergedPorts records the merged ports in the status
+func setMergedPorts(obj *newprojv1.SvcMergerObj, ports []mergedPort) {
+	if obj.Status.MergedService == nil {
+		return
+	}
+	obj.Status.MergedService.Ports = nil
+	for _, port := range ports {
+		obj.Status.MergedService.Ports = append(obj.Status.MergedService.Ports, newprojv1.MergedPortStatus{
+			Name:           port.Name,
+			Port:           port.Port,
+			Protocol:       string(port.Protocol),
+			Service:        port.service,
+			TargetPort:     port.TargetPort,
+			ReadyEndpoints: port.readyEndpoints,
+		})
+	}
+}
+
+// mergedPortsChanged tells whether the ports recorded in the status differ from the given ones, ready
+// endpoint counts included
+func mergedPortsChanged(obj *newprojv1.SvcMergerObj, ports []mergedPort) bool {
+	if obj.Status.MergedService == nil {
+		return false
+	}
+	probe := obj.DeepCopy()
+	setMergedPorts(probe, ports)
+	return !reflect.DeepEqual(probe.Status.MergedService.Ports, obj.Status.MergedService.Ports)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// testService builds a member Service with the given ports
+func testService(name string, ports ...corev1.ServicePort) *corev1.Service {
+	service := &corev1.Service{}
+	service.Name = name
+	service.Spec.Selector = map[string]string{"app": name}
+	service.Spec.Ports = ports
+	return service
+}
+
+// testPort builds a service port; an empty protocol is left for the defaulting under test
+func testPort(name string, port int32, protocol corev1.Protocol, target intstr.IntOrString) corev1.ServicePort {
+	return corev1.ServicePort{Name: name, Port: port, Protocol: protocol, TargetPort: target}
+}
+
+// portSummary is what the tests compare of a merged port
+type portSummary struct {
+	name     string
+	port     int32
+	protocol corev1.Protocol
+	target   intstr.IntOrString
+	service  string
+}
+
+func summarize(ports []mergedPort) []portSummary {
+	var summaries []portSummary
+	for _, port := range ports {
+		summaries = append(summaries, portSummary{port.Name, port.Port, port.Protocol, port.TargetPort, port.service})
+	}
+	return summaries
+}
+
+func TestMergedPortName(t *testing.T) {
+	tests := []struct {
+		name   string
+		svc    string
+		source string
+		want   string
+	}{
+		{name: "named source", svc: "web-1", source: "http", want: "web-1-http"},
+		{name: "numeric source", svc: "web-1", source: "8080", want: "web-1-8080"},
+		{name: "lower case", svc: "Web-1", source: "HTTP", want: "web-1-http"},
+		{name: "truncated to 63", svc: strings.Repeat("a", 60), source: "http", want: strings.Repeat("a", 60) + "-ht"},
+		{name: "no trailing dash after truncation", svc: strings.Repeat("a", 62), source: "http", want: strings.Repeat("a", 62)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergedPortName(test.svc, test.source)
+			if got != test.want {
+				t.Errorf("mergedPortName(%q, %q) = %q, want %q", test.svc, test.source, got, test.want)
+			}
+			if len(got) > 63 {
+				t.Errorf("mergedPortName(%q, %q) is %d characters long", test.svc, test.source, len(got))
+			}
+		})
+	}
+}
+
+func TestBuildMergedPorts(t *testing.T) {
+	specs := map[string]*corev1.Service{
+		"web-1": testService("web-1",
+			testPort("http", 80, "", intstr.FromInt(8080)),
+			testPort("", 9090, corev1.ProtocolTCP, intstr.IntOrString{})),
+		"web-2": testService("web-2",
+			testPort("http", 80, corev1.ProtocolTCP, intstr.FromString("web")),
+			testPort("dns", 53, corev1.ProtocolUDP, intstr.FromInt(5353))),
+		"web-3": testService("web-3",
+			testPort("dns", 53, corev1.ProtocolTCP, intstr.FromInt(5353))),
+	}
+	tests := []struct {
+		name       string
+		strategy   newprojv1.MergeStrategy
+		status     []newprojv1.MergedPortStatus
+		mappings   []newprojv1.PortMapping
+		members    []string
+		want       []portSummary
+		collisions int
+		err        string
+	}{
+		{
+			name:    "carry over",
+			members: []string{"web-1"},
+			want: []portSummary{
+				{"web-1-http", 80, corev1.ProtocolTCP, intstr.FromInt(8080), "web-1"},
+				{"web-1-9090", 9090, corev1.ProtocolTCP, intstr.FromInt(9090), "web-1"},
+			},
+		},
+		{
+			name:    "collision with an earlier member is skipped",
+			members: []string{"web-1", "web-2"},
+			want: []portSummary{
+				{"web-1-http", 80, corev1.ProtocolTCP, intstr.FromInt(8080), "web-1"},
+				{"web-1-9090", 9090, corev1.ProtocolTCP, intstr.FromInt(9090), "web-1"},
+				{"web-2-dns", 53, corev1.ProtocolUDP, intstr.FromInt(5353), "web-2"},
+			},
+			collisions: 1,
+		},
+		{
+			name:     "collision moved to the next free number when ports are isolated",
+			strategy: newprojv1.StrategyEndpointSlicePerPort,
+			members:  []string{"web-1", "web-2"},
+			want: []portSummary{
+				{"web-1-http", 80, corev1.ProtocolTCP, intstr.FromInt(8080), "web-1"},
+				{"web-1-9090", 9090, corev1.ProtocolTCP, intstr.FromInt(9090), "web-1"},
+				{"web-2-http", 81, corev1.ProtocolTCP, intstr.FromString("web"), "web-2"},
+				{"web-2-dns", 53, corev1.ProtocolUDP, intstr.FromInt(5353), "web-2"},
+			},
+		},
+		{
+			name:     "moved port keeps the number of the status",
+			strategy: newprojv1.StrategyEndpointSlicePerPort,
+			status:   []newprojv1.MergedPortStatus{{Name: "web-2-http", Port: 8000, Protocol: "TCP", Service: "web-2"}},
+			members:  []string{"web-1", "web-2"},
+			want: []portSummary{
+				{"web-1-http", 80, corev1.ProtocolTCP, intstr.FromInt(8080), "web-1"},
+				{"web-1-9090", 9090, corev1.ProtocolTCP, intstr.FromInt(9090), "web-1"},
+				{"web-2-http", 8000, corev1.ProtocolTCP, intstr.FromString("web"), "web-2"},
+				{"web-2-dns", 53, corev1.ProtocolUDP, intstr.FromInt(5353), "web-2"},
+			},
+		},
+		{
+			name:    "same number with another protocol is no collision",
+			members: []string{"web-2", "web-3"},
+			want: []portSummary{
+				{"web-2-http", 80, corev1.ProtocolTCP, intstr.FromString("web"), "web-2"},
+				{"web-2-dns", 53, corev1.ProtocolUDP, intstr.FromInt(5353), "web-2"},
+				{"web-3-dns", 53, corev1.ProtocolTCP, intstr.FromInt(5353), "web-3"},
+			},
+		},
+		{
+			name:    "members without a spec are left out",
+			members: []string{"gone", "web-3"},
+			want: []portSummary{
+				{"web-3-dns", 53, corev1.ProtocolTCP, intstr.FromInt(5353), "web-3"},
+			},
+		},
+		{
+			name:    "explicit mappings by name and number",
+			members: []string{"web-1", "web-2"},
+			mappings: []newprojv1.PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("http"), Port: 8001},
+				{Service: "web-2", SourcePort: intstr.FromInt(80), Port: 8002, Name: "second"},
+			},
+			want: []portSummary{
+				{"web-1-http", 8001, corev1.ProtocolTCP, intstr.FromInt(8080), "web-1"},
+				{"second", 8002, corev1.ProtocolTCP, intstr.FromString("web"), "web-2"},
+			},
+		},
+		{
+			name:    "mapping of a non member",
+			members: []string{"web-1"},
+			mappings: []newprojv1.PortMapping{
+				{Service: "other", SourcePort: intstr.FromInt(80), Port: 8001},
+			},
+			err: "not a member",
+		},
+		{
+			name:    "mapping of a missing source port",
+			members: []string{"web-1"},
+			mappings: []newprojv1.PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromString("grpc"), Port: 8001},
+			},
+			err: "has no port grpc",
+		},
+		{
+			name:    "port mapped twice",
+			members: []string{"web-1", "web-2"},
+			mappings: []newprojv1.PortMapping{
+				{Service: "web-1", SourcePort: intstr.FromInt(80), Port: 8000},
+				{Service: "web-2", SourcePort: intstr.FromInt(80), Port: 8000},
+			},
+			err: "mapped for both",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj := &newprojv1.SvcMergerObj{}
+			obj.Spec.Strategy = test.strategy
+			obj.Spec.Ports = test.mappings
+			if test.status != nil {
+				obj.Status.MergedService = &newprojv1.MergedServiceStatus{Ports: test.status}
+			}
+			member_specs := make(map[string]*corev1.Service)
+			for _, svc := range test.members {
+				if spec, ok := specs[svc]; ok {
+					member_specs[svc] = spec
+				}
+			}
+			ports, collisions, err := buildMergedPorts(obj, test.members, member_specs)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := summarize(ports); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ports = %+v, want %+v", got, test.want)
+			}
+			if len(collisions) != test.collisions {
+				t.Errorf("collisions = %v, want %d", collisions, test.collisions)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+	"controllerProj/internal/proxy"
+)
+
+// Reasons of the ProxyReady condition
+const (
+	reasonProxyAvailable = "Available"
+	reasonProxyPending   = "Pending"
+	reasonNoProxyImage   = "NoProxyImage"
+)
+
+const (
+	// proxyContainerName is the name of the proxy container in the proxy pods
+	proxyContainerName = "proxy"
+	// proxyConfigVolume is the volume the routing table ConfigMap is mounted from
+	proxyConfigVolume = "config"
+	// proxyConfigDir is where the routing table is mounted in the proxy pods
+	proxyConfigDir = "/etc/svcmerger-proxy"
+	// proxyProbePort serves the health and ready checks of the proxy, no listener can take it
+	proxyProbePort = 15081
+)
+
+// useProxy tells whether the SvcMergerObj puts a proxy behind its merged Service
+func useProxy(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Spec.Strategy == newprojv1.StrategyProxy
+}
+
+// proxyName returns the name of the proxy Deployment and of its routing table ConfigMap
+func proxyName(obj *newprojv1.SvcMergerObj) string {
+	return boundedName(obj.Name + "-proxy")
+}
+
+// proxyPodLabels are the labels of the proxy pods, the merged Service selects on them
+func (r *SvcMergerObjReconciler) proxyPodLabels(obj *newprojv1.SvcMergerObj) map[string]string {
+	return map[string]string{r.Keys.ProxyOf: obj.Name}
+}
+
+// proxyListenersSet tells whether the spec lists the listeners of the proxy, instead of leaving them to the merged ports
+func proxyListenersSet(obj *newprojv1.SvcMergerObj) bool {
+	return useProxy(obj) && obj.Spec.Proxy != nil && len(obj.Spec.Proxy.Listeners) > 0
+}
+
+// proxyProtocol returns the protocol of a listener, TCP if unset
+func proxyProtocol(listener newprojv1.ProxyListener) newprojv1.ProxyProtocol {
+	if listener.Protocol == "" {
+		return newprojv1.ProxyTCP
+	}
+	return listener.Protocol
+}
+
+// mergedServicePorts returns the ports of the merged Service: the merged member ports, or with the Proxy
+// strategy the ports the proxy listens on, which only proxies TCP
+func mergedServicePorts(obj *newprojv1.SvcMergerObj, ports []mergedPort) []corev1.ServicePort {
+	if !useProxy(obj) {
+		return servicePorts(ports)
+	}
+	var service_ports []corev1.ServicePort
+	if proxyListenersSet(obj) {
+		for _, listener := range obj.Spec.Proxy.Listeners {
+			if listener.Port == proxyProbePort {
+				continue
+			}
+			name := listener.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", strings.ToLower(string(proxyProtocol(listener))), listener.Port)
+			}
+			service_ports = append(service_ports, corev1.ServicePort{
+				Name:       name,
+				Port:       listener.Port,
+				Protocol:   corev1.ProtocolTCP,
+				TargetPort: intstr.FromInt(int(listener.Port)),
+			})
+		}
+		return service_ports
+	}
+	for _, port := range ports {
+		if port.Protocol != corev1.ProtocolTCP || port.Port == proxyProbePort {
+			continue
+		}
+		service_ports = append(service_ports, corev1.ServicePort{
+			Name:        port.Name,
+			Port:        port.Port,
+			Protocol:    corev1.ProtocolTCP,
+			AppProtocol: port.AppProtocol,
+			TargetPort:  intstr.FromInt(int(port.Port)),
+		})
+	}
+	return service_ports
+}
+
+// proxyBackend returns the address the proxy reaches a port of a member on: the backend Service of the member,
+// under its cluster DNS name
+func (r *SvcMergerObjReconciler) proxyBackend(obj *newprojv1.SvcMergerObj, members map[string]bool, member_specs map[string]*corev1.Service, svc string, source *intstr.IntOrString) (string, error) {
+	spec, ok := member_specs[svc]
+	if !members[svc] || !ok {
+		return "", fmt.Errorf("service %s is not a member", svc)
+	}
+	if len(spec.Spec.Selector) == 0 || len(spec.Spec.Ports) == 0 {
+		return "", fmt.Errorf("service %s has no selector or no ports to build a backend from", svc)
+	}
+	port := &spec.Spec.Ports[0]
+	if source != nil {
+		if port, ok = newprojv1.FindServicePort(spec, *source); !ok {
+			return "", fmt.Errorf("service %s has no port %s", svc, source.String())
+		}
+	}
+	return fmt.Sprintf("%s.%s.svc.%s:%d", backendServiceName(obj, svc), obj.Namespace, r.ClusterDomain, port.Port), nil
+}
+
+// proxyConfig builds the routing table of the proxy from the listeners of the spec, or else a TCP listener for
+// every merged port that forwards to the member port it was taken from. Routes that can't reach their member
+// are left out and returned as messages.
+func (r *SvcMergerObjReconciler) proxyConfig(obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service, ports []mergedPort) (*proxy.Config, []string) {
+	members := make(map[string]bool)
+	for _, svc := range services {
+		members[svc] = true
+	}
+	config := &proxy.Config{}
+	var skipped []string
+	probe_port_taken := fmt.Sprintf("port %d is taken by the health checks of the proxy", proxyProbePort)
+
+	if proxyListenersSet(obj) {
+		for _, listener := range obj.Spec.Proxy.Listeners {
+			if listener.Port == proxyProbePort {
+				skipped = append(skipped, probe_port_taken)
+				continue
+			}
+			proxy_listener := proxy.Listener{Port: listener.Port, Protocol: string(proxyProtocol(listener))}
+			for _, route := range listener.Routes {
+				backend, err := r.proxyBackend(obj, members, member_specs, route.Service, route.Port)
+				if err != nil {
+					skipped = append(skipped, fmt.Sprintf("route of listener %d: %s", listener.Port, err.Error()))
+					continue
+				}
+				proxy_listener.Routes = append(proxy_listener.Routes, proxy.Route{Host: route.Host, PathPrefix: route.PathPrefix, Backend: backend})
+			}
+			config.Listeners = append(config.Listeners, proxy_listener)
+		}
+		return config, skipped
+	}
+
+	for _, port := range ports {
+		if port.Protocol != corev1.ProtocolTCP {
+			skipped = append(skipped, fmt.Sprintf("port %d/%s of %s: the proxy only forwards TCP", port.Port, port.Protocol, port.service))
+			continue
+		}
+		if port.Port == proxyProbePort {
+			skipped = append(skipped, probe_port_taken)
+			continue
+		}
+		// the member port is the one the merged port was taken from
+		var source *intstr.IntOrString
+		if spec, ok := member_specs[port.service]; ok {
+			for i := range spec.Spec.Ports {
+				member_port := &spec.Spec.Ports[i]
+				if (member_port.Protocol == "" || member_port.Protocol == corev1.ProtocolTCP) && targetPortOf(member_port) == port.TargetPort {
+					number := intstr.FromInt(int(member_port.Port))
+					source = &number
+					break
+				}
+			}
+		}
+		if source == nil {
+			skipped = append(skipped, fmt.Sprintf("port %d: service %s has no port with target port %s", port.Port, port.service, port.TargetPort.String()))
+			continue
+		}
+		backend, err := r.proxyBackend(obj, members, member_specs, port.service, source)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("port %d: %s", port.Port, err.Error()))
+			continue
+		}
+		config.Listeners = append(config.Listeners, proxy.Listener{
+			Port:     port.Port,
+			Protocol: proxy.ProtocolTCP,
+			Routes:   []proxy.Route{{Backend: backend}},
+		})
+	}
+	return config, skipped
+}
+
+// syncProxy brings the proxy of the Proxy strategy in line with the spec and the members: the routing table
+// in a ConfigMap, which the proxy reloads by itself, and the Deployment running the proxy, both owned by the
+// SvcMergerObj. The backend Services the routes go to are written first. Without the Proxy strategy or without
+// members the proxy is removed. It reports whether the status of the proxy changed.
+func (r *SvcMergerObjReconciler) syncProxy(ctx context.Context, obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service, ports []mergedPort) (bool, error) {
+	l := log.FromContext(ctx)
+	before := obj.Status.DeepCopy()
+	if !useProxy(obj) || len(services) == 0 {
+		if err := r.deleteProxy(ctx, obj); err != nil {
+			return false, err
+		}
+		obj.Status.Proxy = nil
+		meta.RemoveStatusCondition(&obj.Status.Conditions, newprojv1.ConditionProxyReady)
+		return before.Proxy != nil, nil
+	}
+
+	image := r.ProxyImage
+	if obj.Spec.Proxy != nil && obj.Spec.Proxy.Image != "" {
+		image = obj.Spec.Proxy.Image
+	}
+	if image == "" {
+		return false, newReasonError(reasonNoProxyImage, fmt.Errorf("no proxy image, set spec.proxy.image or start the controller with --proxy-image"))
+	}
+	blocked, err := r.syncBackends(ctx, obj, r.backendsFor(obj, services, member_specs))
+	if err != nil {
+		return false, err
+	}
+	// members whose backend name is taken by a Service of someone else can't be reached
+	blocked_members := make(map[string]bool)
+	for svc := range blocked {
+		blocked_members[svc] = true
+	}
+	config, skipped := r.proxyConfig(obj, withoutMembers(services, blocked_members), member_specs, ports)
+	skipped = append(skipped, blockedMessages(blocked)...)
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return false, err
+	}
+	config_map := &corev1.ConfigMap{}
+	config_map.Name = proxyName(obj)
+	config_map.Namespace = obj.Namespace
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, config_map, func() error {
+		if config_map.Labels == nil {
+			config_map.Labels = make(map[string]string)
+		}
+		for key, value := range r.routingLabels(obj) {
+			config_map.Labels[key] = value
+		}
+		config_map.Data = map[string]string{proxy.ConfigKey: string(raw)}
+		return controllerutil.SetControllerReference(obj, config_map, r.Scheme)
+	})
+	if err != nil {
+		l.Error(err, "not able to write the routing table of the proxy", "configmap", config_map.Name)
+		return false, err
+	}
+
+	deployment := &appsv1.Deployment{}
+	deployment.Name = proxyName(obj)
+	deployment.Namespace = obj.Namespace
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, deployment, func() error {
+		r.setupProxyDeployment(obj, deployment, image)
+		return controllerutil.SetControllerReference(obj, deployment, r.Scheme)
+	})
+	if err != nil {
+		l.Error(err, "not able to write the proxy deployment", "deployment", deployment.Name)
+		return false, err
+	}
+	if op != controllerutil.OperationResultNone {
+		l.Info("proxy deployment written", "deployment", deployment.Name, "operation", op)
+	}
+
+	obj.Status.Proxy = &newprojv1.ProxyStatus{
+		Deployment:    deployment.Name,
+		ConfigMap:     config_map.Name,
+		Listeners:     int32(len(config.Listeners)),
+		ReadyReplicas: deployment.Status.ReadyReplicas,
+	}
+	status, reason := metav1.ConditionTrue, reasonProxyAvailable
+	messages := []string{fmt.Sprintf("%d of %d proxy replicas ready", deployment.Status.ReadyReplicas, *deployment.Spec.Replicas)}
+	if deployment.Status.ReadyReplicas == 0 {
+		status, reason = metav1.ConditionFalse, reasonProxyPending
+		messages = []string{"waiting for a replica of the proxy to become ready"}
+	}
+	setCondition(obj, newprojv1.ConditionProxyReady, status, reason, strings.Join(append(messages, skipped...), "; "))
+	return !reflect.DeepEqual(before.Proxy, obj.Status.Proxy) || !reflect.DeepEqual(before.Conditions, obj.Status.Conditions), nil
+}
+
+// setupProxyDeployment sets the fields of the proxy Deployment the controller owns. The rest, including what
+// the API server defaults, is left alone, so that an unchanged Deployment is not written again. The listeners
+// are not part of the pod template: they change with the routing table, which the proxy reloads without a rollout.
+func (r *SvcMergerObjReconciler) setupProxyDeployment(obj *newprojv1.SvcMergerObj, deployment *appsv1.Deployment, image string) {
+	pod_labels := r.proxyPodLabels(obj)
+	if deployment.Labels == nil {
+		deployment.Labels = make(map[string]string)
+	}
+	for key, value := range r.routingLabels(obj) {
+		deployment.Labels[key] = value
+	}
+	replicas := int32(1)
+	if obj.Spec.Proxy != nil && obj.Spec.Proxy.Replicas != nil {
+		replicas = *obj.Spec.Proxy.Replicas
+	}
+	deployment.Spec.Replicas = &replicas
+	// the selector can't be changed once the Deployment exists
+	if deployment.Spec.Selector == nil {
+		deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: pod_labels}
+	}
+
+	template := &deployment.Spec.Template
+	if template.Labels == nil {
+		template.Labels = make(map[string]string)
+	}
+	for key, value := range pod_labels {
+		template.Labels[key] = value
+	}
+
+	var container *corev1.Container
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name == proxyContainerName {
+			container = &template.Spec.Containers[i]
+		}
+	}
+	if container == nil {
+		template.Spec.Containers = append(template.Spec.Containers, corev1.Container{Name: proxyContainerName})
+		container = &template.Spec.Containers[len(template.Spec.Containers)-1]
+	}
+	container.Image = image
+	container.Command = []string{"/svcmerger-proxy"}
+	container.Args = []string{
+		"--config=" + path.Join(proxyConfigDir, proxy.ConfigKey),
+		fmt.Sprintf("--health-probe-bind-address=:%d", proxyProbePort),
+	}
+	container.Ports = []corev1.ContainerPort{{Name: "probes", ContainerPort: proxyProbePort, Protocol: corev1.ProtocolTCP}}
+	container.ReadinessProbe = proxyProbe("/readyz", 5)
+	container.LivenessProbe = proxyProbe("/healthz", 10)
+	container.VolumeMounts = []corev1.VolumeMount{{Name: proxyConfigVolume, MountPath: proxyConfigDir, ReadOnly: true}}
+
+	var volume *corev1.Volume
+	for i := range template.Spec.Volumes {
+		if template.Spec.Volumes[i].Name == proxyConfigVolume {
+			volume = &template.Spec.Volumes[i]
+		}
+	}
+	if volume == nil {
+		template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{Name: proxyConfigVolume})
+		volume = &template.Spec.Volumes[len(template.Spec.Volumes)-1]
+	}
+	mode := corev1.ConfigMapVolumeSourceDefaultMode
+	volume.VolumeSource = corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+		LocalObjectReference: corev1.LocalObjectReference{Name: proxyName(obj)},
+		DefaultMode:          &mode,
+	}}
+}
+
+// proxyProbe builds a probe of the proxy, with the defaults of the API server spelled out
+func proxyProbe(probe_path string, period int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+			Path:   probe_path,
+			Port:   intstr.FromInt(proxyProbePort),
+			Scheme: corev1.URISchemeHTTP,
+		}},
+		TimeoutSeconds:   1,
+		PeriodSeconds:    period,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	}
+}
+
+// proxyReadyPods returns the pods behind the ready endpoints of the backend Services, or none while the proxy
+// has no ready replica: with the Proxy strategy the members are reached through both
+func (r *SvcMergerObjReconciler) proxyReadyPods(ctx context.Context, obj *newprojv1.SvcMergerObj) (map[string]bool, error) {
+	l := log.FromContext(ctx)
+	ready_pods := make(map[string]bool)
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: proxyName(obj), Namespace: obj.Namespace}, deployment)
+	if apierrors.IsNotFound(err) {
+		return ready_pods, nil
+	}
+	if err != nil {
+		l.Error(err, "not able to fetch the proxy deployment")
+		return nil, err
+	}
+	if deployment.Status.ReadyReplicas == 0 {
+		return ready_pods, nil
+	}
+	backends, err := r.listBackends(ctx, obj)
+	if err != nil {
+		l.Error(err, "not able to list backend services")
+		return nil, err
+	}
+	for i := range backends.Items {
+		pods, err := r.readyEndpointPods(ctx, &backends.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		for pod := range pods {
+			ready_pods[pod] = true
+		}
+	}
+	return ready_pods, nil
+}
+
+// deleteProxy removes the proxy Deployment and its routing table. Both are looked up first, most SvcMergerObjs
+// never had a proxy.
+func (r *SvcMergerObjReconciler) deleteProxy(ctx context.Context, obj *newprojv1.SvcMergerObj) error {
+	l := log.FromContext(ctx)
+	for _, object := range []client.Object{&appsv1.Deployment{}, &corev1.ConfigMap{}} {
+		err := r.Get(ctx, types.NamespacedName{Name: proxyName(obj), Namespace: obj.Namespace}, object)
+		if apierrors.IsNotFound(err) || (err == nil && !metav1.IsControlledBy(object, obj)) {
+			continue
+		}
+		if err == nil {
+			err = r.Delete(ctx, object)
+		}
+		if client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to delete the proxy", "name", proxyName(obj))
+			return err
+		}
+	}
+	return nil
+}
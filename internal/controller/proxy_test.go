@@ -0,0 +1,64 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+func TestProxyRoundTrip(t *testing.T) {
+	roundTrip(t, newprojv1.StrategyProxy, func(c *testCluster, obj *newprojv1.SvcMergerObj) {
+		// the proxy replicas becoming ready are seen by the reconcile that follows the status change of its Deployment
+		obj = c.reconcileUntil(obj.Name, func(obj *newprojv1.SvcMergerObj) bool {
+			return meta.IsStatusConditionTrue(obj.Status.Conditions, newprojv1.ConditionProxyReady)
+		})
+		deployment := &appsv1.Deployment{}
+		if !c.get(proxyName(obj), deployment) {
+			t.Fatal("the proxy was not deployed")
+		}
+		if image := deployment.Spec.Template.Spec.Containers[0].Image; image != c.r.ProxyImage {
+			t.Errorf("proxy image = %s, want %s", image, c.r.ProxyImage)
+		}
+		merged_svc := &corev1.Service{}
+		c.get(obj.MergedServiceName(), merged_svc)
+		if !labels.SelectorFromSet(merged_svc.Spec.Selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			t.Errorf("the merged service selector %v doesn't pick the proxy pods (%v)", merged_svc.Spec.Selector, deployment.Spec.Template.Labels)
+		}
+		if !merged(obj) {
+			t.Errorf("phase = %s, want the merge to stay %s", obj.Status.Phase, newprojv1.PhaseMerged)
+		}
+		if obj.Status.Proxy == nil || obj.Status.Proxy.Listeners != 2 {
+			t.Errorf("proxy status = %+v, want a listener for each merged port", obj.Status.Proxy)
+		}
+		// the proxy reaches the members through backend Services selecting their pods
+		for _, svc := range []string{"web-1", "web-2"} {
+			backend := &corev1.Service{}
+			if !c.get(backendServiceName(obj, svc), backend) {
+				t.Errorf("no backend service for %s", svc)
+			} else if !labels.Equals(backend.Spec.Selector, labels.Set{"app": svc}) {
+				t.Errorf("backend service selector of %s = %v, want the selector of the member", svc, backend.Spec.Selector)
+			}
+		}
+	})
+}
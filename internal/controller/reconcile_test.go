@@ -0,0 +1,500 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// testCluster runs the reconciler against a fake client; settle plays the part of the controllers of the
+// cluster between two reconciles
+type testCluster struct {
+	t        *testing.T
+	client   client.Client
+	r        *SvcMergerObjReconciler
+	recorder *record.FakeRecorder
+
+	// fail is asked before every write of the reconciler (create, update, patch, delete or status), a
+	// returned error fails the write. The test itself and settle write around it.
+	fail func(verb string, obj client.Object) error
+}
+
+func newTestCluster(t *testing.T, objs ...client.Object) *testCluster {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := newprojv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(1000)
+	r := &SvcMergerObjReconciler{
+		Scheme:        scheme,
+		Recorder:      recorder,
+		Keys:          NewKeys(DefaultKeyDomain),
+		ClusterDomain: DefaultClusterDomain,
+		ProxyImage:    "svcmerger-proxy:test",
+	}
+	builder := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).
+		WithStatusSubresource(&newprojv1.SvcMergerObj{}).
+		WithIndex(&newprojv1.SvcMergerObj{}, servicesIndexKey, indexServices).
+		WithIndex(&newprojv1.SvcMergerObj{}, memberSelectorsIndexKey, indexMemberSelectors)
+	for _, kind := range workloadKinds() {
+		resolver := workloadResolvers[kind]
+		builder = builder.WithIndex(resolver.newObject(), mergedWorkloadsIndexKey, r.indexMergedWorkloads(resolver))
+	}
+	c := &testCluster{t: t, client: builder.Build(), r: r, recorder: recorder}
+	r.Client = interceptor.NewClient(c.client.(client.WithWatch), interceptor.Funcs{
+		Create: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if err := c.intercept("create", obj); err != nil {
+				return err
+			}
+			return cl.Create(ctx, obj, opts...)
+		},
+		Update: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if err := c.intercept("update", obj); err != nil {
+				return err
+			}
+			return cl.Update(ctx, obj, opts...)
+		},
+		Patch: func(ctx context.Context, cl client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if err := c.intercept("patch", obj); err != nil {
+				return err
+			}
+			return cl.Patch(ctx, obj, patch, opts...)
+		},
+		Delete: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+			if err := c.intercept("delete", obj); err != nil {
+				return err
+			}
+			return cl.Delete(ctx, obj, opts...)
+		},
+		SubResourceUpdate: func(ctx context.Context, cl client.Client, sub_resource string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+			if err := c.intercept(sub_resource, obj); err != nil {
+				return err
+			}
+			return cl.SubResource(sub_resource).Update(ctx, obj, opts...)
+		},
+	})
+	return c
+}
+
+// intercept asks the fail hook about a write of the reconciler
+func (c *testCluster) intercept(verb string, obj client.Object) error {
+	if c.fail == nil {
+		return nil
+	}
+	return c.fail(verb, obj)
+}
+
+// restart replaces the reconciler by a new one, as after a restart of the controller: whatever the old one
+// was in the middle of is lost, only what it wrote to the cluster is left
+func (c *testCluster) restart() {
+	r := &SvcMergerObjReconciler{
+		Client:        c.r.Client,
+		Scheme:        c.r.Scheme,
+		Recorder:      c.recorder,
+		Keys:          c.r.Keys,
+		ClusterDomain: c.r.ClusterDomain,
+		ProxyImage:    c.r.ProxyImage,
+	}
+	c.r = r
+}
+
+// testMerger builds a SvcMergerObj of the given members and strategy
+func testMerger(name string, strategy newprojv1.MergeStrategy, services ...string) *newprojv1.SvcMergerObj {
+	obj := &newprojv1.SvcMergerObj{}
+	obj.Name = name
+	obj.Namespace = "default"
+	obj.Generation = 1
+	obj.Spec.Services = services
+	obj.Spec.Strategy = strategy
+	return obj
+}
+
+// testMember builds a member Service with one port and a Deployment of ready pods behind it
+func testMember(svc string, port int32, replicas int) []client.Object {
+	service := testService(svc, testPort("http", port, corev1.ProtocolTCP, intstr.FromInt(8080)))
+	service.Namespace = "default"
+
+	deployment := &appsv1.Deployment{}
+	deployment.Name = svc
+	deployment.Namespace = "default"
+	deployment.UID = types.UID(svc + "-deployment")
+	deployment.Generation = 1
+	deployment.Spec.Replicas = &[]int32{int32(replicas)}[0]
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": svc}}
+	deployment.Spec.Template.Labels = map[string]string{"app": svc, "tier": "web"}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "web",
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: int32(replicas),
+		UpdatedReplicas: int32(replicas), AvailableReplicas: int32(replicas)}
+
+	replica_set := &appsv1.ReplicaSet{}
+	replica_set.Name = svc + "-rs"
+	replica_set.Namespace = "default"
+	replica_set.UID = types.UID(svc + "-rs")
+	replica_set.Spec.Selector = deployment.Spec.Selector
+	replica_set.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))}
+
+	objs := []client.Object{service, deployment, replica_set}
+	for i := 0; i < replicas; i++ {
+		pod := testPod(fmt.Sprintf("%s-%d", svc, i), svc, fmt.Sprintf("10.0.%d.%d", port%256, i+1))
+		pod.Labels = map[string]string{"app": svc, "tier": "web"}
+		pod.Spec.Containers = deployment.Spec.Template.Spec.Containers
+		pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(replica_set, appsv1.SchemeGroupVersion.WithKind("ReplicaSet"))}
+		objs = append(objs, pod)
+	}
+	return objs
+}
+
+// get fetches the object of the given name, false if it is gone
+func (c *testCluster) get(name string, obj client.Object) bool {
+	c.t.Helper()
+	err := c.client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, obj)
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		c.t.Fatalf("not able to get %s: %v", name, err)
+	}
+	return true
+}
+
+// merger fetches the SvcMergerObj, nil once it is gone
+func (c *testCluster) merger(name string) *newprojv1.SvcMergerObj {
+	c.t.Helper()
+	obj := &newprojv1.SvcMergerObj{}
+	if !c.get(name, obj) {
+		return nil
+	}
+	return obj
+}
+
+// reconcileUntil reconciles the SvcMergerObj, letting the cluster settle in between, until done holds
+func (c *testCluster) reconcileUntil(name string, done func(obj *newprojv1.SvcMergerObj) bool) *newprojv1.SvcMergerObj {
+	c.t.Helper()
+	var last_err error
+	for i := 0; i < 30; i++ {
+		_, last_err = c.r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "default"}})
+		c.settle()
+		if obj := c.merger(name); done(obj) {
+			return obj
+		}
+	}
+	obj := c.merger(name)
+	if obj != nil {
+		c.t.Fatalf("reconciling %s did not get there, last error %v, status %+v", name, last_err, obj.Status)
+	}
+	c.t.Fatalf("reconciling %s did not get there, last error %v", name, last_err)
+	return nil
+}
+
+// settle does what the controllers of the cluster would do: Deployments roll out their pod template onto
+// their pods and have all their replicas ready, the Services with a selector get an EndpointSlice of the ready pods they select, and what is
+// left of an owner that is gone is collected
+func (c *testCluster) settle() {
+	c.t.Helper()
+	ctx := context.Background()
+	c.collectGarbage()
+	deployments := &appsv1.DeploymentList{}
+	if err := c.client.List(ctx, deployments); err != nil {
+		c.t.Fatal(err)
+	}
+	pods := &corev1.PodList{}
+	if err := c.client.List(ctx, pods); err != nil {
+		c.t.Fatal(err)
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		for j := range pods.Items {
+			pod := &pods.Items[j]
+			if owner := metav1.GetControllerOf(pod); owner == nil || owner.Name != deployment.Name+"-rs" {
+				continue
+			}
+			if !labels.Equals(pod.Labels, deployment.Spec.Template.Labels) {
+				pod.Labels = deployment.Spec.Template.Labels
+				if err := c.client.Update(ctx, pod); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+		}
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		if deployment.Status.ObservedGeneration != deployment.Generation || deployment.Status.ReadyReplicas != replicas {
+			deployment.Status.ObservedGeneration = deployment.Generation
+			deployment.Status.Replicas = replicas
+			deployment.Status.UpdatedReplicas = replicas
+			deployment.Status.ReadyReplicas = replicas
+			deployment.Status.AvailableReplicas = replicas
+			if err := c.client.Update(ctx, deployment); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+	}
+
+	services := &corev1.ServiceList{}
+	if err := c.client.List(ctx, services); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.client.List(ctx, pods); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.client.DeleteAllOf(ctx, &discoveryv1.EndpointSlice{}, client.InNamespace("default"),
+		client.MatchingLabels{discoveryv1.LabelManagedBy: "endpointslice-controller.k8s.io"}); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, service := range services.Items {
+		if len(service.Spec.Selector) == 0 {
+			continue
+		}
+		slice := &discoveryv1.EndpointSlice{}
+		slice.Name = service.Name + "-k8s"
+		slice.Namespace = "default"
+		slice.Labels = map[string]string{discoveryv1.LabelServiceName: service.Name, discoveryv1.LabelManagedBy: "endpointslice-controller.k8s.io"}
+		slice.AddressType = discoveryv1.AddressTypeIPv4
+		for _, pod := range pods.Items {
+			if labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) && podReady(&pod) {
+				slice.Endpoints = append(slice.Endpoints, podEndpoint(&pod))
+			}
+		}
+		if err := c.client.Create(ctx, slice); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// collectGarbage deletes the objects whose controller is gone, like the garbage collector of the cluster. Owners
+// are looked up by kind and name, the fake client leaves the UIDs empty.
+func (c *testCluster) collectGarbage() {
+	c.t.Helper()
+	owners := map[string]func() client.Object{
+		"Service":      func() client.Object { return &corev1.Service{} },
+		"Deployment":   func() client.Object { return &appsv1.Deployment{} },
+		"ReplicaSet":   func() client.Object { return &appsv1.ReplicaSet{} },
+		"SvcMergerObj": func() client.Object { return &newprojv1.SvcMergerObj{} },
+	}
+	lists := []client.ObjectList{&discoveryv1.EndpointSliceList{}, &corev1.ConfigMapList{}, &corev1.ServiceList{}, &appsv1.DeploymentList{}}
+	for _, list := range lists {
+		if err := c.client.List(context.Background(), list); err != nil {
+			c.t.Fatal(err)
+		}
+		objects, err := meta.ExtractList(list)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		for _, object := range objects {
+			object := object.(client.Object)
+			owner := metav1.GetControllerOf(object)
+			if owner == nil || owners[owner.Kind] == nil || c.get(owner.Name, owners[owner.Kind]()) {
+				continue
+			}
+			if err := c.client.Delete(context.Background(), object); client.IgnoreNotFound(err) != nil {
+				c.t.Fatal(err)
+			}
+		}
+	}
+}
+
+// events returns the events recorded so far
+func (c *testCluster) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-c.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func merged(obj *newprojv1.SvcMergerObj) bool {
+	return obj != nil && obj.Status.Phase == newprojv1.PhaseMerged && obj.Status.ObservedGeneration == obj.Generation
+}
+
+// roundTrip merges web-1 and web-2 with the given strategy and hands the merged SvcMergerObj to check. It then
+// deletes the SvcMergerObj and checks that the members are back as they were before the merge.
+func roundTrip(t *testing.T, strategy newprojv1.MergeStrategy, check func(c *testCluster, obj *newprojv1.SvcMergerObj)) {
+	objs := []client.Object{testMerger("merger", strategy, "web-1", "web-2")}
+	objs = append(objs, testMember("web-1", 80, 2)...)
+	objs = append(objs, testMember("web-2", 81, 2)...)
+	c := newTestCluster(t, objs...)
+	c.settle()
+	before := make(map[string]client.Object)
+	for _, object := range objs[1:] {
+		before[fmt.Sprintf("%T %s", object, object.GetName())] = object
+	}
+
+	obj := c.reconcileUntil("merger", merged)
+	merged_svc := &corev1.Service{}
+	if !c.get(obj.MergedServiceName(), merged_svc) || len(merged_svc.Spec.Ports) != 2 {
+		t.Errorf("merged service ports = %v, want the ports of both members", merged_svc.Spec.Ports)
+	}
+	for _, svc := range []string{"web-1", "web-2"} {
+		if member := memberStatus(obj, svc); member == nil || member.State != newprojv1.MemberMerged {
+			t.Errorf("member %s = %+v, want it merged", svc, member)
+		}
+		if c.get(svc, &corev1.Service{}) {
+			t.Errorf("service %s was not cut over", svc)
+		}
+	}
+	check(c, obj)
+
+	if err := c.client.Delete(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+	c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool { return obj == nil })
+	if c.get(merged_svc.Name, &corev1.Service{}) {
+		t.Error("the merged service is left behind")
+	}
+	if ports := endpointsByPort(c, merged_svc.Name); len(ports) > 0 {
+		t.Errorf("EndpointSlices of the merged service are left behind: %v", ports)
+	}
+	for _, object := range before {
+		switch original := object.(type) {
+		case *corev1.Service:
+			service := &corev1.Service{}
+			if !c.get(original.Name, service) {
+				t.Errorf("service %s was not restored", original.Name)
+			} else if !labels.Equals(service.Spec.Selector, original.Spec.Selector) || !portsEqual(service.Spec.Ports, original.Spec.Ports) {
+				t.Errorf("service %s was restored as %+v, want %+v", original.Name, service.Spec, original.Spec)
+			}
+		case *appsv1.Deployment:
+			deployment := &appsv1.Deployment{}
+			c.get(original.Name, deployment)
+			if !labels.Equals(deployment.Spec.Template.Labels, original.Spec.Template.Labels) {
+				t.Errorf("pod template labels of %s = %v, want %v back", original.Name, deployment.Spec.Template.Labels, original.Spec.Template.Labels)
+			}
+		case *corev1.Pod:
+			pod := &corev1.Pod{}
+			c.get(original.Name, pod)
+			if !labels.Equals(pod.Labels, original.Labels) {
+				t.Errorf("labels of pod %s = %v, want %v back", original.Name, pod.Labels, original.Labels)
+			}
+		}
+	}
+}
+
+func TestLabelsRoundTrip(t *testing.T) {
+	roundTrip(t, newprojv1.StrategyLabels, func(c *testCluster, obj *newprojv1.SvcMergerObj) {
+		merged_svc := &corev1.Service{}
+		c.get(obj.MergedServiceName(), merged_svc)
+		for _, svc := range []string{"web-1", "web-2"} {
+			deployment := &appsv1.Deployment{}
+			c.get(svc, deployment)
+			if !labels.SelectorFromSet(merged_svc.Spec.Selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+				t.Errorf("the merged service selector %v doesn't pick the pod template of %s (%v)",
+					merged_svc.Spec.Selector, svc, deployment.Spec.Template.Labels)
+			}
+		}
+	})
+}
+
+func TestDemergeWithoutSnapshot(t *testing.T) {
+	objs := []client.Object{testMerger("merger", newprojv1.StrategyLabels, "web-1", "web-2")}
+	objs = append(objs, testMember("web-1", 80, 1)...)
+	objs = append(objs, testMember("web-2", 81, 1)...)
+	c := newTestCluster(t, objs...)
+	c.reconcileUntil("merger", merged)
+
+	// a merge made before snapshots were taken has none for its members
+	snapshots := &corev1.ConfigMap{}
+	if !c.get(snapshotConfigMapName(c.merger("merger")), snapshots) {
+		t.Fatal("no snapshots were taken")
+	}
+	delete(snapshots.Data, "web-2")
+	if err := c.client.Update(context.Background(), snapshots); err != nil {
+		t.Fatal(err)
+	}
+	c.events()
+	obj := c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool {
+		return meta.IsStatusConditionTrue(obj.Status.Conditions, newprojv1.ConditionSnapshotMissing)
+	})
+	if cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionSnapshotMissing); cond.Reason != reasonSnapshotMissing {
+		t.Errorf("condition reason = %s, want %s", cond.Reason, reasonSnapshotMissing)
+	}
+	merged_svc := &corev1.Service{}
+	if !c.get(obj.MergedServiceName(), merged_svc) || len(merged_svc.Spec.Ports) != 1 || merged_svc.Spec.Ports[0].Port != 80 {
+		t.Errorf("merged service ports = %v, want the port of web-1 only", merged_svc.Spec.Ports)
+	}
+
+	// the member without a snapshot is demerged without being created again
+	obj.Spec.Services = []string{"web-1"}
+	obj.Generation++
+	if err := c.client.Update(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+	obj = c.reconcileUntil("merger", merged)
+	if cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionSnapshotMissing); cond == nil ||
+		cond.Status != metav1.ConditionTrue || cond.Reason != reasonNotRestored || !strings.Contains(cond.Message, "web-2") {
+		t.Errorf("condition = %+v, want it to tell that web-2 was not restored", cond)
+	}
+	if c.get("web-2", &corev1.Service{}) {
+		t.Error("service web-2 was created again without a snapshot")
+	}
+	pod := &corev1.Pod{}
+	if c.get("web-2-0", pod); pod.Labels[c.r.Keys.Group] != "" {
+		t.Errorf("pod web-2-0 still carries the merge labels: %v", pod.Labels)
+	}
+	if events := strings.Join(c.events(), "\n"); !strings.Contains(events, "Warning "+reasonSnapshotMissing) {
+		t.Errorf("no %s warning among the events:\n%s", reasonSnapshotMissing, events)
+	}
+
+	// deleting the SvcMergerObj doesn't hang on a member without a snapshot
+	if !c.get(snapshotConfigMapName(obj), snapshots) {
+		t.Fatal("the snapshots are gone")
+	}
+	snapshots.Data = nil
+	if err := c.client.Update(context.Background(), snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client.Delete(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+	c.reconcileUntil("merger", func(obj *newprojv1.SvcMergerObj) bool { return obj == nil })
+	if c.get("web-1", &corev1.Service{}) {
+		t.Error("service web-1 was created again without a snapshot")
+	}
+	if c.get(merged_svc.Name, &corev1.Service{}) {
+		t.Error("the merged service is left behind")
+	}
+}
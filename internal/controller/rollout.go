@@ -0,0 +1,367 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons used while a progressive merge is gated or held
+const (
+	reasonGating        = "Gating"
+	reasonRolloutPaused = "RolloutPaused"
+	reasonGateFailed    = "GateFailed"
+)
+
+const (
+	// gatePollInterval is how often the health gate checks the members of a batch
+	gatePollInterval = 10 * time.Second
+
+	// defaultGateTimeout is how long the checks of the health gate may fail when spec.rollout.gate.timeout is not set
+	defaultGateTimeout = 5 * time.Minute
+
+	// gateProbeTimeout bounds every HTTP request of the health gate
+	gateProbeTimeout = 2 * time.Second
+
+	// gateProbeDeadline bounds the HTTP requests of one check of the health gate together
+	gateProbeDeadline = 5 * time.Second
+
+	// gateProbeParallelism is how many pods the health gate sends its HTTP request to at once
+	gateProbeParallelism = 8
+)
+
+// gateClient sends the HTTP requests of the health gate. Redirects are not followed, a 3xx passes as it is.
+var gateClient = &http.Client{
+	Timeout: gateProbeTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// progressive tells whether new members are brought in batch by batch
+func progressive(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Spec.Rollout != nil
+}
+
+// batchSize returns how many new members a batch of the rollout holds
+func batchSize(obj *newprojv1.SvcMergerObj) int {
+	if obj.Spec.Rollout.BatchSize < 1 {
+		return 1
+	}
+	return int(obj.Spec.Rollout.BatchSize)
+}
+
+// healthGate returns the health gate of the rollout, which waits for one ready endpoint per member when the
+// spec doesn't configure it
+func healthGate(obj *newprojv1.SvcMergerObj) newprojv1.HealthGate {
+	if obj.Spec.Rollout == nil || obj.Spec.Rollout.Gate == nil {
+		return newprojv1.HealthGate{MinReadyEndpoints: 1}
+	}
+	return *obj.Spec.Rollout.Gate
+}
+
+// gateTimeout returns how long the checks of the gate may fail before the gate fails
+func gateTimeout(gate newprojv1.HealthGate) time.Duration {
+	if gate.Timeout == nil {
+		return defaultGateTimeout
+	}
+	return gate.Timeout.Duration
+}
+
+// splitBatches cuts the new members into the batches of the rollout, keeping their order
+func splitBatches(members []string, size int) [][]string {
+	var batches [][]string
+	for len(members) > size {
+		batches = append(batches, members[:size])
+		members = members[size:]
+	}
+	return append(batches, members)
+}
+
+// heldBackMembers returns the members of the batches after the given one, which the merged Service leaves out
+// until their batch comes
+func heldBackMembers(obj *newprojv1.SvcMergerObj, batch int32) map[string]bool {
+	held := make(map[string]bool)
+	if op := obj.Status.Operation; op != nil {
+		for _, step := range op.Steps {
+			if step.Batch > batch && step.Service != "" {
+				held[step.Service] = true
+			}
+		}
+	}
+	return held
+}
+
+// admittedServices returns the members the merged Service serves while the given batch is brought in
+func admittedServices(obj *newprojv1.SvcMergerObj, services []string, batch int32) []string {
+	held := heldBackMembers(obj, batch)
+	if len(held) == 0 {
+		return services
+	}
+	var admitted []string
+	for _, svc := range services {
+		if !held[svc] {
+			admitted = append(admitted, svc)
+		}
+	}
+	return admitted
+}
+
+// startBatch records that the given batch is being brought in
+func startBatch(obj *newprojv1.SvcMergerObj, batch int32) {
+	rollout := obj.Status.Rollout
+	rollout.Batch = batch
+	rollout.State = newprojv1.RolloutProgressing
+	rollout.GateStartedAt = nil
+	rollout.RestartBaseline = nil
+	rollout.Message = ""
+}
+
+// pauseRollout holds the rollout, it carries on once the spec changes
+func pauseRollout(obj *newprojv1.SvcMergerObj, message string) {
+	obj.Status.Rollout.State = newprojv1.RolloutPaused
+	obj.Status.Rollout.Message = message
+}
+
+// rolloutPaused tells whether the rollout is held
+func rolloutPaused(obj *newprojv1.SvcMergerObj) bool {
+	return obj.Status.Rollout != nil && obj.Status.Rollout.State == newprojv1.RolloutPaused
+}
+
+// setRolloutProgress counts the members of the operation that passed their health gate
+func setRolloutProgress(obj *newprojv1.SvcMergerObj) {
+	rollout, op := obj.Status.Rollout, obj.Status.Operation
+	if rollout == nil || op == nil {
+		return
+	}
+	rollout.Passed = 0
+	for _, step := range op.Steps {
+		if step.Action == newprojv1.StepGate && step.State == newprojv1.StepDone {
+			rollout.Passed++
+		}
+	}
+}
+
+// completeRollout records that every batch passed its gate
+func completeRollout(obj *newprojv1.SvcMergerObj) {
+	rollout := obj.Status.Rollout
+	if rollout == nil {
+		return
+	}
+	setRolloutProgress(obj)
+	rollout.State = newprojv1.RolloutCompleted
+	rollout.GateStartedAt = nil
+	rollout.RestartBaseline = nil
+	rollout.Message = ""
+}
+
+// podRestarts sums up the container restarts of the pods
+func podRestarts(pods []corev1.Pod) int32 {
+	restarts := int32(0)
+	for _, pod := range pods {
+		for _, container := range pod.Status.ContainerStatuses {
+			restarts += container.RestartCount
+		}
+	}
+	return restarts
+}
+
+// gateMember runs the health gate of the rollout on a member of the current batch. The restarts of its pods
+// are counted from the first check on; the other checks may fail until the gate times out. Once the gate
+// fails, the rollout is paused. While the member has to wait, the time until the next check is returned.
+func (r *SvcMergerObjReconciler) gateMember(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun, svc string) (time.Duration, error) {
+	rollout := obj.Status.Rollout
+	if rollout == nil {
+		return 0, fmt.Errorf("no rollout is recorded for the health gate of service %s", svc)
+	}
+	if rollout.State == newprojv1.RolloutPaused {
+		return gatePollInterval, nil
+	}
+	gate := healthGate(obj)
+	pods, err := r.getMemberPods(ctx, obj, svc, run.memberSpecs[svc])
+	if err != nil {
+		return 0, err
+	}
+
+	restarts := podRestarts(pods)
+	if rollout.GateStartedAt == nil {
+		now := metav1.Now()
+		rollout.GateStartedAt = &now
+		rollout.State = newprojv1.RolloutGating
+	}
+	if rollout.RestartBaseline == nil {
+		rollout.RestartBaseline = make(map[string]int32)
+	}
+	baseline, ok := rollout.RestartBaseline[svc]
+	if !ok {
+		baseline = restarts
+		rollout.RestartBaseline[svc] = restarts
+	}
+	if gate.MaxRestarts != nil && restarts-baseline > *gate.MaxRestarts {
+		return r.failGate(ctx, obj, svc, fmt.Sprintf("its pods restarted %d times, %d are allowed", restarts-baseline, *gate.MaxRestarts))
+	}
+
+	problem, err := r.gateProblem(ctx, obj, run, svc, gate, pods)
+	if err != nil {
+		return 0, err
+	}
+	member := memberStatus(obj, svc)
+	elapsed := time.Since(rollout.GateStartedAt.Time)
+	if problem != "" {
+		if elapsed >= gateTimeout(gate) {
+			return r.failGate(ctx, obj, svc, problem)
+		}
+		member.Message = "health gate: " + problem
+		return gatePollInterval, nil
+	}
+	if gate.StableFor != nil {
+		if remaining := gate.StableFor.Duration - elapsed; remaining > 0 {
+			member.Message = fmt.Sprintf("health gate: healthy, watched for another %s", remaining.Round(time.Second))
+			if remaining < gatePollInterval {
+				return remaining, nil
+			}
+			return gatePollInterval, nil
+		}
+	}
+	member.Message = ""
+	return 0, nil
+}
+
+// gateProblem runs the checks of the health gate that may fail for a while: the ready endpoints of the member
+// in the merged Service and the HTTP request to its pods. It describes the first check that fails, if any.
+func (r *SvcMergerObjReconciler) gateProblem(ctx context.Context, obj *newprojv1.SvcMergerObj, run *mergeRun, svc string, gate newprojv1.HealthGate, pods []corev1.Pod) (string, error) {
+	// a member weighted out of the traffic has no endpoints in the merged service
+	if gate.MinReadyEndpoints > 0 && !weightedOut(obj, svc) {
+		if err := r.loadReadyPods(ctx, obj, run); err != nil {
+			return "", err
+		}
+		ready := int32(0)
+		for _, pod := range pods {
+			if run.readyPods[pod.Name] {
+				ready++
+			}
+		}
+		if ready < gate.MinReadyEndpoints {
+			return fmt.Sprintf("%d of %d ready endpoints in the merged service", ready, gate.MinReadyEndpoints), nil
+		}
+	}
+
+	if gate.HTTPGet == nil {
+		return "", nil
+	}
+	path := gate.HTTPGet.Path
+	if path == "" {
+		path = "/"
+	}
+	var probes []gateProbe
+	for i := range pods {
+		pod := &pods[i]
+		if !podReady(pod) || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		port, ok := resolveTargetPort(pod, gate.HTTPGet.Port, corev1.ProtocolTCP)
+		if !ok {
+			return fmt.Sprintf("pod %s has no port %s", pod.Name, gate.HTTPGet.Port.String()), nil
+		}
+		probes = append(probes, gateProbe{
+			pod:  pod.Name,
+			path: path,
+			url:  "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(port))) + path,
+		})
+	}
+	probe_ctx, cancel := context.WithTimeout(ctx, gateProbeDeadline)
+	defer cancel()
+	return runGateProbes(probe_ctx, probes), nil
+}
+
+// gateProbe is the HTTP request the health gate sends to a pod
+type gateProbe struct {
+	pod  string
+	path string
+	url  string
+}
+
+// runGateProbes sends the requests of the health gate, gateProbeParallelism at once, until the context is
+// done. It describes the failure of the first pod in order that failed, if any.
+func runGateProbes(ctx context.Context, probes []gateProbe) string {
+	problems := make([]string, len(probes))
+	slots := make(chan struct{}, gateProbeParallelism)
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				problems[i] = fmt.Sprintf("GET %s on pod %s not sent: %v", probes[i].path, probes[i].pod, ctx.Err())
+				return
+			}
+			problems[i] = probes[i].run(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, problem := range problems {
+		if problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// run sends the request and describes why it failed, if it did
+func (p gateProbe) run(ctx context.Context) string {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return fmt.Sprintf("GET %s on pod %s: %v", p.path, p.pod, err)
+	}
+	response, err := gateClient.Do(request)
+	if err != nil {
+		return fmt.Sprintf("GET %s on pod %s failed: %v", p.path, p.pod, err)
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Sprintf("GET %s on pod %s returned %d", p.path, p.pod, response.StatusCode)
+	}
+	return ""
+}
+
+// failGate pauses the rollout because a member of the batch failed the health gate
+func (r *SvcMergerObjReconciler) failGate(ctx context.Context, obj *newprojv1.SvcMergerObj, svc string, problem string) (time.Duration, error) {
+	l := log.FromContext(ctx)
+	l.Info("member failed the health gate, pausing the rollout", "service", svc, "problem", problem)
+	pauseRollout(obj, fmt.Sprintf("service %s failed the health gate: %s", svc, problem))
+	setMemberState(obj, svc, newprojv1.MemberPending, "health gate failed: "+problem)
+	if r.Recorder != nil {
+		r.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonGateFailed,
+			"service %s failed the health gate, the rollout is paused until the spec changes: %s", svc, problem)
+	}
+	return gatePollInterval, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+func TestSplitBatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+		size    int
+		want    [][]string
+	}{
+		{name: "one batch", members: []string{"web-1", "web-2"}, size: 5, want: [][]string{{"web-1", "web-2"}}},
+		{name: "even batches", members: []string{"web-1", "web-2", "web-3", "web-4"}, size: 2, want: [][]string{{"web-1", "web-2"}, {"web-3", "web-4"}}},
+		{name: "last batch is short", members: []string{"web-1", "web-2", "web-3"}, size: 2, want: [][]string{{"web-1", "web-2"}, {"web-3"}}},
+		{name: "one member per batch", members: []string{"web-2", "web-1"}, size: 1, want: [][]string{{"web-2"}, {"web-1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitBatches(test.members, test.size); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("splitBatches(%v, %d) = %v, want %v", test.members, test.size, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdmittedServices(t *testing.T) {
+	obj := &newprojv1.SvcMergerObj{}
+	obj.Status.Operation = &newprojv1.OperationStatus{Steps: []newprojv1.JournalStep{
+		{Action: newprojv1.StepGate, Service: "web-2", Batch: 1},
+		{Action: newprojv1.StepGate, Service: "web-3", Batch: 2},
+		{Action: newprojv1.StepGate, Service: "web-4", Batch: 3},
+		{Action: newprojv1.StepMergedService, Batch: 3},
+	}}
+	services := []string{"web-1", "web-2", "web-3", "web-4"}
+	tests := []struct {
+		batch int32
+		want  []string
+	}{
+		{batch: 1, want: []string{"web-1", "web-2"}},
+		{batch: 2, want: []string{"web-1", "web-2", "web-3"}},
+		{batch: 3, want: services},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.batch), func(t *testing.T) {
+			if got := admittedServices(obj, services, test.batch); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("admitted services of batch %d = %v, want %v", test.batch, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunGateProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/hang":
+			<-req.Context().Done()
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	probes := func(paths ...string) []gateProbe {
+		var probes []gateProbe
+		for i, path := range paths {
+			probes = append(probes, gateProbe{pod: fmt.Sprintf("pod-%d", i), path: path, url: server.URL + path})
+		}
+		return probes
+	}
+
+	tests := []struct {
+		name    string
+		probes  []gateProbe
+		problem string
+	}{
+		{name: "no pods"},
+		{name: "healthy", probes: probes("/", "/", "/")},
+		{name: "first failing pod in order is reported", probes: probes("/", "/slow", "/fail", "/fail"), problem: "GET /fail on pod pod-2 returned 503"},
+		{
+			// one after the other these would take 4s, far beyond the deadline
+			name:   "probes run at once",
+			probes: probes("/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow", "/slow"),
+		},
+		{name: "the deadline bounds hanging pods", probes: probes("/", "/hang", "/hang"), problem: "GET /hang on pod pod-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			start := time.Now()
+			problem := runGateProbes(ctx, test.probes)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("the probes took %s, past the deadline", elapsed)
+			}
+			if test.problem == "" && problem != "" {
+				t.Errorf("unexpected problem: %s", problem)
+			}
+			if test.problem != "" && !strings.HasPrefix(problem, test.problem) {
+				t.Errorf("problem = %q, want it to start with %q", problem, test.problem)
+			}
+		})
+	}
+}
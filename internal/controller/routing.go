@@ -0,0 +1,622 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons of the RouteAccepted condition
+const (
+	reasonRouteAccepted = "Accepted"
+	reasonRoutePending  = "Pending"
+	reasonRouteRefused  = "NotAccepted"
+	reasonBackendTaken  = "BackendTaken"
+)
+
+// routePollInterval is how often HTTPRoutes are checked until the Gateways accepted them. They are not
+// watched, as the Gateway API may not be installed.
+const routePollInterval = 30 * time.Second
+
+// httpRouteGVK is the Gateway API version the HTTPRoutes are written in. The Gateway API is not a dependency
+// of the controller, the routes are handled as unstructured objects.
+var httpRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1beta1", Kind: "HTTPRoute"}
+
+// routeTarget is the backend Service and port a rule sends its requests to
+type routeTarget struct {
+	rule    newprojv1.RouteRule
+	backend string
+	port    int32
+}
+
+// backendServiceName returns the name of the backend Service of a member
+func backendServiceName(obj *newprojv1.SvcMergerObj, svc string) string {
+	return boundedName(obj.Name + "-" + svc)
+}
+
+// boundedName makes a generated name fit into a DNS label: longer names are shortened and made unique with a hash
+func boundedName(name string) string {
+	if len(name) <= 63 {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%s-%08x", strings.TrimRight(name[:54], "-"), h.Sum32())
+}
+
+// routeName returns the name of the routing object for a host, the one for the default hostnames is named after the SvcMergerObj
+func routeName(obj *newprojv1.SvcMergerObj, host string) string {
+	if host == "" {
+		return obj.Name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return fmt.Sprintf("%s-%08x", obj.Name, h.Sum32())
+}
+
+// routingLabels are put on every object generated for spec.routing, so that stale ones can be found
+func (r *SvcMergerObjReconciler) routingLabels(obj *newprojv1.SvcMergerObj) map[string]string {
+	return map[string]string{r.Keys.MergedBy: obj.Name}
+}
+
+// backendFor builds the backend Service of a member: the selector and ports of the member Service, so that
+// it reaches the pods of this member only, whatever the merge did to their labels
+func (r *SvcMergerObjReconciler) backendFor(obj *newprojv1.SvcMergerObj, spec *corev1.Service) *corev1.Service {
+	backend := &corev1.Service{}
+	backend.Name = backendServiceName(obj, spec.Name)
+	backend.Namespace = obj.Namespace
+	backend.Labels = r.routingLabels(obj)
+	backend.Labels[r.Keys.Member] = spec.Name
+	backend.Spec.Selector = spec.Spec.Selector
+	for _, port := range spec.Spec.Ports {
+		port.NodePort = 0
+		port.TargetPort = targetPortOf(&port)
+		backend.Spec.Ports = append(backend.Spec.Ports, port)
+	}
+	return backend
+}
+
+// routeTargets resolves the rules of spec.routing to backend Services. Rules whose member is not part of the
+// merge or has no selector to build a backend from are left out and returned as messages.
+func (r *SvcMergerObjReconciler) routeTargets(obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service) ([]routeTarget, map[string]*corev1.Service, []string) {
+	members := make(map[string]bool)
+	for _, svc := range services {
+		members[svc] = true
+	}
+	var targets []routeTarget
+	var skipped []string
+	backends := make(map[string]*corev1.Service)
+	for _, rule := range obj.Spec.Routing.Rules {
+		spec, ok := member_specs[rule.Service]
+		if !members[rule.Service] || !ok {
+			skipped = append(skipped, fmt.Sprintf("service %s of the rule for %s is not a member", rule.Service, rule.Path))
+			continue
+		}
+		if len(spec.Spec.Selector) == 0 || len(spec.Spec.Ports) == 0 {
+			skipped = append(skipped, fmt.Sprintf("service %s has no selector or no ports to build a backend from", rule.Service))
+			continue
+		}
+		port := &spec.Spec.Ports[0]
+		if rule.Port != nil {
+			if port, ok = newprojv1.FindServicePort(spec, *rule.Port); !ok {
+				skipped = append(skipped, fmt.Sprintf("service %s has no port %s", rule.Service, rule.Port.String()))
+				continue
+			}
+		}
+		backend := r.backendFor(obj, spec)
+		backends[backend.Name] = backend
+		if rule.Path == "" {
+			rule.Path = "/"
+		}
+		if rule.PathType == "" {
+			rule.PathType = newprojv1.PathPrefix
+		}
+		targets = append(targets, routeTarget{rule: rule, backend: backend.Name, port: port.Port})
+	}
+	return targets, backends, skipped
+}
+
+// syncRouting brings the objects generated for spec.routing in line with the spec and the members: a backend
+// Service per routed member (next to the ones of the proxy), and the Ingress or the HTTPRoutes. Objects that
+// are not needed anymore, e.g. after the kind changed, are deleted. The generated objects are owned by the
+// SvcMergerObj. It reports whether the routes in the status changed.
+func (r *SvcMergerObjReconciler) syncRouting(ctx context.Context, obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service) (bool, error) {
+	before := obj.Status.Routes
+	blocked, err := r.syncBackends(ctx, obj, r.backendsFor(obj, services, member_specs))
+	if err != nil {
+		return false, err
+	}
+	if obj.Spec.Routing == nil {
+		if err := r.deleteRouting(ctx, obj); err != nil {
+			return false, err
+		}
+		obj.Status.Routes = nil
+		meta.RemoveStatusCondition(&obj.Status.Conditions, newprojv1.ConditionRouteAccepted)
+		return len(before) > 0, nil
+	}
+
+	targets, _, skipped := r.routeTargets(obj, services, member_specs)
+	// rules whose backend name is taken by a Service of someone else are left out
+	var routed []routeTarget
+	for _, target := range targets {
+		if _, ok := blocked[target.rule.Service]; !ok {
+			routed = append(routed, target)
+		}
+	}
+	targets = routed
+	skipped = append(skipped, blockedMessages(blocked)...)
+
+	var routes []newprojv1.RouteStatus
+	switch obj.Spec.Routing.Kind {
+	case newprojv1.RoutingIngress:
+		if err := r.deleteHTTPRoutes(ctx, obj, nil); err != nil {
+			return false, err
+		}
+		routes, err = r.syncIngress(ctx, obj, targets)
+	case newprojv1.RoutingHTTPRoute:
+		if err := r.deleteIngresses(ctx, obj, nil); err != nil {
+			return false, err
+		}
+		routes, err = r.syncHTTPRoutes(ctx, obj, targets)
+	default:
+		err = fmt.Errorf("unknown routing kind %s", obj.Spec.Routing.Kind)
+	}
+	if err != nil {
+		return false, err
+	}
+	obj.Status.Routes = routes
+
+	status, reason, messages := metav1.ConditionTrue, reasonRouteAccepted, skipped
+	for _, route := range routes {
+		if route.Accepted == metav1.ConditionFalse {
+			status, reason = metav1.ConditionFalse, reasonRouteRefused
+		} else if route.Accepted == metav1.ConditionUnknown && status == metav1.ConditionTrue {
+			status, reason = metav1.ConditionUnknown, reasonRoutePending
+		}
+		if route.Message != "" {
+			messages = append(messages, fmt.Sprintf("%s %s: %s", route.Kind, route.Name, route.Message))
+		}
+	}
+	if len(blocked) > 0 {
+		status, reason = metav1.ConditionFalse, reasonBackendTaken
+	}
+	if len(routes) == 0 {
+		status, reason = metav1.ConditionFalse, reasonRouteRefused
+		messages = append(messages, "no rule resolves to a member, nothing is routed")
+	}
+	message := strings.Join(messages, "; ")
+	if message == "" {
+		message = fmt.Sprintf("%d %s accepted", len(routes), obj.Spec.Routing.Kind)
+	}
+	setCondition(obj, newprojv1.ConditionRouteAccepted, status, reason, message)
+	return !reflect.DeepEqual(before, routes), nil
+}
+
+// routeWaiting tells whether the HTTPRoutes still have to be accepted, which is polled for
+func routeWaiting(obj *newprojv1.SvcMergerObj) bool {
+	if obj.Spec.Routing == nil || obj.Spec.Routing.Kind != newprojv1.RoutingHTTPRoute {
+		return false
+	}
+	cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionRouteAccepted)
+	return cond != nil && cond.Status != metav1.ConditionTrue
+}
+
+// backendsFor returns the backend Services the SvcMergerObj needs: the ones of the routing rules and, with the
+// Proxy strategy, one for every member the proxy can reach
+func (r *SvcMergerObjReconciler) backendsFor(obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service) map[string]*corev1.Service {
+	backends := make(map[string]*corev1.Service)
+	if obj.Spec.Routing != nil {
+		_, backends, _ = r.routeTargets(obj, services, member_specs)
+	}
+	if useProxy(obj) {
+		for _, svc := range services {
+			if spec, ok := member_specs[svc]; ok && len(spec.Spec.Selector) > 0 && len(spec.Spec.Ports) > 0 {
+				backend := r.backendFor(obj, spec)
+				backends[backend.Name] = backend
+			}
+		}
+	}
+	return backends
+}
+
+// syncBackends creates and updates the backend Services and deletes the ones neither a rule nor the proxy needs
+// anymore. A Service of someone else that has the name of a backend is left alone; it returns the members whose
+// backend it blocks, with a message.
+func (r *SvcMergerObjReconciler) syncBackends(ctx context.Context, obj *newprojv1.SvcMergerObj, backends map[string]*corev1.Service) (map[string]string, error) {
+	l := log.FromContext(ctx)
+	existing, err := r.listBackends(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	for i := range existing.Items {
+		live := &existing.Items[i]
+		want, ok := backends[live.Name]
+		if !ok {
+			if err := r.Delete(ctx, live); client.IgnoreNotFound(err) != nil {
+				l.Error(err, "not able to delete backend service", "service", live.Name)
+				return nil, err
+			}
+			continue
+		}
+		delete(backends, live.Name)
+		if reflect.DeepEqual(live.Spec.Selector, want.Spec.Selector) && equality.Semantic.DeepEqual(live.Spec.Ports, want.Spec.Ports) {
+			continue
+		}
+		live.Spec.Selector = want.Spec.Selector
+		live.Spec.Ports = want.Spec.Ports
+		if err := r.Update(ctx, live); err != nil {
+			l.Error(err, "not able to update backend service", "service", live.Name)
+			return nil, err
+		}
+	}
+	blocked := make(map[string]string)
+	for _, backend := range backends {
+		err := r.Get(ctx, client.ObjectKeyFromObject(backend), &corev1.Service{})
+		if err == nil {
+			member := backend.Labels[r.Keys.Member]
+			blocked[member] = fmt.Sprintf("service %s exists already and is not the backend of service %s, rename it to route to the member", backend.Name, member)
+			continue
+		} else if !apierrors.IsNotFound(err) {
+			l.Error(err, "not able to fetch backend service", "service", backend.Name)
+			return nil, err
+		}
+		if err := controllerutil.SetControllerReference(obj, backend, r.Scheme); err != nil {
+			return nil, err
+		}
+		if err := r.Create(ctx, backend); err != nil {
+			l.Error(err, "not able to create backend service", "service", backend.Name)
+			return nil, err
+		}
+	}
+	return blocked, nil
+}
+
+// blockedMessages returns the messages of the blocked backends, ordered by member
+func blockedMessages(blocked map[string]string) []string {
+	var members []string
+	for svc := range blocked {
+		members = append(members, svc)
+	}
+	sort.Strings(members)
+	var messages []string
+	for _, svc := range members {
+		messages = append(messages, blocked[svc])
+	}
+	return messages
+}
+
+// listBackends lists the backend Services of the SvcMergerObj. They carry the member label, which tells them
+// apart from the merged Service.
+func (r *SvcMergerObjReconciler) listBackends(ctx context.Context, obj *newprojv1.SvcMergerObj) (*corev1.ServiceList, error) {
+	selector := labels.SelectorFromSet(r.routingLabels(obj))
+	has_member, err := labels.NewRequirement(r.Keys.Member, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	service_list := &corev1.ServiceList{}
+	err = r.List(ctx, service_list, client.InNamespace(obj.Namespace), client.MatchingLabelsSelector{Selector: selector.Add(*has_member)})
+	return service_list, err
+}
+
+// syncIngress writes the Ingress of the SvcMergerObj, with a rule per host
+func (r *SvcMergerObjReconciler) syncIngress(ctx context.Context, obj *newprojv1.SvcMergerObj, targets []routeTarget) ([]newprojv1.RouteStatus, error) {
+	l := log.FromContext(ctx)
+	if len(targets) == 0 {
+		return nil, r.deleteIngresses(ctx, obj, nil)
+	}
+
+	desired := &networkingv1.Ingress{}
+	desired.Spec.IngressClassName = obj.Spec.Routing.IngressClassName
+	var hosts []string
+	paths := make(map[string][]networkingv1.HTTPIngressPath)
+	for _, target := range targets {
+		rule_hosts := obj.Spec.Routing.Hostnames
+		if target.rule.Host != "" {
+			rule_hosts = []string{target.rule.Host}
+		} else if len(rule_hosts) == 0 {
+			rule_hosts = []string{""}
+		}
+		path_type := networkingv1.PathTypePrefix
+		if target.rule.PathType == newprojv1.PathExact {
+			path_type = networkingv1.PathTypeExact
+		}
+		for _, host := range rule_hosts {
+			if _, ok := paths[host]; !ok {
+				hosts = append(hosts, host)
+			}
+			paths[host] = append(paths[host], networkingv1.HTTPIngressPath{
+				Path:     target.rule.Path,
+				PathType: &path_type,
+				Backend: networkingv1.IngressBackend{
+					Service: &networkingv1.IngressServiceBackend{
+						Name: target.backend,
+						Port: networkingv1.ServiceBackendPort{Number: target.port},
+					},
+				},
+			})
+		}
+	}
+	for _, host := range hosts {
+		desired.Spec.Rules = append(desired.Spec.Rules, networkingv1.IngressRule{
+			Host:             host,
+			IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: paths[host]}},
+		})
+	}
+
+	ingress := &networkingv1.Ingress{}
+	ingress.Name = routeName(obj, "")
+	ingress.Namespace = obj.Namespace
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, ingress, func() error {
+		if ingress.Labels == nil {
+			ingress.Labels = make(map[string]string)
+		}
+		for key, value := range r.routingLabels(obj) {
+			ingress.Labels[key] = value
+		}
+		ingress.Spec = desired.Spec
+		return controllerutil.SetControllerReference(obj, ingress, r.Scheme)
+	})
+	if err != nil {
+		l.Error(err, "not able to write ingress", "ingress", ingress.Name)
+		return nil, err
+	}
+	if op != controllerutil.OperationResultNone {
+		l.Info("ingress written", "ingress", ingress.Name, "operation", op)
+	}
+	if err := r.deleteIngresses(ctx, obj, map[string]bool{ingress.Name: true}); err != nil {
+		return nil, err
+	}
+
+	route := newprojv1.RouteStatus{Kind: "Ingress", Name: ingress.Name, Accepted: metav1.ConditionUnknown,
+		Message: "waiting for the ingress controller to assign an address"}
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			route.Addresses = append(route.Addresses, lb.IP)
+		}
+		if lb.Hostname != "" {
+			route.Addresses = append(route.Addresses, lb.Hostname)
+		}
+	}
+	if len(route.Addresses) > 0 {
+		route.Accepted = metav1.ConditionTrue
+		route.Message = ""
+	}
+	return []newprojv1.RouteStatus{route}, nil
+}
+
+// deleteIngresses deletes the Ingresses generated for the SvcMergerObj, except the ones to keep
+func (r *SvcMergerObjReconciler) deleteIngresses(ctx context.Context, obj *newprojv1.SvcMergerObj, keep map[string]bool) error {
+	l := log.FromContext(ctx)
+	ingress_list := &networkingv1.IngressList{}
+	if err := r.List(ctx, ingress_list, client.InNamespace(obj.Namespace), client.MatchingLabels(r.routingLabels(obj))); err != nil {
+		l.Error(err, "not able to list ingresses")
+		return err
+	}
+	for i := range ingress_list.Items {
+		ingress := &ingress_list.Items[i]
+		if keep[ingress.Name] {
+			continue
+		}
+		if err := r.Delete(ctx, ingress); client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to delete ingress", "ingress", ingress.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// syncHTTPRoutes writes the HTTPRoutes of the SvcMergerObj. Hostnames apply to a whole HTTPRoute, so the rules
+// of every host get a route of their own, next to the one for the default hostnames. With spec.weights set,
+// the rules of a host that match the same path are joined into one rule whose backends carry the weights.
+func (r *SvcMergerObjReconciler) syncHTTPRoutes(ctx context.Context, obj *newprojv1.SvcMergerObj, targets []routeTarget) ([]newprojv1.RouteStatus, error) {
+	l := log.FromContext(ctx)
+	if len(obj.Spec.Routing.ParentRefs) == 0 {
+		return nil, fmt.Errorf("spec.routing.parentRefs is needed for the HTTPRoute kind")
+	}
+
+	var hosts []string
+	rules := make(map[string][]interface{})
+	weighted_rules := make(map[string]map[string]interface{}) // "<host> <path type> <path>" -> rule
+	for _, target := range targets {
+		path_type := "PathPrefix"
+		if target.rule.PathType == newprojv1.PathExact {
+			path_type = "Exact"
+		}
+		if _, ok := rules[target.rule.Host]; !ok {
+			hosts = append(hosts, target.rule.Host)
+		}
+		backend_ref := map[string]interface{}{"name": target.backend, "port": int64(target.port)}
+		if weighted(obj) {
+			backend_ref["weight"] = int64(memberWeight(obj, target.rule.Service))
+			key := fmt.Sprintf("%s %s %s", target.rule.Host, path_type, target.rule.Path)
+			if rule, ok := weighted_rules[key]; ok {
+				rule["backendRefs"] = append(rule["backendRefs"].([]interface{}), backend_ref)
+				continue
+			}
+		}
+		rule := map[string]interface{}{
+			"matches": []interface{}{
+				map[string]interface{}{"path": map[string]interface{}{"type": path_type, "value": target.rule.Path}},
+			},
+			"backendRefs": []interface{}{backend_ref},
+		}
+		if weighted(obj) {
+			weighted_rules[fmt.Sprintf("%s %s %s", target.rule.Host, path_type, target.rule.Path)] = rule
+		}
+		rules[target.rule.Host] = append(rules[target.rule.Host], rule)
+	}
+	var parent_refs []interface{}
+	for _, ref := range obj.Spec.Routing.ParentRefs {
+		parent_ref := map[string]interface{}{"name": ref.Name}
+		if ref.Namespace != "" {
+			parent_ref["namespace"] = ref.Namespace
+		}
+		if ref.SectionName != "" {
+			parent_ref["sectionName"] = ref.SectionName
+		}
+		parent_refs = append(parent_refs, parent_ref)
+	}
+
+	var statuses []newprojv1.RouteStatus
+	keep := make(map[string]bool)
+	for _, host := range hosts {
+		var hostnames []interface{}
+		if host != "" {
+			hostnames = []interface{}{host}
+		} else {
+			for _, hostname := range obj.Spec.Routing.Hostnames {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		spec := map[string]interface{}{
+			"parentRefs": parent_refs,
+			"rules":      rules[host],
+		}
+		if len(hostnames) > 0 {
+			spec["hostnames"] = hostnames
+		}
+
+		route := &unstructured.Unstructured{}
+		route.SetGroupVersionKind(httpRouteGVK)
+		route.SetName(routeName(obj, host))
+		route.SetNamespace(obj.Namespace)
+		keep[route.GetName()] = true
+		_, err := controllerutil.CreateOrUpdate(ctx, r.Client, route, func() error {
+			route_labels := route.GetLabels()
+			if route_labels == nil {
+				route_labels = make(map[string]string)
+			}
+			for key, value := range r.routingLabels(obj) {
+				route_labels[key] = value
+			}
+			route.SetLabels(route_labels)
+			if err := unstructured.SetNestedField(route.Object, spec, "spec"); err != nil {
+				return err
+			}
+			return controllerutil.SetControllerReference(obj, route, r.Scheme)
+		})
+		if meta.IsNoMatchError(err) {
+			return nil, fmt.Errorf("the Gateway API (HTTPRoute %s) is not installed in the cluster", httpRouteGVK.GroupVersion())
+		}
+		if err != nil {
+			l.Error(err, "not able to write httproute", "httproute", route.GetName())
+			return nil, err
+		}
+		statuses = append(statuses, httpRouteStatus(route, len(parent_refs)))
+	}
+	if err := r.deleteHTTPRoutes(ctx, obj, keep); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// httpRouteStatus reads the Accepted conditions the parent Gateways wrote on the current generation of an HTTPRoute
+func httpRouteStatus(route *unstructured.Unstructured, parents int) newprojv1.RouteStatus {
+	status := newprojv1.RouteStatus{Kind: httpRouteGVK.Kind, Name: route.GetName(), Accepted: metav1.ConditionUnknown,
+		Message: "waiting for the gateways to accept the route"}
+	generation := route.GetGeneration()
+	parent_statuses, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	accepted := 0
+	for _, raw := range parent_statuses {
+		parent, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		gateway, _, _ := unstructured.NestedString(parent, "parentRef", "name")
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		for _, raw_cond := range conditions {
+			cond, ok := raw_cond.(map[string]interface{})
+			if !ok || cond["type"] != "Accepted" {
+				continue
+			}
+			// a condition written for an earlier generation of the route says nothing about this one
+			if observed, ok := cond["observedGeneration"].(int64); ok && observed < generation {
+				continue
+			}
+			switch cond["status"] {
+			case string(metav1.ConditionTrue):
+				accepted++
+			case string(metav1.ConditionFalse):
+				status.Accepted = metav1.ConditionFalse
+				status.Message = fmt.Sprintf("gateway %s: %v: %v", gateway, cond["reason"], cond["message"])
+				return status
+			}
+		}
+	}
+	if accepted >= parents {
+		status.Accepted = metav1.ConditionTrue
+		status.Message = ""
+	}
+	return status
+}
+
+// deleteHTTPRoutes deletes the HTTPRoutes generated for the SvcMergerObj, except the ones to keep. Without
+// the Gateway API in the cluster there is nothing to delete.
+func (r *SvcMergerObjReconciler) deleteHTTPRoutes(ctx context.Context, obj *newprojv1.SvcMergerObj, keep map[string]bool) error {
+	l := log.FromContext(ctx)
+	route_list := &unstructured.UnstructuredList{}
+	route_list.SetGroupVersionKind(httpRouteGVK.GroupVersion().WithKind(httpRouteGVK.Kind + "List"))
+	err := r.List(ctx, route_list, client.InNamespace(obj.Namespace), client.MatchingLabels(r.routingLabels(obj)))
+	if meta.IsNoMatchError(err) {
+		return nil
+	}
+	if err != nil {
+		l.Error(err, "not able to list httproutes")
+		return err
+	}
+	for i := range route_list.Items {
+		route := &route_list.Items[i]
+		if keep[route.GetName()] {
+			continue
+		}
+		if err := r.Delete(ctx, route); client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to delete httproute", "httproute", route.GetName())
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRouting removes the routing objects generated for spec.routing, the backend Services are left to syncBackends
+func (r *SvcMergerObjReconciler) deleteRouting(ctx context.Context, obj *newprojv1.SvcMergerObj) error {
+	if err := r.deleteIngresses(ctx, obj, nil); err != nil {
+		return err
+	}
+	return r.deleteHTTPRoutes(ctx, obj, nil)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// testRoute builds an HTTPRoute of the given generation whose parents wrote the given Accepted conditions
+func testRoute(generation int64, conditions ...map[string]interface{}) *unstructured.Unstructured {
+	route := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	route.SetGroupVersionKind(httpRouteGVK)
+	route.SetName("merger")
+	route.SetGeneration(generation)
+	var parents []interface{}
+	for i, cond := range conditions {
+		cond["type"] = "Accepted"
+		parents = append(parents, map[string]interface{}{
+			"parentRef":  map[string]interface{}{"name": []string{"gw-1", "gw-2"}[i]},
+			"conditions": []interface{}{cond},
+		})
+	}
+	_ = unstructured.SetNestedSlice(route.Object, parents, "status", "parents")
+	return route
+}
+
+func TestHTTPRouteStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   *unstructured.Unstructured
+		parents int
+		want    metav1.ConditionStatus
+	}{
+		{
+			name:    "no status yet",
+			route:   testRoute(1),
+			parents: 1,
+			want:    metav1.ConditionUnknown,
+		},
+		{
+			name: "accepted by every parent",
+			route: testRoute(2,
+				map[string]interface{}{"status": "True", "observedGeneration": int64(2)},
+				map[string]interface{}{"status": "True"}),
+			parents: 2,
+			want:    metav1.ConditionTrue,
+		},
+		{
+			name: "accepted by one of two parents",
+			route: testRoute(1,
+				map[string]interface{}{"status": "True", "observedGeneration": int64(1)}),
+			parents: 2,
+			want:    metav1.ConditionUnknown,
+		},
+		{
+			name: "refused",
+			route: testRoute(1,
+				map[string]interface{}{"status": "False", "observedGeneration": int64(1), "reason": "NotAllowedByListeners"}),
+			parents: 1,
+			want:    metav1.ConditionFalse,
+		},
+		{
+			name: "acceptance of an earlier generation",
+			route: testRoute(3,
+				map[string]interface{}{"status": "True", "observedGeneration": int64(2)}),
+			parents: 1,
+			want:    metav1.ConditionUnknown,
+		},
+		{
+			name: "refusal of an earlier generation",
+			route: testRoute(3,
+				map[string]interface{}{"status": "False", "observedGeneration": int64(2)},
+				map[string]interface{}{"status": "True", "observedGeneration": int64(3)}),
+			parents: 1,
+			want:    metav1.ConditionTrue,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := httpRouteStatus(test.route, test.parents)
+			if status.Accepted != test.want {
+				t.Errorf("accepted = %s (%s), want %s", status.Accepted, status.Message, test.want)
+			}
+		})
+	}
+}
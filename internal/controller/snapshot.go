@@ -0,0 +1,186 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons used on the SnapshotMissing condition
+const (
+	reasonSnapshotMissing = "SnapshotMissing"
+	reasonNotRestored     = "NotRestored"
+	reasonSnapshotsKept   = "SnapshotsKept"
+)
+
+// snapshotConfigMapSuffix is appended to the SvcMergerObj name to get the name of the ConfigMap
+// holding the snapshots of the member Services. Every member is stored under its own key.
+const snapshotConfigMapSuffix = "-svc-snapshots"
+
+func snapshotConfigMapName(obj *newprojv1.SvcMergerObj) string {
+	return obj.Name + snapshotConfigMapSuffix
+}
+
+// snapshotService returns a copy of the service with everything that the API server fills in
+// stripped off, i.e. exactly what is needed to create it again.
+func snapshotService(service *corev1.Service) *corev1.Service {
+	live := service.DeepCopy()
+	snapshot := &corev1.Service{}
+	snapshot.Name = live.Name
+	snapshot.Namespace = live.Namespace
+	snapshot.Labels = live.Labels
+	snapshot.Annotations = live.Annotations
+	snapshot.Spec = live.Spec
+	return snapshot
+}
+
+// loadSnapshots reads the member Service snapshots of the merge. A missing ConfigMap means no snapshots.
+func (r *SvcMergerObjReconciler) loadSnapshots(ctx context.Context, obj *newprojv1.SvcMergerObj) (map[string]*corev1.Service, error) {
+	l := log.FromContext(ctx)
+	snapshots := make(map[string]*corev1.Service)
+
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: snapshotConfigMapName(obj), Namespace: obj.Namespace}, cm)
+	if apierrors.IsNotFound(err) {
+		return snapshots, nil
+	}
+	if err != nil {
+		l.Error(err, "not able to fetch service snapshots")
+		return nil, err
+	}
+	for svc, raw := range cm.Data {
+		snapshot := &corev1.Service{}
+		if err := json.Unmarshal([]byte(raw), snapshot); err != nil {
+			l.Error(err, "not able to parse service snapshot", "service", svc)
+			return nil, err
+		}
+		snapshots[svc] = snapshot
+	}
+	return snapshots, nil
+}
+
+// saveSnapshot stores a snapshot of the member service in the snapshot ConfigMap, which is owned by the
+// SvcMergerObj. It has to be called before the member service is deleted.
+func (r *SvcMergerObjReconciler) saveSnapshot(ctx context.Context, obj *newprojv1.SvcMergerObj, service *corev1.Service) error {
+	l := log.FromContext(ctx)
+
+	raw, err := json.Marshal(snapshotService(service))
+	if err != nil {
+		return err
+	}
+
+	cm := &corev1.ConfigMap{}
+	cm.Name = snapshotConfigMapName(obj)
+	cm.Namespace = obj.Namespace
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, cm, func() error {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[service.Name] = string(raw)
+		return controllerutil.SetControllerReference(obj, cm, r.Scheme)
+	})
+	if err != nil {
+		l.Error(err, "not able to save service snapshot", "service", service.Name)
+		return err
+	}
+	return nil
+}
+
+// dropSnapshot removes the snapshot of a member service once it has been restored
+func (r *SvcMergerObjReconciler) dropSnapshot(ctx context.Context, obj *newprojv1.SvcMergerObj, svc string) error {
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: snapshotConfigMapName(obj), Namespace: obj.Namespace}, cm)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := cm.Data[svc]; !ok {
+		return nil
+	}
+	delete(cm.Data, svc)
+	return r.Update(ctx, cm)
+}
+
+// restoreService recreates a member service from its snapshot. The original ClusterIP (and node ports)
+// are asked for again; if the API server refuses them because they have been handed out in the meantime,
+// the service is created with freshly allocated ones instead.
+func (r *SvcMergerObjReconciler) restoreService(ctx context.Context, snapshot *corev1.Service) error {
+	l := log.FromContext(ctx)
+
+	service := snapshot.DeepCopy()
+	err := r.Create(ctx, service)
+	if err == nil || !apierrors.IsInvalid(err) {
+		return err
+	}
+	l.Info("original cluster IP or node ports not available anymore, allocating new ones", "service", snapshot.Name, "reason", err.Error())
+
+	service = snapshot.DeepCopy()
+	if service.Spec.ClusterIP != corev1.ClusterIPNone {
+		service.Spec.ClusterIP = ""
+		service.Spec.ClusterIPs = nil
+	}
+	for i := range service.Spec.Ports {
+		service.Spec.Ports[i].NodePort = 0
+	}
+	service.Spec.HealthCheckNodePort = 0
+	return r.Create(ctx, service)
+}
+
+// markSnapshotsMissing records the merged members without a snapshot in the SnapshotMissing condition and
+// returns true if the condition changed. A member demerged without being restored stays on record.
+func (r *SvcMergerObjReconciler) markSnapshotsMissing(obj *newprojv1.SvcMergerObj, missing []string) bool {
+	cond := meta.FindStatusCondition(obj.Status.Conditions, newprojv1.ConditionSnapshotMissing)
+	if len(missing) == 0 {
+		if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != reasonSnapshotMissing {
+			return false
+		}
+		setCondition(obj, newprojv1.ConditionSnapshotMissing, metav1.ConditionFalse, reasonSnapshotsKept, "every deleted member service has a snapshot")
+		return true
+	}
+	message := fmt.Sprintf("no snapshot of services %s: their ports are left out of the merged service and they are not restored on demerge",
+		strings.Join(missing, ", "))
+	changed := cond == nil || cond.Status != metav1.ConditionTrue || cond.Message != message
+	if changed && r.Recorder != nil {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, reasonSnapshotMissing, message)
+	}
+	setCondition(obj, newprojv1.ConditionSnapshotMissing, metav1.ConditionTrue, reasonSnapshotMissing, message)
+	return changed
+}
+
+// markNotRestored records that a demerged member Service was not created again for lack of a snapshot
+func (r *SvcMergerObjReconciler) markNotRestored(obj *newprojv1.SvcMergerObj, svc string) {
+	message := fmt.Sprintf("service %s has no snapshot and was not restored, it has to be created again by hand", svc)
+	if r.Recorder != nil {
+		r.Recorder.Event(obj, corev1.EventTypeWarning, reasonSnapshotMissing, message)
+	}
+	setCondition(obj, newprojv1.ConditionSnapshotMissing, metav1.ConditionTrue, reasonNotRestored, message)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// mergeState is the current state of one merge. It is rebuilt from the cluster on every reconcile,
+// so nothing is lost when the manager restarts.
+type mergeState struct {
+	// mergedService is the live merged Service, nil if it does not exist (yet)
+	mergedService *corev1.Service
+
+	// members maps every Service that is part of the merge to its original port (0 when unknown)
+	members map[string]int32
+
+	// workloads maps every workload taking part in the merge to the member Service it belongs to
+	workloads map[workloadRef]string
+
+	// snapshots holds the saved copy of every member Service that was deleted by the merge
+	snapshots map[string]*corev1.Service
+}
+
+// memberNames returns the names of the members in a stable order
+func (s *mergeState) memberNames() []string {
+	var names []string
+	for svc := range s.members {
+		names = append(names, svc)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// workloadsOf returns the workloads of the given member in a stable order
+func (s *mergeState) workloadsOf(svc string) []workloadRef {
+	var refs []workloadRef
+	for ref, member := range s.workloads {
+		if member == svc {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// loadMergeState works out the state of the merge from the durable sources: the merged Service and
+// its annotations, the annotations and merge label on the workloads, and the CR status.
+func (r *SvcMergerObjReconciler) loadMergeState(ctx context.Context, obj *newprojv1.SvcMergerObj) (*mergeState, error) {
+	l := log.FromContext(ctx)
+	name := obj.Name
+	state := &mergeState{
+		members: make(map[string]int32),
+	}
+
+	// The merged Service remembers the members and their ports. While a new name from the service template is
+	// rolled out, the merged Service still goes by the old one.
+	merged_svc := &corev1.Service{}
+	svc_name := obj.MergedServiceName()
+	err := r.Get(ctx, types.NamespacedName{Name: svc_name, Namespace: obj.Namespace}, merged_svc)
+	if live_name := liveMergedServiceName(obj); apierrors.IsNotFound(err) && live_name != svc_name {
+		err = r.Get(ctx, types.NamespacedName{Name: live_name, Namespace: obj.Namespace}, merged_svc)
+		if err == nil && merged_svc.Labels[r.Keys.MergedBy] != name {
+			err = apierrors.NewNotFound(corev1.Resource("services"), live_name)
+		}
+	} else if err == nil && svc_name != name && merged_svc.Labels[r.Keys.MergedBy] != name {
+		// a Service of that name that was not created by the merge is not taken over
+		return nil, fmt.Errorf("service %s already exists and is not the merged service of %s", svc_name, name)
+	}
+	if err == nil {
+		state.mergedService = merged_svc
+		if raw, ok := merged_svc.Annotations[r.Keys.MemberPorts]; ok {
+			ports := make(map[string]int32)
+			if err := json.Unmarshal([]byte(raw), &ports); err != nil {
+				l.Error(err, "not able to parse member ports annotation on merged service")
+				return nil, err
+			}
+			for svc, port := range ports {
+				state.members[svc] = port
+			}
+		}
+	} else if !apierrors.IsNotFound(err) {
+		l.Error(err, "not able to fetch merged service")
+		return nil, err
+	}
+
+	// Workloads are annotated with the merge they belong to (see findMergedWorkloads)
+	state.workloads, err = r.findMergedWorkloads(ctx, obj, r.Keys)
+	if err != nil {
+		l.Error(err, "not able to find merged workloads")
+		return nil, err
+	}
+	for _, member := range state.workloads {
+		if _, ok := state.members[member]; !ok && member != "" {
+			state.members[member] = 0
+		}
+	}
+
+	// Every member with a snapshot had its service deleted by the merge
+	state.snapshots, err = r.loadSnapshots(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	for svc, snapshot := range state.snapshots {
+		if port := state.members[svc]; port == 0 && len(snapshot.Spec.Ports) > 0 {
+			state.members[svc] = snapshot.Spec.Ports[0].Port
+		}
+	}
+
+	// Members the status reports as merged (or half way out of the merge) are part of it as well
+	for _, member := range obj.Status.Members {
+		if member.State != newprojv1.MemberMerged && member.State != newprojv1.MemberDetaching {
+			continue
+		}
+		if _, ok := state.members[member.Name]; !ok {
+			state.members[member.Name] = 0
+		}
+	}
+
+	return state, nil
+}
+
+// syncMemberPorts writes the member ports of the state back onto the merged Service
+func (r *SvcMergerObjReconciler) syncMemberPorts(ctx context.Context, state *mergeState) error {
+	if state.mergedService == nil {
+		return nil
+	}
+	raw, err := json.Marshal(state.members)
+	if err != nil {
+		return err
+	}
+	if state.mergedService.Annotations[r.Keys.MemberPorts] == string(raw) {
+		return nil
+	}
+	if state.mergedService.Annotations == nil {
+		state.mergedService.Annotations = make(map[string]string)
+	}
+	state.mergedService.Annotations[r.Keys.MemberPorts] = string(raw)
+	return r.Update(ctx, state.mergedService)
+}
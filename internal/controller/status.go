@@ -0,0 +1,188 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// Reasons used on the status conditions
+const (
+	reasonMerging        = "Merging"
+	reasonUpdating       = "Updating"
+	reasonDemerging      = "Demerging"
+	reasonMerged         = "Merged"
+	reasonReconcileError = "ReconcileError"
+	reasonPortsSkipped   = "PortsSkipped"
+	reasonNoCollision    = "NoCollision"
+
+	reasonUnsupportedWorkload = "UnsupportedWorkload"
+	reasonRollingOut          = "RollingOut"
+	reasonRolloutFailed       = "RolloutFailed"
+	reasonCuttingOver         = "CuttingOver"
+	reasonRollingBack         = "RollingBack"
+	reasonRolledBack          = "RolledBack"
+	reasonSelectorLabel       = "SelectorLabelConflict"
+)
+
+// reasonError is an error that carries the condition reason it should be reported with
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func newReasonError(reason string, err error) error {
+	return &reasonError{reason: reason, err: err}
+}
+
+func (e *reasonError) Error() string { return e.err.Error() }
+func (e *reasonError) Unwrap() error { return e.err }
+
+// setCondition sets a condition on the SvcMergerObj status, stamped with the current generation
+func setCondition(obj *newprojv1.SvcMergerObj, condType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&obj.Status.Conditions, metav1.Condition{
+		Type:               condType,
+		Status:             status,
+		ObservedGeneration: obj.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setPhase records the step of the merge lifecycle the object is in
+func setPhase(obj *newprojv1.SvcMergerObj, phase newprojv1.MergePhase) {
+	obj.Status.Phase = phase
+}
+
+// markProgressing flags the object as having an operation in flight
+func markProgressing(obj *newprojv1.SvcMergerObj, reason, message string) {
+	obj.Status.ObservedGeneration = obj.Generation
+	setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionTrue, reason, message)
+	setCondition(obj, newprojv1.ConditionReady, metav1.ConditionFalse, reason, message)
+}
+
+// markReady flags the object as fully merged
+func markReady(obj *newprojv1.SvcMergerObj, message string) {
+	obj.Status.ObservedGeneration = obj.Generation
+	setPhase(obj, newprojv1.PhaseMerged)
+	setCondition(obj, newprojv1.ConditionReady, metav1.ConditionTrue, reasonMerged, message)
+	setCondition(obj, newprojv1.ConditionProgressing, metav1.ConditionFalse, reasonMerged, message)
+	setCondition(obj, newprojv1.ConditionDegraded, metav1.ConditionFalse, reasonMerged, message)
+}
+
+// markDegraded flags the object as failed part way through, the error is kept as the message
+func markDegraded(obj *newprojv1.SvcMergerObj, reason string, err error) {
+	setPhase(obj, newprojv1.PhaseFailed)
+	setCondition(obj, newprojv1.ConditionDegraded, metav1.ConditionTrue, reason, err.Error())
+	setCondition(obj, newprojv1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+}
+
+// memberStatus returns the status entry of the named member, adding a Pending one if it is not there yet
+func memberStatus(obj *newprojv1.SvcMergerObj, name string) *newprojv1.MemberStatus {
+	for i := range obj.Status.Members {
+		if obj.Status.Members[i].Name == name {
+			return &obj.Status.Members[i]
+		}
+	}
+	obj.Status.Members = append(obj.Status.Members, newprojv1.MemberStatus{
+		Name:  name,
+		State: newprojv1.MemberPending,
+	})
+	return &obj.Status.Members[len(obj.Status.Members)-1]
+}
+
+// setMemberState sets the state of the named member, adding it to the list if it is not there yet
+func setMemberState(obj *newprojv1.SvcMergerObj, name string, state newprojv1.MemberState, message string) {
+	member := memberStatus(obj, name)
+	member.State = state
+	member.Message = message
+}
+
+// setMemberSelectors records the pod selector of every member that has a spec. It returns true if any changed.
+func setMemberSelectors(obj *newprojv1.SvcMergerObj, services []string, member_specs map[string]*corev1.Service) bool {
+	changed := false
+	for _, svc := range services {
+		spec, ok := member_specs[svc]
+		if !ok {
+			continue
+		}
+		member := memberStatus(obj, svc)
+		if !reflect.DeepEqual(member.Selector, spec.Spec.Selector) {
+			member.Selector = spec.Spec.Selector
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeMember drops the named member from the status list
+func removeMember(obj *newprojv1.SvcMergerObj, name string) {
+	members := obj.Status.Members[:0]
+	for _, member := range obj.Status.Members {
+		if member.Name != name {
+			members = append(members, member)
+		}
+	}
+	obj.Status.Members = members
+}
+
+// setMergedService records the merged Service reference in the status
+func setMergedService(obj *newprojv1.SvcMergerObj, svc *corev1.Service) {
+	merged := &newprojv1.MergedServiceStatus{
+		Name:      svc.Name,
+		ClusterIP: svc.Spec.ClusterIP,
+	}
+	if len(svc.Spec.Ports) > 0 {
+		merged.Port = svc.Spec.Ports[0].Port
+	}
+	obj.Status.MergedService = merged
+}
+
+// updateStatus writes the status subresource. Failures are logged and returned so the caller can requeue
+func (r *SvcMergerObjReconciler) updateStatus(ctx context.Context, obj *newprojv1.SvcMergerObj) error {
+	l := log.FromContext(ctx)
+	if err := r.Status().Update(ctx, obj); err != nil {
+		l.Error(err, "not able to update svcmergerobj status")
+		return err
+	}
+	return nil
+}
+
+// failMember marks a member (if any) as Failed and the object as Degraded, writes the status and returns the original error
+func (r *SvcMergerObjReconciler) failMember(ctx context.Context, obj *newprojv1.SvcMergerObj, member string, err error) error {
+	if member != "" {
+		setMemberState(obj, member, newprojv1.MemberFailed, err.Error())
+	}
+	reason := reasonReconcileError
+	var reason_err *reasonError
+	if errors.As(err, &reason_err) {
+		reason = reason_err.reason
+	}
+	markDegraded(obj, reason, err)
+	// the status write is best effort here, the reconcile error is what matters
+	_ = r.updateStatus(ctx, obj)
+	return err
+}
@@ -18,19 +18,28 @@ package controller
 
 import (
 	"context"
-	"time"
+	"encoding/json"
+	"reflect"
+	"strings"
 
 	// metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	// "sigs.k8s.io/controller-runtime/pkg/reconcile"
 
@@ -41,641 +50,829 @@ import (
 // SvcMergerObjReconciler reconciles a SvcMergerObj object
 type SvcMergerObjReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Keys are the label, annotation and finalizer keys written by the controller, NewKeys(DefaultKeyDomain) if unset
+	Keys Keys
+	// MigrateLegacyKeys moves merges made with the keys of older versions over to Keys
+	MigrateLegacyKeys bool
+	// Ports allocates the merged Service ports not set in the spec; without it the first port keeps its number
+	Ports *PortAllocator
+	// ClusterDomain is the DNS domain of the cluster that ExternalName aliases point into, DefaultClusterDomain if unset
+	ClusterDomain string
+	// ProxyImage is the image of the proxy of the Proxy strategy, for SvcMergerObjs that don't set their own
+	ProxyImage string
 }
 
-var all_maps_initialized bool = false
+// This function will return the pods selected by a member service. For merges made before snapshots were
+// taken the selector of the member is not known anymore, the pods are then found by the labels the merge put on them.
+func (r *SvcMergerObjReconciler) getMemberPods(ctx context.Context, obj *newprojv1.SvcMergerObj, svc string, spec *corev1.Service) ([]corev1.Pod, error) {
 
-// stores the names of merged services
-var merged_service_exists map[string]bool
-
-// map to store the service names which are currently under merger
-var cur_mrgd_svcs_map map[string]map[string]int
-
-// List of pods that are currently under merger.
-var merged_pods map[string][]string
+	l := log.FromContext(ctx)
 
-// Map to store svc name and port number
-var svc_port_map map[string]int32
+	selector_labels_map := map[string]string{
+		r.Keys.Member: svc,
+		r.Keys.Group:  obj.Name,
+	}
+	if spec != nil && len(spec.Spec.Selector) > 0 {
+		selector_labels_map = spec.Spec.Selector
+	}
 
-type string_pair struct {
-	pod     string
-	service string
+	pod_list := &corev1.PodList{}
+	err := r.Client.List(ctx, pod_list, client.InNamespace(obj.Namespace), client.MatchingLabels(selector_labels_map))
+	if err != nil {
+		l.Error(err, "not able to fetch pods")
+		return nil, err
+	}
+	return pod_list.Items, nil
 }
 
-// This function will take in a list of services and return a list of pods that are associated with those services
-func (r *SvcMergerObjReconciler) getPodNames(ctx context.Context, req ctrl.Request, services []string) ([]string_pair, error) {
+// This function will add the merge labels to every workload behind the given member service.
+// It returns the workloads it had to change.
+func (r *SvcMergerObjReconciler) labelMemberWorkloads(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string, spec *corev1.Service) ([]workloadRef, error) {
 
 	l := log.FromContext(ctx)
-	l.Info("Entered getPodNames function")
+	var relabeled []workloadRef
 
-	// create a pods array of pair of {string, string} to store the pod name and service name
-	var pods []string_pair
+	pods, err := r.getMemberPods(ctx, obj, svc, spec)
+	if err != nil {
+		l.Error(err, "not able to get pods of member service", "service", svc)
+		return nil, err
+	}
 
-	for _, svc := range services {
+	// maintain a map to see if this workload has already been labeled. If yes, then we don't need to do again
+	workload_map := make(map[workloadRef]bool)
+	for i := range pods {
+		pod_obj := &pods[i]
+		ref, err := r.resolveWorkload(ctx, pod_obj)
+		if err != nil {
+			l.Error(err, "not able to resolve the workload of pod", "pod", pod_obj.Name)
+			return relabeled, err
+		}
+		if ref.Kind == "Pod" && obj.Spec.OwnerlessPods != newprojv1.OwnerlessPodsRelabel {
+			return relabeled, newReasonError(reasonUnsupportedWorkload,
+				fmt.Errorf("pod %s of service %s is not managed by any workload, set spec.ownerlessPods to Relabel to merge it", pod_obj.Name, svc))
+		}
+		if workload_map[ref] {
+			continue
+		}
+		workload_map[ref] = true
 
-		service := &corev1.Service{}
-		err := r.Get(ctx, types.NamespacedName{
-			Name:      svc,
-			Namespace: req.Namespace,
-		}, service)
+		// The annotations record the membership, so the merge can be found again after a restart
+		state.workloads[ref] = svc
+		updated, err := r.labelWorkload(ctx, obj, ref, svc)
+		if err != nil {
+			return relabeled, err
+		}
+		if updated {
+			relabeled = append(relabeled, ref)
+		}
+	}
+	return relabeled, nil
+}
+
+// This function will check the rollouts of the workloads of the given member. It returns a message
+// describing what the member still waits for, empty once every workload runs its relabeled pods.
+func (r *SvcMergerObjReconciler) memberRollout(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string) (string, error) {
 
+	var waiting []string
+	for _, ref := range state.workloadsOf(svc) {
+		done, message, err := r.workloadRollout(ctx, obj.Namespace, ref)
 		if err != nil {
-			l.Error(err, "not able to fetch service")
-			return nil, err
+			return "", newReasonError(reasonRolloutFailed, err)
 		}
+		if !done {
+			waiting = append(waiting, fmt.Sprintf("%s: %s", ref.String(), message))
+		}
+	}
+	if len(waiting) == 0 {
+		return "", nil
+	}
+	return "waiting for rollout of " + strings.Join(waiting, ", "), nil
+}
+
+// This function will take the given member out of the merge: it restores the original service from its
+// snapshot if the merge deleted it, in place of its alias if there is one, and removes the merge label and annotations from the workloads of the member.
+func (r *SvcMergerObjReconciler) demergeMember(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string) error {
+
+	l := log.FromContext(ctx)
 
-		pod_list := &corev1.PodList{}
-		selector_labels_map := service.Spec.Selector
-		err = r.Client.List(ctx, pod_list, client.InNamespace(req.Namespace), client.MatchingLabels(selector_labels_map))
+	service := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{
+		Name:      svc,
+		Namespace: obj.Namespace,
+	}, service)
+	if err == nil && r.isAlias(obj, service) {
+		// the alias makes way for the original
+		if err := r.removeAlias(ctx, service); err != nil {
+			return err
+		}
+		err = apierrors.NewNotFound(corev1.Resource("services"), svc)
+	}
+	if snapshot, ok := state.snapshots[svc]; ok && apierrors.IsNotFound(err) {
+		err = r.restoreService(ctx, snapshot)
 		if err != nil {
-			l.Error(err, "not able to fetch pods")
-			return nil, err
+			l.Error(err, "not able to restore member service from snapshot", "service", svc)
+			return err
 		}
+	} else if apierrors.IsNotFound(err) && keepsMemberServices(obj) {
+		// the service was deleted by hand, the merge never took it away so it isn't brought back either
+	} else if apierrors.IsNotFound(err) {
+		// merges made before snapshots were taken can't bring the service back, the demerge carries on without it
+		l.Info("no snapshot of member service, not restoring it", "service", svc)
+		r.markNotRestored(obj, svc)
+	} else if err != nil {
+		l.Error(err, "not able to fetch member service", "service", svc)
+		return err
+	}
+
+	// Service is there again. Remove the merge label from the workloads so that the pods are freed
+	if err := r.unlabelMemberWorkloads(ctx, obj, state, svc); err != nil {
+		return err
+	}
+	if err := r.releaseClaim(ctx, obj, svc); err != nil {
+		return err
+	}
 
-		for _, pod := range pod_list.Items {
-			pods = append(pods, string_pair{pod.Name, svc})
+	// Forget the member on the merged service and drop its snapshot
+	if err := r.dropSnapshot(ctx, obj, svc); err != nil {
+		l.Error(err, "not able to drop service snapshot", "service", svc)
+		return err
+	}
+	delete(state.snapshots, svc)
+	delete(state.members, svc)
+	return r.syncMemberPorts(ctx, state)
+}
+
+// This function will remove the merge label and annotations from the workloads of the given member
+func (r *SvcMergerObjReconciler) unlabelMemberWorkloads(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, svc string) error {
+
+	for ref, member := range state.workloads {
+		if member != svc {
+			continue
 		}
+		if err := r.unlabelWorkload(ctx, obj, ref, r.Keys); err != nil {
+			return err
+		}
+		delete(state.workloads, ref)
 	}
-	return pods, nil
+	return nil
 }
 
-// This function will take in a pod object and return the deployment owner reference
-func (r *SvcMergerObjReconciler) getDeploymentName(ctx context.Context, req ctrl.Request, pod_obj *corev1.Pod) (string, error) {
+// This function will create the merged service if it does not exist yet, and otherwise keep its ports,
+// selector, labels, the member ports annotation and what the service template sets up to date. Changes that
+// are not explained by a new generation of the spec were made by hand and are recorded as repairs. When the
+// service template gives the merged service a new name, it is created under that name and the old one deleted.
+func (r *SvcMergerObjReconciler) ensureMergedService(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, ports []corev1.ServicePort, repairs *driftRepairs) (*corev1.Service, error) {
 
 	l := log.FromContext(ctx)
-	owner_ref := pod_obj.OwnerReferences
-
-	// this owner_ref is a replica set object, we need to get the deployment object from it
-	for _, owner := range owner_ref {
-		if owner.Kind == "ReplicaSet" {
-			replica_set_obj := &appsv1.ReplicaSet{}
-			err := r.Get(ctx, types.NamespacedName{
-				Name:      owner.Name,
-				Namespace: req.Namespace,
-			}, replica_set_obj)
-			if err != nil {
-				l.Error(err, "not able to fetch replica set")
-				return "", err
+	name := obj.Name
+	svc_name := obj.MergedServiceName()
+
+	// With the EndpointSlice strategies the merged service has no selector, the controller writes its endpoints;
+	// with the Proxy strategy it selects the proxy pods
+	var selector map[string]string
+	if useProxy(obj) {
+		selector = r.proxyPodLabels(obj)
+	} else if !useEndpointSlices(obj) {
+		selector = map[string]string{
+			r.Keys.Group: name,
+		}
+	}
 
+	var renamed *corev1.Service
+	if state.mergedService != nil && state.mergedService.Name != svc_name {
+		renamed = state.mergedService
+		state.mergedService = nil
+	}
+
+	if state.mergedService != nil {
+		merged_svc := state.mergedService
+		selector_changed := !reflect.DeepEqual(merged_svc.Spec.Selector, selector)
+		labels_changed := merged_svc.Labels[r.Keys.MergedBy] != name ||
+			!controllerutil.ContainsFinalizer(merged_svc, r.Keys.mergedServiceFinalizerFor(name))
+		ports_changed := !portsEqual(merged_svc.Spec.Ports, ports)
+		if ports_changed {
+			merged_svc.Spec.Ports = keepNodePorts(ports, merged_svc.Spec.Ports)
+		}
+		template_changed := r.Keys.applyServiceTemplate(merged_svc, obj.Spec.ServiceTemplate)
+		if selector_changed || labels_changed || ports_changed || template_changed {
+			// no operation is changing the merge and the spec is unchanged since the last reconcile,
+			// so someone edited the merged service
+			if obj.Generation == obj.Status.ObservedGeneration && !operationInFlight(obj) {
+				r.recordRepair(ctx, obj, repairs, reasonMergedServiceRepaired,
+					fmt.Sprintf("merged service %s was changed and has been set back", svc_name))
+			}
+			merged_svc.Spec.Selector = selector
+			if merged_svc.Labels == nil {
+				merged_svc.Labels = make(map[string]string)
 			}
-			owner_ref2 := replica_set_obj.OwnerReferences
-			for _, owner2 := range owner_ref2 {
-				if owner2.Kind == "Deployment" {
-					return owner2.Name, nil
-				}
+			merged_svc.Labels[r.Keys.MergedBy] = name
+			controllerutil.AddFinalizer(merged_svc, r.Keys.mergedServiceFinalizerFor(name))
+			if err := r.Update(ctx, merged_svc); err != nil {
+				l.Error(err, "not able to update merged service")
+				return nil, err
 			}
+		}
+		if selector_changed && selector != nil {
+			// switched to the Labels or Proxy strategy, the slices written by the controller are not needed anymore
+			if err := r.deleteEndpointSlices(ctx, state.mergedService); err != nil {
+				l.Error(err, "not able to delete endpoint slices of merged service")
+				return nil, err
+			}
+		}
+		if err := r.syncMemberPorts(ctx, state); err != nil {
+			l.Error(err, "not able to update member ports on merged service")
+			return nil, err
+		}
+		return state.mergedService, nil
+	}
+
+	member_ports, err := json.Marshal(state.members)
+	if err != nil {
+		return nil, err
+	}
 
+	// Now we need to create a new service with the group label as selector to add the pods of all the members
+	// (or without selector for the EndpointSlice strategy)
+	merged_svc := &corev1.Service{}
+	merged_svc.Name = svc_name
+	merged_svc.Namespace = obj.Namespace
+	merged_svc.Spec.Ports = ports
+	r.Keys.applyServiceTemplate(merged_svc, obj.Spec.ServiceTemplate)
+	if merged_svc.Labels == nil {
+		merged_svc.Labels = make(map[string]string)
+	}
+	merged_svc.Labels[r.Keys.MergedBy] = name
+	if merged_svc.Annotations == nil {
+		merged_svc.Annotations = make(map[string]string)
+	}
+	merged_svc.Annotations[r.Keys.MemberPorts] = string(member_ports)
+	merged_svc.Spec.Selector = selector
+	merged_svc.Finalizers = append(merged_svc.Finalizers, r.Keys.mergedServiceFinalizerFor(name))
+	err = r.Create(ctx, merged_svc)
+	if err != nil {
+		l.Error(err, "not able to create new merge service")
+		return nil, err
+	}
+	if renamed != nil {
+		l.Info("merged service renamed by the service template, deleting the old one", "old", renamed.Name, "new", svc_name)
+		if err := r.releaseAndDelete(ctx, obj, renamed); err != nil {
+			return nil, err
 		}
+	} else if obj.Status.MergedService != nil {
+		// the merge was in place before, so the merged service has been deleted by hand
+		r.recordRepair(ctx, obj, repairs, reasonMergedServiceRecreated,
+			fmt.Sprintf("merged service %s was deleted and has been created again", svc_name))
 	}
-	return "", nil
+	state.mergedService = merged_svc
+	return merged_svc, nil
 }
 
 //+kubebuilder:rbac:groups=newproj.controller.proj,resources=svcmergerobjs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=newproj.controller.proj,resources=svcmergerobjs/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=newproj.controller.proj,resources=svcmergerobjs/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=create;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch;create;update;patch;delete;deletecollection
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SvcMergerObj object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+//
+// Nothing is kept in memory between two calls: the state of the merge is rebuilt from the
+// merged Service, the member workloads and the CR status every time (see loadMergeState),
+// so the manager can be restarted at any point without losing track of a merge.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.15.0/pkg/reconcile
 func (r *SvcMergerObjReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
-	time.Sleep(3 * time.Second)
 	l.Info(fmt.Sprintf("Entered Reconciliation function >>>> %v", req.Name))
-	var name string
-	var delete_event bool
-	// Get the name of the Custom Resource
+
+	// Get the Custom Resource
 	svcMergerObj := &newprojv1.SvcMergerObj{}
 	err := r.Get(ctx, req.NamespacedName, svcMergerObj)
 	if err != nil {
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
-	// fmt.Println("################", svcMergerObj.ObjectMeta.Name)
-	// if svcMergerObj.ObjectMeta.Name == "" {
-	// 	return ctrl.Result{}, nil
-	// }
-	if svcMergerObj.Kind == "SvcMergerObj" {
-		finalizer := "finalizer.newproj.controller.proj"
-		if svcMergerObj.DeletionTimestamp.IsZero() {
-
-			name = svcMergerObj.ObjectMeta.Name
-			delete_event = false
-			if !controllerutil.ContainsFinalizer(svcMergerObj, finalizer) {
-				controllerutil.AddFinalizer(svcMergerObj, finalizer)
-				if err := r.Update(ctx, svcMergerObj); err != nil {
-					l.Info("error in adding finalizer")
-					return ctrl.Result{}, err
-				}
-			}
-		} else {
-			if controllerutil.ContainsFinalizer(svcMergerObj, finalizer) {
-				l.Info("deleting the finalizer")
-				name = svcMergerObj.ObjectMeta.Name
-				delete_event = true
-				controllerutil.RemoveFinalizer(svcMergerObj, finalizer)
-				if err := r.Update(ctx, svcMergerObj); err != nil {
-					l.Info("error in removing finalizer")
-					return ctrl.Result{}, err
-				}
-			}
+
+	// Merges made with the keys of older versions are moved over to the configured keys first
+	if r.MigrateLegacyKeys && !svcMergerObj.Status.KeysMigrated {
+		migrated, err := r.migrateLegacyKeys(ctx, svcMergerObj)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !migrated {
+			return ctrl.Result{RequeueAfter: rolloutPollInterval}, nil
+		}
+		svcMergerObj.Status.KeysMigrated = true
+		if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+			return ctrl.Result{}, err
 		}
 	}
 
-	if !all_maps_initialized {
-
-		merged_service_exists = make(map[string]bool)
-		cur_mrgd_svcs_map = make(map[string]map[string]int)
-		svc_port_map = make(map[string]int32)
-		merged_pods = make(map[string][]string)
+	if !svcMergerObj.DeletionTimestamp.IsZero() {
+		// The finalizer is only removed once the rollback is done, so that the status can be
+		// written for every phase of the deletion.
+		if !controllerutil.ContainsFinalizer(svcMergerObj, r.Keys.Finalizer) &&
+			!controllerutil.ContainsFinalizer(svcMergerObj, legacyKeys.Finalizer) {
+			return ctrl.Result{}, nil
+		}
+		state, err := r.loadMergeState(ctx, svcMergerObj)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.reconcileDelete(ctx, svcMergerObj, state)
+	}
 
-		all_maps_initialized = true
+	if !controllerutil.ContainsFinalizer(svcMergerObj, r.Keys.Finalizer) {
+		controllerutil.AddFinalizer(svcMergerObj, r.Keys.Finalizer)
+		if err := r.Update(ctx, svcMergerObj); err != nil {
+			l.Info("error in adding finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+	if svcMergerObj.Status.Phase == "" {
+		setPhase(svcMergerObj, newprojv1.PhasePending)
+		if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
-	// Check if the merged service "name" exists or not. If not, then create it.
-	if _, exists := merged_service_exists[name]; !exists {
+	state, err := r.loadMergeState(ctx, svcMergerObj)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return r.reconcileMerge(ctx, svcMergerObj, state)
+}
 
-		fmt.Println("######################################### CREATION STARTED ###############################################")
-		l.Info("Merging services ............")
-		var services []string // get the services from the spec
+// reconcileMerge brings the merge in line with the spec. It handles both the first merge and
+// later updates of the member list: members that left the spec (or no longer match its selector)
+// are given back their service, members whose original service still exists are merged.
+func (r *SvcMergerObjReconciler) reconcileMerge(ctx context.Context, svcMergerObj *newprojv1.SvcMergerObj, state *mergeState) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	name := svcMergerObj.Name
 
-		services = svcMergerObj.Spec.Services
-		cur_mrgd_svcs_map[name] = make(map[string]int)
+	// A merged service that was deleted by hand is held by our finalizer; let it go and create it again
+	terminating, err := r.releaseDeletedMergedService(ctx, svcMergerObj, state)
+	if err != nil {
+		return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+	}
+	if terminating {
+		return ctrl.Result{Requeue: true}, nil
+	}
+	var repairs driftRepairs
 
-		// Fill the cur_mrgd_svcs_map with service name and labels
-		for _, svc := range services {
-			service := &corev1.Service{}
-			err := r.Get(ctx, types.NamespacedName{
-				Name:      svc,
-				Namespace: req.Namespace,
-			}, service)
-			if err != nil {
-				l.Error(err, "not able to fetch service")
-				return ctrl.Result{}, err
-			}
-			// fmt.Println("Ig it's here###########")
-			cur_mrgd_svcs_map[name][svc] = 1 // just to inform that it's there!
-			svc_port_map[svc] = service.Spec.Ports[0].Port
-		}
+	services, err := r.resolveMembers(ctx, svcMergerObj, state)
+	if err != nil {
+		l.Error(err, "not able to resolve the member services")
+		return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+	}
+	resolved_changed := !reflect.DeepEqual(svcMergerObj.Status.ResolvedServices, services)
+	svcMergerObj.Status.ResolvedServices = services
+	if len(services) == 0 {
+		return r.reconcileNoMembers(ctx, svcMergerObj, state)
+	}
 
-		var pods []string_pair
+	new_service_map := make(map[string]bool)
+	for _, svc := range services {
+		new_service_map[svc] = true
+	}
 
-		pods, err := r.getPodNames(ctx, req, services)
-		if err != nil {
-			l.Error(err, "not able to get pods -- first time")
-			return ctrl.Result{}, err
+	// Members that are no longer in the spec have to be demerged
+	var to_delete []string
+	known_members := make(map[string]bool)
+	for _, svc := range state.memberNames() {
+		known_members[svc] = true
+		if !new_service_map[svc] {
+			to_delete = append(to_delete, svc)
 		}
+	}
 
-		fmt.Println("all pods before merging")
-		for _, pod := range pods {
-			l.Info(pod.pod)
+	// Members whose original service still exists have not been merged (completely) yet, unless the member
+	// was merged already and the service has been created again by hand, or the mode keeps member services.
+	// member_specs keeps the spec of every member: the live service, or the snapshot once it is deleted.
+	// A deleted member without a snapshot has no spec.
+	var to_add, merged, recreated, missing_snapshots []string
+	var conflicts []claimConflict
+	member_specs := make(map[string]*corev1.Service)
+	for _, svc := range services {
+		service := &corev1.Service{}
+		err := r.Get(ctx, types.NamespacedName{
+			Name:      svc,
+			Namespace: svcMergerObj.Namespace,
+		}, service)
+		if err == nil && r.isAlias(svcMergerObj, service) {
+			// an alias stands in for a member whose original service is gone
+			err = apierrors.NewNotFound(corev1.Resource("services"), svc)
 		}
-
-		deployment_map := make(map[string]bool)
-
-		// Now that we have all the pods, we need to loop over them and get the owner references of each pod and add a new merge label to the deployment if it doesn't exist already
-		for _, pod := range pods {
-			pod_obj := &corev1.Pod{}
-			err = r.Get(ctx, types.NamespacedName{
-				Name:      pod.pod,
-				Namespace: req.Namespace,
-			}, pod_obj)
-			if err != nil {
-				// l.Error(err, "not able to fetch pod")
-				// return ctrl.Result{}, err
-				l.Info("pod not found, but that's okay, as we don't have to update the deployment again")
-				continue
+		if _, ok := state.snapshots[svc]; ok && err == nil && memberMerged(svcMergerObj, svc) {
+			recreated = append(recreated, svc)
+			merged = append(merged, svc)
+			member_specs[svc] = state.snapshots[svc]
+			continue
+		}
+		if err == nil {
+			if len(service.Spec.Ports) == 0 {
+				err = fmt.Errorf("service %s has no ports", svc)
+				return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
 			}
-
-			// I want to change the label selector of the deployment to include the new label, for that I need to get the owner reference of the pod
-			// and then get the deployment object to add the label to it and update it
-			// owner_ref := pod_obj.OwnerReferences
-
-			//maintain a map to see if this deployment has already been fetched. If yes, then we don't need to do again
-
-			deployment_name, err := r.getDeploymentName(ctx, req, pod_obj)
-			if deployment_name == "" {
-				l.Error(err, "Deployment name is empty")
-				return ctrl.Result{}, err
+			state.members[svc] = service.Spec.Ports[0].Port
+			member_specs[svc] = service
+			if keepsMemberServices(svcMergerObj) && memberMerged(svcMergerObj, svc) {
+				merged = append(merged, svc)
+				continue
 			}
+			to_add = append(to_add, svc)
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			l.Error(err, "not able to fetch service")
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
+		}
+		// a member service is only gone because of the merge if the mode replaces them
+		if _, merged := state.members[svc]; !merged || keepsMemberServices(svcMergerObj) {
+			// a member merged by another SvcMergerObj is gone as well, its snapshot tells who has it
+			holder, err := r.snapshotHolder(ctx, svcMergerObj, svc)
 			if err != nil {
-				l.Error(err, "not able to get deployment name")
-				return ctrl.Result{}, err
+				l.Error(err, "not able to look for the holder of service", "service", svc)
+				return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
 			}
-
-			if deployment_map[deployment_name] == false {
-
-				deployment_obj := &appsv1.Deployment{}
-				err = r.Get(ctx, types.NamespacedName{
-					Name:      deployment_name,
-					Namespace: req.Namespace,
-				}, deployment_obj)
-				if err != nil {
-					l.Error(err, "not able to fetch deployment")
-					return ctrl.Result{}, err
-				}
-				fmt.Println(">>>>>>>>", deployment_name)
-
-				// add  'merge' label & name = pod.service to the pod template of deployment object if it doesn't exist already
-				pod_template_labels := deployment_obj.Spec.Template.Labels
-				if pod_template_labels["merge"] != name {
-					pod_template_labels["merge"] = name
-					pod_template_labels["name"] = pod.service
-					deployment_obj.Spec.Template.SetLabels(pod_template_labels)
-					err = r.Update(ctx, deployment_obj)
-					if err != nil {
-						l.Error(err, "not able to update deployment with a label")
-						return ctrl.Result{}, err
-					}
-				}
-
-				deployment_map[deployment_name] = true
+			if holder != "" {
+				conflicts = append(conflicts, claimConflict{service: svc, holder: holder, reason: reasonServiceClaimed,
+					message: fmt.Sprintf("service %s is merged by SvcMergerObj %s", svc, holder)})
+				continue
 			}
-
+			err = fmt.Errorf("service %s not found", svc)
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
 		}
-		// update the pods array with names of new pods that are created because of the restart of deployment
-		// sleep for 5 seconds to give time for the pods to restart
-		time.Sleep(20 * time.Second)
-		pods = nil
-		pods, err = r.getPodNames(ctx, req, services)
+		merged = append(merged, svc)
+		if snapshot, ok := state.snapshots[svc]; ok {
+			member_specs[svc] = snapshot
+		} else {
+			missing_snapshots = append(missing_snapshots, svc)
+		}
+	}
+
+	// Members claimed by another SvcMergerObj are parked as Pending until they are free, the rest of the merge
+	// carries on without them
+	for _, svc := range to_add {
+		conflict, err := r.checkClaim(ctx, svcMergerObj, member_specs[svc])
 		if err != nil {
-			l.Error(err, "not able to get pods -- second time")
-			return ctrl.Result{}, err
+			l.Error(err, "not able to check the claim on service", "service", svc)
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
+		}
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	conflicts_changed := false
+	if len(conflicts) > 0 {
+		parked := make(map[string]bool)
+		for _, conflict := range conflicts {
+			parked[conflict.service] = true
+			if !known_members[conflict.service] {
+				delete(state.members, conflict.service)
+			}
+		}
+		services = withoutMembers(services, parked)
+		to_add = withoutMembers(to_add, parked)
+		merged = withoutMembers(merged, parked)
+		if len(services) == 0 {
+			return r.waitForClaims(ctx, svcMergerObj, conflicts)
 		}
+		conflicts_changed = r.parkConflicts(ctx, svcMergerObj, conflicts)
+	} else {
+		clearConflict(svcMergerObj)
+	}
 
-		fmt.Println("all pods after merging")
-		for _, pod := range pods {
-			l.Info(pod.pod)
+	snapshots_changed := r.markSnapshotsMissing(svcMergerObj, missing_snapshots)
+
+	ports, collisions, err := buildMergedPorts(svcMergerObj, services, member_specs)
+	if err == nil && len(ports) == 0 {
+		err = fmt.Errorf("member services expose no ports")
+	}
+	if err != nil {
+		l.Error(err, "not able to work out the ports of the merged service")
+		return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+	}
+	// Without explicit port mappings the first port is exposed on the port of the merged service, if one is
+	// set in the spec or allocated; otherwise every port keeps its number
+	if len(svcMergerObj.Spec.Ports) == 0 {
+		port, err := r.mergedServicePort(ctx, svcMergerObj, state)
+		if err != nil {
+			l.Error(err, "not able to allocate a port for the merged service")
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+		}
+		if port != 0 {
+			var port_collisions []string
+			ports, port_collisions = exposeMergedPort(ports, port)
+			collisions = append(collisions, port_collisions...)
 		}
+	}
+	// the listeners of the proxy take the place of the member ports, colliding or not
+	if proxyListenersSet(svcMergerObj) {
+		collisions = nil
+	}
+	if len(collisions) > 0 {
+		setCondition(svcMergerObj, newprojv1.ConditionPortCollision, metav1.ConditionTrue, reasonPortsSkipped, strings.Join(collisions, "; "))
+	} else {
+		setCondition(svcMergerObj, newprojv1.ConditionPortCollision, metav1.ConditionFalse, reasonNoCollision, "all member ports are exposed")
+	}
 
-		// this is the final list of pods that are created after the merge operation
-		merged_pods[name] = []string{}
-		for _, pod := range pods {
-			merged_pods[name] = append(merged_pods[name], pod.pod)
+	l.Info("computed merge changes", "to_add", to_add, "to_delete", to_delete)
+
+	// Forget status entries of services that are neither listed nor part of the merge anymore
+	for _, member := range append([]newprojv1.MemberStatus(nil), svcMergerObj.Status.Members...) {
+		if _, merged := state.members[member.Name]; !merged && !new_service_map[member.Name] {
+			removeMember(svcMergerObj, member.Name)
 		}
+	}
+	selectors_changed := setMemberSelectors(svcMergerObj, services, member_specs)
 
-		// Now we need to create a new service with selector label as merge=true to add the pods from the array 'pods'
-		merged_svc := &corev1.Service{}
-		merged_svc.Name = name
-		merged_svc.Namespace = req.Namespace
-		merged_svc.Spec.Selector = map[string]string{
-			"merge": name,
+	// Nothing changed in the member list (e.g. reconcile triggered by a watched object),
+	// only the ports of the merged service may have to follow the spec
+	// Anything that was changed by hand is put back on the way
+	if len(to_add) == 0 && len(to_delete) == 0 && state.mergedService != nil && !operationInFlight(svcMergerObj) {
+		merged_svc, err := r.ensureMergedService(ctx, svcMergerObj, state, mergedServicePorts(svcMergerObj, ports), &repairs)
+		if err != nil {
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
 		}
-		port_no := 89 + int32(len(merged_service_exists))
-		merged_svc.Spec.Ports = []corev1.ServicePort{
-			{
-				Name:       "merged-service-port",
-				Port:       port_no,
-				Protocol:   corev1.ProtocolTCP,
-				TargetPort: intstr.FromInt(8080),
-			},
+		if err := r.repairDrift(ctx, svcMergerObj, state, merged, recreated, member_specs, &repairs); err != nil {
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
 		}
-		finalizer := "finalizer.newproj.controller.proj/" + name
-		merged_svc.Finalizers = append(merged_svc.Finalizers, finalizer)
-		err = r.Create(ctx, merged_svc)
+		shares_changed, err := r.syncMergedEndpoints(ctx, svcMergerObj, state, services, member_specs, ports)
 		if err != nil {
-			l.Error(err, "not able to create new merge service")
-			return ctrl.Result{}, err
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
 		}
-		// Deleting all the services from the services array
-		for _, svc := range services {
-			service := &corev1.Service{}
-			err = r.Get(ctx, types.NamespacedName{
-				Name:      svc,
-				Namespace: req.Namespace,
-			}, service)
-			if err != nil {
-				l.Error(err, "not able to fetch service", "service", service)
-				return ctrl.Result{}, err
+		if err := r.syncAliases(ctx, svcMergerObj, state, merged); err != nil {
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+		}
+		routes_changed, err := r.syncRouting(ctx, svcMergerObj, services, member_specs)
+		if err != nil {
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+		}
+		proxy_changed, err := r.syncProxy(ctx, svcMergerObj, services, member_specs, ports)
+		if err != nil {
+			return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+		}
+		if len(repairs) > 0 || resolved_changed || selectors_changed || conflicts_changed || snapshots_changed || routes_changed || proxy_changed || shares_changed || mergedPortsChanged(svcMergerObj, ports) || svcMergerObj.Status.ObservedGeneration != svcMergerObj.Generation ||
+			!meta.IsStatusConditionTrue(svcMergerObj.Status.Conditions, newprojv1.ConditionReady) {
+			setDriftCondition(svcMergerObj, repairs)
+			for _, svc := range services {
+				setMemberState(svcMergerObj, svc, newprojv1.MemberMerged, "")
 			}
-			err = r.Delete(ctx, service)
-			if err != nil {
-				l.Error(err, "could not delete service", "service", service)
+			setMergedService(svcMergerObj, merged_svc)
+			setMergedPorts(svcMergerObj, ports)
+			markReady(svcMergerObj, fmt.Sprintf("%d services merged into %s", len(services), name))
+			if err := r.updateStatus(ctx, svcMergerObj); err != nil {
 				return ctrl.Result{}, err
 			}
 		}
-		// Add the merged service to the merged_service_exists map
-		merged_service_exists[name] = true
-		return ctrl.Result{}, nil
-	} else {
-
-		// This gets triggered when the crd is deleted or updated.
-		var services []string // stores the services fetched from the spec of svcmergerobj
-
-		if delete_event == false {
+		return resultFor(svcMergerObj), nil
+	}
 
-			fmt.Println("####################################### UPDATION STARTED ###############################################")
-			l.Info("Svcmergerobj is not deleted. So Reconciler Update.")
-			services = svcMergerObj.Spec.Services
-			new_service_map := make(map[string]int)
-			for _, svc := range services {
-				new_service_map[svc] = 1
+	// Changes of the member list are made by a journaled operation (see runOperation), which is
+	// resumed by the following reconciles until it is done or rolled back
+	if !operationInFlight(svcMergerObj) {
+		if op := svcMergerObj.Status.Operation; op != nil && op.State == newprojv1.OperationRolledBack && op.Generation == svcMergerObj.Generation {
+			l.Info("the last operation was rolled back, waiting for the spec to change")
+			return ctrl.Result{}, nil
+		}
+		op_type, reason := newprojv1.OperationUpdate, reasonUpdating
+		if state.mergedService == nil {
+			op_type, reason = newprojv1.OperationMerge, reasonMerging
+		}
+		for _, svc := range to_add {
+			if err := r.claimService(ctx, svcMergerObj, member_specs[svc]); err != nil {
+				return ctrl.Result{}, r.failMember(ctx, svcMergerObj, svc, err)
 			}
+		}
+		planMerge(svcMergerObj, op_type, to_add, to_delete)
+		for _, svc := range to_delete {
+			setMemberState(svcMergerObj, svc, newprojv1.MemberDetaching, "")
+		}
+		for _, svc := range to_add {
+			setMemberState(svcMergerObj, svc, newprojv1.MemberPending, "")
+		}
+		setPhase(svcMergerObj, newprojv1.PhaseMerging)
+		markProgressing(svcMergerObj, reason, "merging member services")
+		if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-			// Maintain two lists to_delete, to_add
-			var to_delete []string
-			var to_add []string
+	run := &mergeRun{
+		state:       state,
+		services:    services,
+		memberSpecs: member_specs,
+		ports:       ports,
+		merged:      merged,
+		recreated:   recreated,
+		repairs:     repairs,
+	}
+	done, result, err := r.runOperation(ctx, svcMergerObj, run)
+	if !done {
+		return result, err
+	}
+	if svcMergerObj.Status.Operation.Type == newprojv1.OperationDemerge {
+		// members showed up again while the merge was rolled back for lack of them, merge them now
+		return ctrl.Result{Requeue: true}, r.updateStatus(ctx, svcMergerObj)
+	}
+	if keepsMemberServices(svcMergerObj) {
+		// without a cutover the members are merged as soon as the merged service is in place
+		for _, svc := range services {
+			setMemberState(svcMergerObj, svc, newprojv1.MemberMerged, "")
+		}
+	}
 
-			var all_services []string
-			for svc := range cur_mrgd_svcs_map[name] {
-				all_services = append(all_services, svc)
-			}
-			for svc := range new_service_map {
-				all_services = append(all_services, svc)
-			}
+	if _, err := r.syncRouting(ctx, svcMergerObj, services, member_specs); err != nil {
+		return ctrl.Result{}, r.failMember(ctx, svcMergerObj, "", err)
+	}
+	setDriftCondition(svcMergerObj, run.repairs)
+	markReady(svcMergerObj, fmt.Sprintf("%d services merged into %s", len(services), name))
+	if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+		return ctrl.Result{}, err
+	}
+	return resultFor(svcMergerObj), nil
+}
 
-			for _, svc := range all_services {
-				_, is_old := cur_mrgd_svcs_map[name][svc]
-				_, is_new := new_service_map[svc]
-
-				if is_old && is_new {
-					continue
-				} else if is_old {
-					to_delete = append(to_delete, svc)
-				} else {
-					to_add = append(to_add, svc)
-				}
-			}
+// syncMergedEndpoints takes care of the strategy specific part of the merge. The strategies other than Labels
+// make sure no workload still carries the merge label from an earlier Labels merge. With the EndpointSlice
+// strategies it writes the EndpointSlices of the merged service, leaving out what spec.weights asks for, and
+// counts the ready endpoints of every port. The share of every member in the merged service is recorded where
+// the merged service spreads over the member pods; it returns true if a share changed.
+func (r *SvcMergerObjReconciler) syncMergedEndpoints(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState, services []string, member_specs map[string]*corev1.Service, ports []mergedPort) (bool, error) {
+	if relabelsWorkloads(obj) {
+		counts, err := r.readyPodCounts(ctx, obj, state.mergedService, services, member_specs)
+		if err != nil {
+			return false, err
+		}
+		return setMemberShares(obj, services, counts), nil
+	}
+	for _, svc := range state.memberNames() {
+		if err := r.unlabelMemberWorkloads(ctx, obj, state, svc); err != nil {
+			return false, err
+		}
+	}
+	if !useEndpointSlices(obj) {
+		return setMemberShares(obj, services, nil), nil
+	}
+	groups, err := r.buildEndpointGroups(ctx, obj.Namespace, services, member_specs, ports, isolatePorts(obj))
+	if err != nil {
+		return false, err
+	}
+	// with every port going to its own member only, the members don't share anything
+	var counts map[string]int32
+	if !isolatePorts(obj) {
+		counts = weightEndpoints(obj, groups)
+	}
+	countReadyEndpoints(groups, ports)
+	return setMemberShares(obj, services, counts), r.syncEndpointSlices(ctx, state.mergedService, groups)
+}
 
-			fmt.Println("size of to_add is ", len(to_add))
-			fmt.Println("size of to_delete is", len(to_delete))
-
-			// Delete(Liberate) the pods associated with the services in to_delete
-			for _, svc := range to_delete {
-
-				// create a service with the name and labels as temp map
-				var temp = make(map[string]string)
-				temp["name"] = svc
-				new_svc := &corev1.Service{}
-				new_svc.Name = svc
-				new_svc.Namespace = req.Namespace
-				new_svc.Spec.Selector = temp
-				new_svc.Spec.Ports = []corev1.ServicePort{
-					{
-						Name:       "merged-service-port",
-						Port:       svc_port_map[svc], // port number retrieved from the service port map
-						Protocol:   corev1.ProtocolTCP,
-						TargetPort: intstr.FromInt(8080),
-					},
-				}
-				err := r.Create(ctx, new_svc)
-				if err != nil {
-					l.Error(err, "not able to create new service")
-					return ctrl.Result{}, err
-				}
-				// Service is created. But currently there are no pods associated with it. If we remove "merge"="true" label from deployment,
-				// then the pods will be freed. So we need to get the deployment name from the pod name and then remove the label from the deployment
-				// But first we need to get the pod list.
-
-				// Add merge=true label to the temp map. Used to identify the pods that were under this service before merging
-				temp["merge"] = name
-				// Now we need to get all the pods in the cluster with the labels in temp
-				pod_list := &corev1.PodList{}
-				err = r.Client.List(ctx, pod_list, client.InNamespace(req.Namespace), client.MatchingLabels(temp))
-				if err != nil {
-					l.Error(err, "Unable to get pod list from matching labels")
-					return ctrl.Result{}, err
-				}
-				// Now we need to get the deployment name from the pod name and then remove the label from the deployment
-				deployment_map := make(map[string]bool)
-				for _, pod := range pod_list.Items {
-					deployment_name, err := r.getDeploymentName(ctx, req, &pod)
-					if err != nil {
-						l.Error(err, "not able to get deployment name")
-						return ctrl.Result{}, err
-					}
-					if deployment_map[deployment_name] == false {
-
-						deployment_obj := &appsv1.Deployment{}
-						err = r.Get(ctx, types.NamespacedName{
-							Name:      deployment_name,
-							Namespace: req.Namespace,
-						}, deployment_obj)
-						if err != nil {
-							l.Error(err, "not able to fetch deployment")
-							return ctrl.Result{}, err
-						}
-						pod_template_labels := deployment_obj.Spec.Template.Labels
-						delete(pod_template_labels, "merge")
-						deployment_obj.Spec.Template.SetLabels(pod_template_labels)
-						err = r.Update(ctx, deployment_obj)
-						if err != nil {
-							l.Error(err, "not able to delete label from deployment")
-							return ctrl.Result{}, err
-						}
-
-						deployment_map[deployment_name] = true
-					}
-				}
-
-				// Delete the svc from cur_mrgd_svcs_map and svc_port_map
-				delete(cur_mrgd_svcs_map[name], svc)
-				delete(svc_port_map, svc)
+// resultFor returns the result of a successful reconcile. EndpointSlices, of the merged Service or of
+// Endpoints aliases, are rebuilt periodically as they follow the pods, and HTTPRoutes are checked until
+// they are accepted.
+func resultFor(obj *newprojv1.SvcMergerObj) ctrl.Result {
+	if useEndpointSlices(obj) || aliasType(obj) == newprojv1.AliasEndpoints {
+		return ctrl.Result{RequeueAfter: endpointSliceResync}
+	}
+	if routeWaiting(obj) {
+		return ctrl.Result{RequeueAfter: routePollInterval}
+	}
+	if meta.IsStatusConditionTrue(obj.Status.Conditions, newprojv1.ConditionConflict) {
+		return ctrl.Result{RequeueAfter: claimPollInterval}
+	}
+	return ctrl.Result{}
+}
 
-			}
+// reconcileDelete rolls back the merge when the SvcMergerObj is deleted and then releases its finalizer
+func (r *SvcMergerObjReconciler) reconcileDelete(ctx context.Context, svcMergerObj *newprojv1.SvcMergerObj, state *mergeState) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
 
-			// Add the pods associated with the services in to_add to the merged service by adding the labels to the deployment
-			for _, svc := range to_add {
-
-				svc_obj := &corev1.Service{}
-				err := r.Get(ctx, types.NamespacedName{
-					Name:      svc,
-					Namespace: req.Namespace,
-				}, svc_obj)
-				if err != nil {
-					l.Error(err, "unable to fetch service")
-					return ctrl.Result{}, err
-				}
-				// Add the service name and labels to the cur_mrgd_svcs_map
-				cur_mrgd_svcs_map[name][svc] = 1
-				svc_port_map[svc] = svc_obj.Spec.Ports[0].Port
-
-				pod_list := &corev1.PodList{}
-				err = r.Client.List(ctx, pod_list, client.InNamespace(req.Namespace), client.MatchingLabels(svc_obj.Spec.Selector))
-				if err != nil {
-					l.Error(err, "Unable to get pod list from matching labels")
-					return ctrl.Result{}, err
-				}
-				// Now we need to get the deployment name from the pod name and then add the label to the deployment
-				deployment_map := make(map[string]bool)
-				for _, pod := range pod_list.Items {
-					deployment_name, err := r.getDeploymentName(ctx, req, &pod)
-					if err != nil {
-						l.Error(err, "not able to get deployment name")
-						return ctrl.Result{}, err
-					}
-					if deployment_map[deployment_name] == false {
-
-						deployment_obj := &appsv1.Deployment{}
-						err = r.Get(ctx, types.NamespacedName{
-							Name:      deployment_name,
-							Namespace: req.Namespace,
-						}, deployment_obj)
-						if err != nil {
-							l.Error(err, "not able to fetch deployment")
-							return ctrl.Result{}, err
-						}
-						pod_template_labels := deployment_obj.Spec.Template.Labels
-						pod_template_labels["merge"] = name
-						pod_template_labels["name"] = svc
-						deployment_obj.Spec.Template.SetLabels(pod_template_labels)
-						err = r.Update(ctx, deployment_obj)
-						if err != nil {
-							l.Error(err, "not able to delete label from deployment")
-							return ctrl.Result{}, err
-						}
-						deployment_map[deployment_name] = true
-					}
-				}
-			}
+	l.Info("Reconciler called for deletion of CRD")
+	// A demerge of an earlier generation was made when the spec resolved to no member, it is planned again
+	if op := svcMergerObj.Status.Operation; op == nil || op.Type != newprojv1.OperationDemerge || op.Generation != svcMergerObj.Generation {
+		members := state.memberNames()
+		planDemerge(svcMergerObj, members)
+		for _, svc := range members {
+			setMemberState(svcMergerObj, svc, newprojv1.MemberDetaching, "")
+		}
+		setPhase(svcMergerObj, newprojv1.PhaseDemerging)
+		markProgressing(svcMergerObj, reasonDemerging, "rolling back the merge")
+		if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-			time.Sleep(20 * time.Second) // sleep for some time to give time for the pods to restart
-			// Now update the merged_pods array.
-			merged_pods[name] = []string{}
-			// merged pods can be found in the client list with matching label as merge=true
-			merged_pod_list := &corev1.PodList{}
-			err := r.Client.List(ctx, merged_pod_list, client.InNamespace(req.Namespace), client.MatchingLabels(map[string]string{"merge": name}))
-			if err != nil {
-				l.Error(err, "Unable to get pod list from matching labels")
-				return ctrl.Result{}, err
-			}
-			for _, pod := range merged_pod_list.Items {
-				merged_pods[name] = append(merged_pods[name], pod.Name)
-			}
+	//We need to roll back the merge operation
+	done, result, err := r.runOperation(ctx, svcMergerObj, &mergeRun{state: state})
+	if !done {
+		return result, err
+	}
 
-			// Now delete the services from the to_add list
-			for _, svc := range to_add {
-				service := &corev1.Service{}
-				err = r.Get(ctx, types.NamespacedName{
-					Name:      svc,
-					Namespace: req.Namespace,
-				}, service)
-				if err != nil {
-					l.Error(err, "not able to fetch service", "service", service)
-					return ctrl.Result{}, err
-				}
-				err = r.Delete(ctx, service)
-				if err != nil {
-					l.Error(err, "could not delete service", "service", service)
-					return ctrl.Result{}, err
-				}
-			}
+	// Rollback is complete, the object can go away now. Listed services that never got merged may still carry its claim
+	for _, svc := range svcMergerObj.MemberServices() {
+		if err := r.releaseClaim(ctx, svcMergerObj, svc); err != nil {
 			return ctrl.Result{}, err
-		} else {
-
-			fmt.Println("######################################### DELETION STARTED ###############################################")
-
-			l.Info("Reconciler called for deletion of CRD")
-			//We need to roll back the merge operation
-			l.Info("Deleting the merged service.......")
-
-			deployment_map := make(map[string]bool)
-			for _, pod := range merged_pods[name] {
-
-				pod_obj := &corev1.Pod{}
-				err := r.Get(ctx, types.NamespacedName{
-					Name:      pod,
-					Namespace: req.Namespace,
-				}, pod_obj)
-				if err != nil {
-					l.Info("It's coming to error", "pod", pod)
-					continue
-				}
-
-				deployment_name, err := r.getDeploymentName(ctx, req, pod_obj)
-				if err != nil {
-					l.Error(err, "not able to get deployment name -- while rolling back")
-					return ctrl.Result{}, err
-				}
-
-				fmt.Println("Deployment is ", deployment_name)
-				if deployment_map[deployment_name] == false {
-
-					deployment_obj := &appsv1.Deployment{}
-					err = r.Get(ctx, types.NamespacedName{
-						Name:      deployment_name,
-						Namespace: req.Namespace,
-					}, deployment_obj)
-					if err != nil {
-						l.Error(err, "not able to fetch deployment -- while rolling back")
-						return ctrl.Result{}, err
-					}
-					pod_template_labels := deployment_obj.Spec.Template.Labels
-					delete(pod_template_labels, "merge")
-					deployment_obj.Spec.Template.SetLabels(pod_template_labels)
-					err = r.Update(ctx, deployment_obj)
-					if err != nil {
-						l.Error(err, "not able to delete label from deployment -- while rolling back")
-						return ctrl.Result{}, err
-					}
-
-					deployment_map[deployment_name] = true
-				}
+		}
+	}
+	svcMergerObj.Status.MergedService = nil
+	if err := r.updateStatus(ctx, svcMergerObj); err != nil {
+		return ctrl.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(svcMergerObj, r.Keys.Finalizer)
+	controllerutil.RemoveFinalizer(svcMergerObj, legacyKeys.Finalizer)
+	if err := r.Update(ctx, svcMergerObj); err != nil {
+		l.Info("error in removing finalizer")
+		return ctrl.Result{}, err
+	}
+	if r.Ports != nil {
+		r.Ports.release(types.NamespacedName{Name: svcMergerObj.Name, Namespace: svcMergerObj.Namespace})
+	}
+	return ctrl.Result{}, nil
+}
 
-			}
-			// Merge is rolled back. Delete merged svc & create old svc
-			merged_svc_obj := &corev1.Service{}
-			err := r.Get(ctx, types.NamespacedName{
-				Name:      name,
-				Namespace: req.Namespace,
-			}, merged_svc_obj)
-			if err != nil {
-				l.Error(err, "Could not fetch merged svc for deletion -- while rolling back")
-				return ctrl.Result{}, err
-			}
-			// Before deleting, delete the finalizer from merged service object.
-			finalizer := "finalizer.newproj.controller.proj/" + name
-			controllerutil.RemoveFinalizer(merged_svc_obj, finalizer)
-			if err := r.Update(ctx, merged_svc_obj); err != nil {
-				l.Info("error in removing finalizer from merged service")
-				return ctrl.Result{}, err
-			}
-			err = r.Delete(ctx, merged_svc_obj)
-			// Now create the old svc's
-			for svc_name := range cur_mrgd_svcs_map[name] {
-
-				var temp = make(map[string]string)
-				temp["name"] = svc_name
-
-				svc_obj := &corev1.Service{}
-				svc_obj.Name = svc_name
-				svc_obj.Namespace = req.Namespace
-				svc_obj.Spec.Selector = temp
-				svc_obj.Spec.Ports = []corev1.ServicePort{
-					{
-						Name:       "merged-service-port",
-						Port:       svc_port_map[svc_name], // port number retrieved from the service port map
-						Protocol:   corev1.ProtocolTCP,
-						TargetPort: intstr.FromInt(8080),
-					},
-				}
-				err = r.Create(ctx, svc_obj)
-				if err != nil {
-					l.Error(err, "Could not recreate old svc -- while rolling back")
-					return ctrl.Result{}, err
-				}
-			}
-			delete(merged_service_exists, name)
-			delete(merged_pods, name)
-			// delete all the svcs from svc_port_map which are in cur_mrgd_svcs_map[name]
-			for svc_name := range cur_mrgd_svcs_map[name] {
-				delete(svc_port_map, svc_name)
-			}
-			delete(cur_mrgd_svcs_map, name)
+// deleteMergedService releases the finalizer of the merged service and deletes it
+func (r *SvcMergerObjReconciler) deleteMergedService(ctx context.Context, obj *newprojv1.SvcMergerObj, state *mergeState) error {
+	if state.mergedService == nil {
+		return nil
+	}
+	if err := r.releaseAndDelete(ctx, obj, state.mergedService); err != nil {
+		return err
+	}
+	state.mergedService = nil
+	return nil
+}
 
-			return ctrl.Result{}, nil
+// releaseAndDelete removes the finalizer of the SvcMergerObj from a merged service and deletes it
+func (r *SvcMergerObjReconciler) releaseAndDelete(ctx context.Context, obj *newprojv1.SvcMergerObj, merged_svc_obj *corev1.Service) error {
+	l := log.FromContext(ctx)
+	l.Info("Deleting the merged service.......", "service", merged_svc_obj.Name)
+	// Before deleting, delete the finalizer from merged service object.
+	if controllerutil.RemoveFinalizer(merged_svc_obj, r.Keys.mergedServiceFinalizerFor(obj.Name)) {
+		if err := r.Update(ctx, merged_svc_obj); client.IgnoreNotFound(err) != nil {
+			l.Info("error in removing finalizer from merged service")
+			return err
 		}
 	}
+	if err := r.Delete(ctx, merged_svc_obj); client.IgnoreNotFound(err) != nil {
+		l.Error(err, "Could not delete merged svc -- while rolling back")
+		return err
+	}
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// Besides the SvcMergerObjs themselves, the member and merged Services, the member workloads and their pods
+// are watched, so that scaling, rollouts, deleted Services and hand edited labels trigger a reconcile of
+// the SvcMergerObj they belong to. Status writes of the controller itself don't change the generation and
+// are filtered out.
 func (r *SvcMergerObjReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&newprojv1.SvcMergerObj{}).
-		Complete(r)
+	if r.Keys == (Keys{}) {
+		r.Keys = NewKeys(DefaultKeyDomain)
+	}
+	if r.ClusterDomain == "" {
+		r.ClusterDomain = DefaultClusterDomain
+	}
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &newprojv1.SvcMergerObj{}, servicesIndexKey, indexServices)
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &newprojv1.SvcMergerObj{}, memberSelectorsIndexKey, indexMemberSelectors)
+	if err != nil {
+		return err
+	}
+	for _, kind := range workloadKinds() {
+		resolver := workloadResolvers[kind]
+		err := mgr.GetFieldIndexer().IndexField(context.Background(), resolver.newObject(), mergedWorkloadsIndexKey, r.indexMergedWorkloads(resolver))
+		if err != nil {
+			return err
+		}
+	}
+
+	controller_builder := ctrl.NewControllerManagedBy(mgr).
+		For(&newprojv1.SvcMergerObj{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&appsv1.Deployment{}).
+		Watches(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.mapService)).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.mapPod), builder.WithPredicates(podChangedPredicate))
+	for _, kind := range workloadKinds() {
+		if kind == "Pod" {
+			continue
+		}
+		resolver := workloadResolvers[kind]
+		controller_builder = controller_builder.Watches(resolver.newObject(), handler.EnqueueRequestsFromMapFunc(r.mapWorkload(resolver)))
+	}
+	return controller_builder.Complete(r)
 }
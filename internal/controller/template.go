@@ -0,0 +1,156 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// appliedTemplate is kept as JSON in the applied template annotation of the merged Service. It lists the
+// label and annotation keys set from the service template, so that keys removed from the template can be
+// removed from the Service without touching the ones other controllers set.
+type appliedTemplate struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// liveMergedServiceName returns the name the merged Service was last created under, which differs from
+// MergedServiceName while a new name from the service template is being rolled out
+func liveMergedServiceName(obj *newprojv1.SvcMergerObj) string {
+	if obj.Status.MergedService != nil && obj.Status.MergedService.Name != "" {
+		return obj.Status.MergedService.Name
+	}
+	return obj.MergedServiceName()
+}
+
+// applyTemplateMap sets the template entries on a label or annotation map and removes the entries an earlier
+// template set that are gone from the template. It returns the map and the keys now set from the template.
+func applyTemplateMap(current map[string]string, template map[string]string, applied []string) (map[string]string, []string) {
+	for _, key := range applied {
+		if _, ok := template[key]; !ok {
+			delete(current, key)
+		}
+	}
+	var keys []string
+	for key, value := range template {
+		if current == nil {
+			current = make(map[string]string)
+		}
+		current[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return current, keys
+}
+
+// applyServiceTemplate brings the merged Service in line with the service template of the SvcMergerObj and
+// reports whether anything changed. Spec fields the template leaves empty get the Kubernetes default, or
+// keep what the API server filled in for fields it defaults itself. The keys written by the controller
+// are set after the template, so the template can't override them.
+func (k Keys) applyServiceTemplate(merged_svc *corev1.Service, template *newprojv1.ServiceTemplate) bool {
+	if template == nil {
+		template = &newprojv1.ServiceTemplate{}
+	}
+	before := merged_svc.DeepCopy()
+
+	applied := appliedTemplate{}
+	if raw, ok := merged_svc.Annotations[k.AppliedTemplate]; ok {
+		// a broken record only means removed keys are not cleaned up
+		_ = json.Unmarshal([]byte(raw), &applied)
+	}
+	merged_svc.Labels, applied.Labels = applyTemplateMap(merged_svc.Labels, template.Metadata.Labels, applied.Labels)
+	merged_svc.Annotations, applied.Annotations = applyTemplateMap(merged_svc.Annotations, template.Metadata.Annotations, applied.Annotations)
+	if len(applied.Labels) > 0 || len(applied.Annotations) > 0 {
+		raw, _ := json.Marshal(applied)
+		if merged_svc.Annotations == nil {
+			merged_svc.Annotations = make(map[string]string)
+		}
+		merged_svc.Annotations[k.AppliedTemplate] = string(raw)
+	} else {
+		delete(merged_svc.Annotations, k.AppliedTemplate)
+	}
+
+	spec := &template.Spec
+	service_spec := &merged_svc.Spec
+	service_spec.Type = spec.Type
+	if service_spec.Type == "" {
+		service_spec.Type = corev1.ServiceTypeClusterIP
+	}
+	service_spec.SessionAffinity = spec.SessionAffinity
+	if service_spec.SessionAffinity == "" {
+		service_spec.SessionAffinity = corev1.ServiceAffinityNone
+	}
+	if spec.SessionAffinityConfig != nil || service_spec.SessionAffinity == corev1.ServiceAffinityNone {
+		service_spec.SessionAffinityConfig = spec.SessionAffinityConfig
+	}
+	if spec.ExternalTrafficPolicy != "" {
+		service_spec.ExternalTrafficPolicy = spec.ExternalTrafficPolicy
+	} else if service_spec.Type == corev1.ServiceTypeClusterIP {
+		service_spec.ExternalTrafficPolicy = ""
+	}
+	if spec.InternalTrafficPolicy != nil {
+		service_spec.InternalTrafficPolicy = spec.InternalTrafficPolicy
+	}
+	if spec.IPFamilyPolicy != nil {
+		service_spec.IPFamilyPolicy = spec.IPFamilyPolicy
+	}
+	if len(spec.IPFamilies) > 0 {
+		service_spec.IPFamilies = spec.IPFamilies
+	}
+	if spec.LoadBalancerClass != nil {
+		service_spec.LoadBalancerClass = spec.LoadBalancerClass
+	}
+	service_spec.LoadBalancerSourceRanges = spec.LoadBalancerSourceRanges
+	if spec.AllocateLoadBalancerNodePorts != nil {
+		service_spec.AllocateLoadBalancerNodePorts = spec.AllocateLoadBalancerNodePorts
+	} else if service_spec.Type != corev1.ServiceTypeLoadBalancer {
+		service_spec.AllocateLoadBalancerNodePorts = nil
+	}
+	if service_spec.Type != corev1.ServiceTypeLoadBalancer || service_spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal {
+		service_spec.HealthCheckNodePort = 0
+	}
+	if service_spec.Type == corev1.ServiceTypeClusterIP {
+		for i := range service_spec.Ports {
+			service_spec.Ports[i].NodePort = 0
+		}
+	}
+
+	return !reflect.DeepEqual(before.Labels, merged_svc.Labels) ||
+		!reflect.DeepEqual(before.Annotations, merged_svc.Annotations) ||
+		!reflect.DeepEqual(before.Spec, merged_svc.Spec)
+}
+
+// keepNodePorts carries the node ports the API server allocated over to the desired ports, so that updating
+// the ports of a NodePort or LoadBalancer merged Service doesn't move them
+func keepNodePorts(desired []corev1.ServicePort, live []corev1.ServicePort) []corev1.ServicePort {
+	node_ports := make(map[string]int32)
+	for _, port := range live {
+		node_ports[port.Name] = port.NodePort
+	}
+	ports := make([]corev1.ServicePort, len(desired))
+	for i, port := range desired {
+		port.NodePort = node_ports[port.Name]
+		ports[i] = port
+	}
+	return ports
+}
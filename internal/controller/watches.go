@@ -0,0 +1,181 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// servicesIndexKey indexes SvcMergerObjs by the names of their member Services, listed or last resolved from the selector
+const servicesIndexKey = ".spec.services"
+
+// indexServices is the indexer function for servicesIndexKey
+func indexServices(obj client.Object) []string {
+	return obj.(*newprojv1.SvcMergerObj).MemberServices()
+}
+
+// memberSelectorsIndexKey indexes SvcMergerObjs by the key=value pairs of the pod selectors of their members
+const memberSelectorsIndexKey = ".status.members.selector"
+
+// indexMemberSelectors is the indexer function for memberSelectorsIndexKey
+func indexMemberSelectors(obj client.Object) []string {
+	var pairs []string
+	for _, member := range obj.(*newprojv1.SvcMergerObj).Status.Members {
+		for key, value := range member.Selector {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return pairs
+}
+
+// podChangedPredicate lets through the pod updates that change what the merge sees of a pod: its labels,
+// phase, IP, readiness or deletion
+var podChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old_pod, ok_old := e.ObjectOld.(*corev1.Pod)
+		new_pod, ok_new := e.ObjectNew.(*corev1.Pod)
+		if !ok_old || !ok_new {
+			return true
+		}
+		return !reflect.DeepEqual(old_pod.Labels, new_pod.Labels) ||
+			old_pod.Status.Phase != new_pod.Status.Phase ||
+			old_pod.Status.PodIP != new_pod.Status.PodIP ||
+			podReady(old_pod) != podReady(new_pod) ||
+			old_pod.DeletionTimestamp.IsZero() != new_pod.DeletionTimestamp.IsZero()
+	},
+}
+
+// requestsFor builds a deduplicated list of reconcile requests for the named SvcMergerObjs of a namespace
+func requestsFor(namespace string, names ...string) []reconcile.Request {
+	seen := make(map[string]bool)
+	var requests []reconcile.Request
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}})
+	}
+	return requests
+}
+
+// mergersOfService returns the names of the SvcMergerObjs that list the service as a member
+func (r *SvcMergerObjReconciler) mergersOfService(ctx context.Context, namespace string, svc string) []string {
+	l := log.FromContext(ctx)
+	merger_list := &newprojv1.SvcMergerObjList{}
+	err := r.List(ctx, merger_list, client.InNamespace(namespace), client.MatchingFields{servicesIndexKey: svc})
+	if err != nil {
+		l.Error(err, "not able to list svcmergerobjs of service", "service", svc)
+		return nil
+	}
+	var names []string
+	for _, merger := range merger_list.Items {
+		names = append(names, merger.Name)
+	}
+	return names
+}
+
+// mergersSelecting returns the names of the SvcMergerObjs whose service selector matches the labels
+func (r *SvcMergerObjReconciler) mergersSelecting(ctx context.Context, namespace string, service_labels map[string]string) []string {
+	l := log.FromContext(ctx)
+	merger_list := &newprojv1.SvcMergerObjList{}
+	if err := r.List(ctx, merger_list, client.InNamespace(namespace)); err != nil {
+		l.Error(err, "not able to list svcmergerobjs")
+		return nil
+	}
+	var names []string
+	for _, merger := range merger_list.Items {
+		if merger.Spec.ServiceSelector == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(merger.Spec.ServiceSelector)
+		if err == nil && selector.Matches(labels.Set(service_labels)) {
+			names = append(names, merger.Name)
+		}
+	}
+	return names
+}
+
+// mapService enqueues the SvcMergerObj a merged Service belongs to, every SvcMergerObj that has the Service
+// as a member and every SvcMergerObj whose selector matches it, e.g. when a member Service is recreated by
+// hand, the merged Service is deleted or a Service is labeled to join a merge. Updates are mapped for the
+// old and the new object, so a Service whose labels no longer match is noticed as well.
+func (r *SvcMergerObjReconciler) mapService(ctx context.Context, obj client.Object) []reconcile.Request {
+	names := r.mergersOfService(ctx, obj.GetNamespace(), obj.GetName())
+	names = append(names, r.mergersSelecting(ctx, obj.GetNamespace(), obj.GetLabels())...)
+	names = append(names, obj.GetLabels()[r.Keys.MergedBy])
+	return requestsFor(obj.GetNamespace(), names...)
+}
+
+// mapWorkload returns the map function for one kind of workload. It enqueues the SvcMergerObj the workload
+// takes part in, found through its annotations or the merge label on its pod template. This catches
+// scaling, rollouts and hand edits of the labels.
+func (r *SvcMergerObjReconciler) mapWorkload(resolver workloadResolver) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		names := []string{obj.GetAnnotations()[r.Keys.MergedBy]}
+		if template := resolver.podTemplate(obj); template != nil {
+			names = append(names, template.Labels[r.Keys.Group])
+		}
+		return requestsFor(obj.GetNamespace(), names...)
+	}
+}
+
+// mapPod enqueues the SvcMergerObj a pod is merged into, and every SvcMergerObj with a member that selects
+// the pod, so that new, deleted and relabeled pods are noticed. The members are found through the selectors
+// recorded in the status, one index lookup per pod label.
+func (r *SvcMergerObjReconciler) mapPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	l := log.FromContext(ctx)
+	names := []string{obj.GetLabels()[r.Keys.Group], obj.GetAnnotations()[r.Keys.MergedBy]}
+
+	pod_labels := labels.Set(obj.GetLabels())
+	seen := make(map[string]bool)
+	for key, value := range pod_labels {
+		merger_list := &newprojv1.SvcMergerObjList{}
+		err := r.List(ctx, merger_list, client.InNamespace(obj.GetNamespace()), client.MatchingFields{memberSelectorsIndexKey: key + "=" + value})
+		if err != nil {
+			l.Error(err, "not able to list svcmergerobjs selecting pod", "pod", obj.GetName())
+			continue
+		}
+		for _, merger := range merger_list.Items {
+			if seen[merger.Name] {
+				continue
+			}
+			seen[merger.Name] = true
+			for _, member := range merger.Status.Members {
+				if len(member.Selector) > 0 && labels.SelectorFromSet(member.Selector).Matches(pod_labels) {
+					names = append(names, merger.Name)
+					break
+				}
+			}
+		}
+	}
+	return requestsFor(obj.GetNamespace(), names...)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// defaultMemberWeight is the weight of the members spec.weights leaves out
+const defaultMemberWeight = 1
+
+// weighted tells whether the spec shares the traffic out by weight instead of by ready pods
+func weighted(obj *newprojv1.SvcMergerObj) bool {
+	return len(obj.Spec.Weights) > 0
+}
+
+// memberWeight returns the weight of a member
+func memberWeight(obj *newprojv1.SvcMergerObj, svc string) int32 {
+	for _, weight := range obj.Spec.Weights {
+		if weight.Service == svc {
+			return weight.Weight
+		}
+	}
+	return defaultMemberWeight
+}
+
+// weightedOut tells whether spec.weights leaves the member without endpoints in the merged Service
+func weightedOut(obj *newprojv1.SvcMergerObj, svc string) bool {
+	return useEndpointSlices(obj) && !isolatePorts(obj) && memberWeight(obj, svc) == 0
+}
+
+// endpointReady tells whether the endpoint is ready; a missing ready condition means ready
+func endpointReady(endpoint *discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// weightEndpoints drops endpoints from the groups so that the ready endpoints of every member are in
+// proportion to its weight; kube-proxy spreads the connections evenly over the ready endpoints, so the
+// members get their share of the traffic. As many endpoints as possible are kept: the member with the fewest
+// ready pods for its weight keeps all of them, the others keep the first ones by pod name. A member with a
+// weight keeps at least as many as the cutover waits for, even if that bends the ratio. Not ready endpoints
+// of the members that were cut down are dropped too, they would bend the ratio once they turn ready. It
+// returns the number of ready endpoints kept per member.
+func weightEndpoints(obj *newprojv1.SvcMergerObj, groups map[string]*endpointGroup) map[string]int32 {
+	ready := make(map[string][]string)
+	for _, group := range groups {
+		for i := range group.endpoints {
+			endpoint := &group.endpoints[i]
+			if endpointReady(endpoint) {
+				svc := group.members[endpoint.TargetRef.Name]
+				ready[svc] = append(ready[svc], endpoint.TargetRef.Name)
+			}
+		}
+	}
+	counts := make(map[string]int32)
+	if !weighted(obj) {
+		for svc, pods := range ready {
+			counts[svc] = int32(len(pods))
+		}
+		return counts
+	}
+
+	// pods per unit of weight that every member can serve
+	scale := math.Inf(1)
+	for svc, pods := range ready {
+		if weight := memberWeight(obj, svc); weight > 0 {
+			scale = math.Min(scale, float64(len(pods))/float64(weight))
+		}
+	}
+	kept := make(map[string]bool)
+	for svc, pods := range ready {
+		weight := memberWeight(obj, svc)
+		keep := 0
+		if weight > 0 {
+			keep = int(math.Floor(scale*float64(weight) + 1e-9))
+			if min_ready := int(minReadyEndpoints(obj)); keep < min_ready {
+				keep = min_ready
+			}
+			if keep > len(pods) {
+				keep = len(pods)
+			}
+		}
+		sort.Strings(pods)
+		for _, pod := range pods[:keep] {
+			kept[pod] = true
+		}
+		counts[svc] = int32(keep)
+	}
+
+	for key, group := range groups {
+		endpoints := group.endpoints[:0]
+		for _, endpoint := range group.endpoints {
+			svc := group.members[endpoint.TargetRef.Name]
+			if kept[endpoint.TargetRef.Name] || (memberWeight(obj, svc) > 0 && int(counts[svc]) == len(ready[svc]) && !endpointReady(&endpoint)) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		group.endpoints = endpoints
+		if len(endpoints) == 0 {
+			delete(groups, key)
+		}
+	}
+	return counts
+}
+
+// readyPodCounts counts the ready endpoints of the merged Service that belong to each member, for the
+// strategies where the merged Service selects the member pods itself
+func (r *SvcMergerObjReconciler) readyPodCounts(ctx context.Context, obj *newprojv1.SvcMergerObj, merged_svc *corev1.Service, services []string, member_specs map[string]*corev1.Service) (map[string]int32, error) {
+	counts := make(map[string]int32)
+	if merged_svc == nil {
+		return counts, nil
+	}
+	ready_pods, err := r.readyEndpointPods(ctx, merged_svc)
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range services {
+		spec, ok := member_specs[svc]
+		if !ok {
+			continue
+		}
+		pods, err := r.getMemberPods(ctx, obj, svc, spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods {
+			if ready_pods[pod.Name] {
+				counts[svc]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// setMemberShares records the share of the ready endpoints every member has, from the given counts; nil
+// counts clear the shares. It returns true if any share changed.
+func setMemberShares(obj *newprojv1.SvcMergerObj, services []string, counts map[string]int32) bool {
+	percents := sharePercents(services, counts)
+	changed := false
+	for _, svc := range services {
+		var share *int32
+		if counts != nil {
+			percent := percents[svc]
+			share = &percent
+		}
+		member := memberStatus(obj, svc)
+		if (member.SharePercent == nil) != (share == nil) || (share != nil && *member.SharePercent != *share) {
+			member.SharePercent = share
+			changed = true
+		}
+	}
+	return changed
+}
+
+// sharePercents splits 100 percent over the members in proportion to the counts, so that the shares add up to
+// 100: every member gets its share rounded down, the percents left go to the largest remainders, earlier
+// members first. Without any count every share is 0.
+func sharePercents(services []string, counts map[string]int32) map[string]int32 {
+	percents := make(map[string]int32)
+	total := int64(0)
+	for _, svc := range services {
+		total += int64(counts[svc])
+	}
+	if total == 0 {
+		return percents
+	}
+	left := int64(100)
+	remainders := make(map[string]int64)
+	for _, svc := range services {
+		percents[svc] = int32(int64(counts[svc]) * 100 / total)
+		remainders[svc] = int64(counts[svc]) * 100 % total
+		left -= int64(percents[svc])
+	}
+	order := append([]string(nil), services...)
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for _, svc := range order[:left] {
+		percents[svc]++
+	}
+	return percents
+}
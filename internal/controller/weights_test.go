@@ -0,0 +1,223 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// testGroups builds one endpoint group per member with a pod per readiness given, named <member>-<index>
+func testGroups(readiness map[string][]bool) map[string]*endpointGroup {
+	groups := make(map[string]*endpointGroup)
+	for svc, pods := range readiness {
+		group := &endpointGroup{addressType: discoveryv1.AddressTypeIPv4, members: make(map[string]string)}
+		for i, ready := range pods {
+			name := fmt.Sprintf("%s-%d", svc, i)
+			ready := ready
+			group.endpoints = append(group.endpoints, discoveryv1.Endpoint{
+				Addresses:  []string{fmt.Sprintf("10.0.0.%d", i)},
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: name},
+			})
+			group.members[name] = svc
+		}
+		groups[svc] = group
+	}
+	return groups
+}
+
+// keptPods lists the pods left in the groups, per member
+func keptPods(groups map[string]*endpointGroup) map[string][]string {
+	kept := make(map[string][]string)
+	for _, group := range groups {
+		for _, endpoint := range group.endpoints {
+			svc := group.members[endpoint.TargetRef.Name]
+			kept[svc] = append(kept[svc], endpoint.TargetRef.Name)
+		}
+	}
+	for _, pods := range kept {
+		sort.Strings(pods)
+	}
+	return kept
+}
+
+func TestWeightEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []newprojv1.MemberWeight
+		cutover   *newprojv1.CutoverSpec
+		readiness map[string][]bool
+		counts    map[string]int32
+		kept      map[string][]string
+	}{
+		{
+			name:      "without weights every endpoint is kept",
+			readiness: map[string][]bool{"web-1": {true, true, false}, "web-2": {true}},
+			counts:    map[string]int32{"web-1": 2, "web-2": 1},
+			kept:      map[string][]string{"web-1": {"web-1-0", "web-1-1", "web-1-2"}, "web-2": {"web-2-0"}},
+		},
+		{
+			name:      "endpoints in proportion to the weights",
+			weights:   []newprojv1.MemberWeight{{Service: "web-1", Weight: 3}, {Service: "web-2", Weight: 1}},
+			readiness: map[string][]bool{"web-1": {true, true, true, true, true, true}, "web-2": {true, true, true, true, true, true}},
+			counts:    map[string]int32{"web-1": 6, "web-2": 2},
+			kept: map[string][]string{
+				"web-1": {"web-1-0", "web-1-1", "web-1-2", "web-1-3", "web-1-4", "web-1-5"},
+				"web-2": {"web-2-0", "web-2-1"},
+			},
+		},
+		{
+			name:      "members left out of the weights weigh 1",
+			weights:   []newprojv1.MemberWeight{{Service: "web-1", Weight: 2}},
+			readiness: map[string][]bool{"web-1": {true, true}, "web-2": {true, true, true}},
+			counts:    map[string]int32{"web-1": 2, "web-2": 1},
+			kept:      map[string][]string{"web-1": {"web-1-0", "web-1-1"}, "web-2": {"web-2-0"}},
+		},
+		{
+			name:      "a zero weight member gets no endpoints",
+			weights:   []newprojv1.MemberWeight{{Service: "web-1", Weight: 1}, {Service: "web-2", Weight: 0}},
+			readiness: map[string][]bool{"web-1": {true, true}, "web-2": {true, true, false}},
+			counts:    map[string]int32{"web-1": 2, "web-2": 0},
+			kept:      map[string][]string{"web-1": {"web-1-0", "web-1-1"}},
+		},
+		{
+			name:      "the ready endpoints the cutover waits for bend the ratio",
+			weights:   []newprojv1.MemberWeight{{Service: "web-1", Weight: 10}, {Service: "web-2", Weight: 1}},
+			cutover:   &newprojv1.CutoverSpec{MinReadyEndpoints: 2},
+			readiness: map[string][]bool{"web-1": {true, true}, "web-2": {true, true, true, true}},
+			counts:    map[string]int32{"web-1": 2, "web-2": 2},
+			kept:      map[string][]string{"web-1": {"web-1-0", "web-1-1"}, "web-2": {"web-2-0", "web-2-1"}},
+		},
+		{
+			name:      "not ready endpoints are only kept by members that were not cut down",
+			weights:   []newprojv1.MemberWeight{{Service: "web-1", Weight: 1}, {Service: "web-2", Weight: 1}},
+			readiness: map[string][]bool{"web-1": {true, true, false}, "web-2": {true, true, true, true, false}},
+			counts:    map[string]int32{"web-1": 2, "web-2": 2},
+			kept:      map[string][]string{"web-1": {"web-1-0", "web-1-1", "web-1-2"}, "web-2": {"web-2-0", "web-2-1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj := &newprojv1.SvcMergerObj{}
+			obj.Spec.Weights = test.weights
+			obj.Spec.Cutover = test.cutover
+			groups := testGroups(test.readiness)
+			counts := weightEndpoints(obj, groups)
+			if !reflect.DeepEqual(counts, test.counts) {
+				t.Errorf("counts = %v, want %v", counts, test.counts)
+			}
+			if kept := keptPods(groups); !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("kept = %v, want %v", kept, test.kept)
+			}
+			for key, group := range groups {
+				if len(group.endpoints) == 0 {
+					t.Errorf("group %s is left without endpoints", key)
+				}
+			}
+		})
+	}
+}
+
+func TestSetMemberShares(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []string
+		counts   map[string]int32
+		shares   map[string]int32
+	}{
+		{
+			name:     "in proportion",
+			services: []string{"web-1", "web-2"},
+			counts:   map[string]int32{"web-1": 6, "web-2": 2},
+			shares:   map[string]int32{"web-1": 75, "web-2": 25},
+		},
+		{
+			name:     "thirds add up to 100",
+			services: []string{"web-1", "web-2", "web-3"},
+			counts:   map[string]int32{"web-1": 1, "web-2": 1, "web-3": 1},
+			shares:   map[string]int32{"web-1": 34, "web-2": 33, "web-3": 33},
+		},
+		{
+			name:     "largest remainder rounds up",
+			services: []string{"web-1", "web-2", "web-3"},
+			counts:   map[string]int32{"web-1": 1, "web-2": 2, "web-3": 4},
+			shares:   map[string]int32{"web-1": 14, "web-2": 29, "web-3": 57},
+		},
+		{
+			name:     "a member without endpoints gets no share",
+			services: []string{"web-1", "web-2", "web-3"},
+			counts:   map[string]int32{"web-1": 2, "web-2": 0, "web-3": 1},
+			shares:   map[string]int32{"web-1": 67, "web-2": 0, "web-3": 33},
+		},
+		{
+			name:     "no endpoints at all",
+			services: []string{"web-1", "web-2"},
+			counts:   map[string]int32{},
+			shares:   map[string]int32{"web-1": 0, "web-2": 0},
+		},
+		{
+			name:     "nil counts clear the shares",
+			services: []string{"web-1", "web-2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj := &newprojv1.SvcMergerObj{}
+			// shares of an earlier reconcile, to be replaced
+			for _, svc := range test.services {
+				share := int32(50)
+				memberStatus(obj, svc).SharePercent = &share
+			}
+			if !setMemberShares(obj, test.services, test.counts) {
+				t.Error("no share reported as changed")
+			}
+			total := int32(0)
+			for _, svc := range test.services {
+				share := memberStatus(obj, svc).SharePercent
+				if test.shares == nil {
+					if share != nil {
+						t.Errorf("share of %s = %d, want none", svc, *share)
+					}
+					continue
+				}
+				if share == nil || *share != test.shares[svc] {
+					t.Errorf("share of %s = %v, want %d", svc, share, test.shares[svc])
+					continue
+				}
+				total += *share
+			}
+			endpoints := int32(0)
+			for _, count := range test.counts {
+				endpoints += count
+			}
+			if endpoints > 0 && total != 100 {
+				t.Errorf("shares add up to %d", total)
+			}
+			if setMemberShares(obj, test.services, test.counts) {
+				t.Error("shares reported as changed although the counts are the same")
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	newprojv1 "controllerProj/api/v1"
+)
+
+// rolloutPollInterval is how often the rollouts of relabeled workloads are checked when no watch event comes in
+const rolloutPollInterval = 10 * time.Second
+
+// workloadRef identifies a workload that runs pods of a member Service, e.g. Deployment/web-1
+type workloadRef struct {
+	Kind string
+	Name string
+}
+
+func (w workloadRef) String() string {
+	return w.Kind + "/" + w.Name
+}
+
+// workloadResolver knows how to find and relabel one kind of workload. New kinds are plugged in
+// by adding them to workloadResolvers.
+type workloadResolver interface {
+	// newObject returns an empty object of the kind
+	newObject() client.Object
+	// listObjects lists the objects of the kind that match the options
+	listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error)
+	// podTemplate returns the pod template of the workload, nil if it has none that can be changed
+	podTemplate(obj client.Object) *corev1.PodTemplateSpec
+	// rollsOutTemplate tells whether a change of the pod template replaces the running pods. When it doesn't,
+	// the merge label is also put on the running pods directly.
+	rollsOutTemplate(obj client.Object) bool
+	// podSelector returns the selector of the pods run by the workload
+	podSelector(obj client.Object) (*metav1.LabelSelector, error)
+	// rolloutStatus tells whether the workload runs its current pod template everywhere. While it doesn't,
+	// the returned message says what is still missing. An error means the rollout is stuck for good.
+	rolloutStatus(obj client.Object) (bool, string, error)
+}
+
+// workloadResolvers holds a resolver for every kind of workload that can take part in a merge
+var workloadResolvers = map[string]workloadResolver{
+	"Deployment":  deploymentResolver{},
+	"StatefulSet": statefulSetResolver{},
+	"DaemonSet":   daemonSetResolver{},
+	"ReplicaSet":  replicaSetResolver{},
+	"Job":         jobResolver{},
+	"Pod":         podResolver{},
+}
+
+// workloadKinds returns the registered kinds in a stable order
+func workloadKinds() []string {
+	var kinds []string
+	for kind := range workloadResolvers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+type deploymentResolver struct{}
+
+func (deploymentResolver) newObject() client.Object { return &appsv1.Deployment{} }
+func (deploymentResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &appsv1.DeploymentList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+func (deploymentResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	return &obj.(*appsv1.Deployment).Spec.Template
+}
+func (deploymentResolver) rollsOutTemplate(obj client.Object) bool { return true }
+func (deploymentResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	return obj.(*appsv1.Deployment).Spec.Selector, nil
+}
+
+// rolloutStatus follows the same rules as kubectl rollout status. A rollout that passed the
+// progressDeadlineSeconds of the Deployment is reported by the deployment controller and fails here.
+func (deploymentResolver) rolloutStatus(obj client.Object) (bool, string, error) {
+	deployment := obj.(*appsv1.Deployment)
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false, "waiting for the new pod template to be observed", nil
+	}
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("rollout of deployment %s exceeded its progress deadline: %s", deployment.Name, cond.Message)
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	if status.UpdatedReplicas < replicas {
+		return false, fmt.Sprintf("%d of %d replicas updated", status.UpdatedReplicas, replicas), nil
+	}
+	if status.Replicas > status.UpdatedReplicas {
+		return false, fmt.Sprintf("%d old replicas pending termination", status.Replicas-status.UpdatedReplicas), nil
+	}
+	if status.AvailableReplicas < status.UpdatedReplicas {
+		return false, fmt.Sprintf("%d of %d updated replicas available", status.AvailableReplicas, status.UpdatedReplicas), nil
+	}
+	return true, "", nil
+}
+
+type statefulSetResolver struct{}
+
+func (statefulSetResolver) newObject() client.Object { return &appsv1.StatefulSet{} }
+func (statefulSetResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &appsv1.StatefulSetList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+func (statefulSetResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	return &obj.(*appsv1.StatefulSet).Spec.Template
+}
+func (statefulSetResolver) rollsOutTemplate(obj client.Object) bool {
+	return obj.(*appsv1.StatefulSet).Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType
+}
+func (statefulSetResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	return obj.(*appsv1.StatefulSet).Spec.Selector, nil
+}
+func (r statefulSetResolver) rolloutStatus(obj client.Object) (bool, string, error) {
+	stateful_set := obj.(*appsv1.StatefulSet)
+	if !r.rollsOutTemplate(obj) {
+		return true, "", nil
+	}
+	if stateful_set.Status.ObservedGeneration < stateful_set.Generation {
+		return false, "waiting for the new pod template to be observed", nil
+	}
+	replicas := int32(1)
+	if stateful_set.Spec.Replicas != nil {
+		replicas = *stateful_set.Spec.Replicas
+	}
+	status := stateful_set.Status
+	if status.UpdatedReplicas < replicas || status.UpdateRevision != status.CurrentRevision {
+		return false, fmt.Sprintf("%d of %d replicas updated", status.UpdatedReplicas, replicas), nil
+	}
+	if status.AvailableReplicas < replicas {
+		return false, fmt.Sprintf("%d of %d replicas available", status.AvailableReplicas, replicas), nil
+	}
+	return true, "", nil
+}
+
+type daemonSetResolver struct{}
+
+func (daemonSetResolver) newObject() client.Object { return &appsv1.DaemonSet{} }
+func (daemonSetResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &appsv1.DaemonSetList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+func (daemonSetResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	return &obj.(*appsv1.DaemonSet).Spec.Template
+}
+func (daemonSetResolver) rollsOutTemplate(obj client.Object) bool {
+	return obj.(*appsv1.DaemonSet).Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType
+}
+func (daemonSetResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	return obj.(*appsv1.DaemonSet).Spec.Selector, nil
+}
+func (r daemonSetResolver) rolloutStatus(obj client.Object) (bool, string, error) {
+	daemon_set := obj.(*appsv1.DaemonSet)
+	if !r.rollsOutTemplate(obj) {
+		return true, "", nil
+	}
+	if daemon_set.Status.ObservedGeneration < daemon_set.Generation {
+		return false, "waiting for the new pod template to be observed", nil
+	}
+	status := daemon_set.Status
+	if status.UpdatedNumberScheduled < status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("%d of %d pods updated", status.UpdatedNumberScheduled, status.DesiredNumberScheduled), nil
+	}
+	if status.NumberAvailable < status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("%d of %d updated pods available", status.NumberAvailable, status.DesiredNumberScheduled), nil
+	}
+	return true, "", nil
+}
+
+// replicaSetResolver only handles ReplicaSets that are not managed by a Deployment. A ReplicaSet doesn't
+// replace its pods when the template changes, so the running pods are relabeled as well.
+type replicaSetResolver struct{}
+
+func (replicaSetResolver) newObject() client.Object { return &appsv1.ReplicaSet{} }
+func (replicaSetResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &appsv1.ReplicaSetList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		if metav1.GetControllerOf(&list.Items[i]) == nil {
+			objs = append(objs, &list.Items[i])
+		}
+	}
+	return objs, nil
+}
+func (replicaSetResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec {
+	return &obj.(*appsv1.ReplicaSet).Spec.Template
+}
+func (replicaSetResolver) rollsOutTemplate(obj client.Object) bool { return false }
+func (replicaSetResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	return obj.(*appsv1.ReplicaSet).Spec.Selector, nil
+}
+func (replicaSetResolver) rolloutStatus(obj client.Object) (bool, string, error) {
+	return true, "", nil
+}
+
+// jobResolver handles Jobs. The pod template of a Job is immutable, so only the running pods are relabeled.
+type jobResolver struct{}
+
+func (jobResolver) newObject() client.Object { return &batchv1.Job{} }
+func (jobResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &batchv1.JobList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+func (jobResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec { return nil }
+func (jobResolver) rollsOutTemplate(obj client.Object) bool               { return false }
+func (jobResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	return obj.(*batchv1.Job).Spec.Selector, nil
+}
+func (jobResolver) rolloutStatus(obj client.Object) (bool, string, error) { return true, "", nil }
+
+// podResolver handles pods that are not managed by any workload; the pod itself carries the merge label.
+type podResolver struct{}
+
+func (podResolver) newObject() client.Object { return &corev1.Pod{} }
+func (podResolver) listObjects(ctx context.Context, c client.Client, opts ...client.ListOption) ([]client.Object, error) {
+	list := &corev1.PodList{}
+	if err := c.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	var objs []client.Object
+	for i := range list.Items {
+		if metav1.GetControllerOf(&list.Items[i]) == nil {
+			objs = append(objs, &list.Items[i])
+		}
+	}
+	return objs, nil
+}
+func (podResolver) podTemplate(obj client.Object) *corev1.PodTemplateSpec { return nil }
+func (podResolver) rollsOutTemplate(obj client.Object) bool               { return false }
+func (podResolver) podSelector(obj client.Object) (*metav1.LabelSelector, error) {
+	// the pod only selects itself, see workloadPods
+	return nil, nil
+}
+func (podResolver) rolloutStatus(obj client.Object) (bool, string, error) { return true, "", nil }
+
+// resolveWorkload finds the workload that manages the pod. Pods of a ReplicaSet that belongs to a
+// Deployment resolve to the Deployment, pods without owner resolve to themselves.
+func (r *SvcMergerObjReconciler) resolveWorkload(ctx context.Context, pod *corev1.Pod) (workloadRef, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return workloadRef{Kind: "Pod", Name: pod.Name}, nil
+	}
+	if owner.Kind == "ReplicaSet" {
+		replica_set_obj := &appsv1.ReplicaSet{}
+		err := r.Get(ctx, types.NamespacedName{Name: owner.Name, Namespace: pod.Namespace}, replica_set_obj)
+		if err != nil {
+			return workloadRef{}, err
+		}
+		if rs_owner := metav1.GetControllerOf(replica_set_obj); rs_owner != nil {
+			if rs_owner.Kind != "Deployment" {
+				return workloadRef{}, newReasonError(reasonUnsupportedWorkload,
+					fmt.Errorf("pod %s is managed by %s %s, which is not supported", pod.Name, rs_owner.Kind, rs_owner.Name))
+			}
+			return workloadRef{Kind: "Deployment", Name: rs_owner.Name}, nil
+		}
+		return workloadRef{Kind: "ReplicaSet", Name: owner.Name}, nil
+	}
+	if _, ok := workloadResolvers[owner.Kind]; !ok || owner.Kind == "Pod" {
+		return workloadRef{}, newReasonError(reasonUnsupportedWorkload,
+			fmt.Errorf("pod %s is managed by %s %s, which is not supported", pod.Name, owner.Kind, owner.Name))
+	}
+	return workloadRef{Kind: owner.Kind, Name: owner.Name}, nil
+}
+
+// workloadPods lists the running pods of a workload
+func (r *SvcMergerObjReconciler) workloadPods(ctx context.Context, ref workloadRef, obj client.Object) ([]*corev1.Pod, error) {
+	if pod, ok := obj.(*corev1.Pod); ok {
+		return []*corev1.Pod{pod}, nil
+	}
+	label_selector, err := workloadResolvers[ref.Kind].podSelector(obj)
+	if err != nil || label_selector == nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(label_selector)
+	if err != nil {
+		return nil, err
+	}
+	pod_list := &corev1.PodList{}
+	err = r.List(ctx, pod_list, client.InNamespace(obj.GetNamespace()), client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []*corev1.Pod
+	for i := range pod_list.Items {
+		pods = append(pods, &pod_list.Items[i])
+	}
+	return pods, nil
+}
+
+// labelWorkload puts the merge labels on a workload: on its pod template, and on its running pods when a
+// template change doesn't replace them. The workload is annotated with the merge and member it belongs to.
+// It reports whether anything had to be changed. A changed template rolls out new pods, see workloadRollout.
+func (r *SvcMergerObjReconciler) labelWorkload(ctx context.Context, obj *newprojv1.SvcMergerObj, ref workloadRef, svc string) (bool, error) {
+	l := log.FromContext(ctx)
+	name := obj.Name
+	keys := r.Keys
+	resolver := workloadResolvers[ref.Kind]
+
+	workload := resolver.newObject()
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: obj.Namespace}, workload)
+	if err != nil {
+		l.Error(err, "not able to fetch workload", "workload", ref.String())
+		return false, err
+	}
+
+	updated := false
+	annotations := workload.GetAnnotations()
+	template := resolver.podTemplate(workload)
+	labeled := annotations[keys.MergedBy] == name && annotations[keys.MemberAnnotation] == svc
+	if template != nil {
+		labeled = labeled && keys.hasMergeLabels(template.Labels, name, svc)
+	}
+	if _, is_pod := workload.(*corev1.Pod); is_pod {
+		labeled = labeled && keys.hasMergeLabels(workload.GetLabels(), name, svc)
+	}
+
+	if !labeled {
+		// A workload merged by another SvcMergerObj stays with it until it is released
+		if holder := annotations[keys.MergedBy]; holder != "" && holder != name {
+			active, err := r.activeHolder(ctx, obj, holder, "")
+			if err != nil {
+				return false, err
+			}
+			if active {
+				return false, newReasonError(reasonWorkloadClaimed,
+					fmt.Errorf("%s is merged by SvcMergerObj %s", ref.String(), holder))
+			}
+		}
+
+		// Labels the workload selects its pods on can't be changed without orphaning its pods
+		label_selector, err := resolver.podSelector(workload)
+		if err != nil {
+			return false, err
+		}
+		if template != nil {
+			if err := keys.checkSelectorLabels(ref, label_selector, template.Labels, name, svc); err != nil {
+				return false, err
+			}
+		}
+
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[keys.MergedBy] = name
+		annotations[keys.MemberAnnotation] = svc
+
+		// add the group label (= name) & member label (= svc) to the pod template of the workload, keeping the values they had before
+		if template != nil {
+			annotations = keys.saveOriginalLabels(annotations, template.Labels, name)
+			template.Labels = keys.addMergeLabels(template.Labels, name, svc)
+		}
+		if _, is_pod := workload.(*corev1.Pod); is_pod {
+			annotations = keys.saveOriginalLabels(annotations, workload.GetLabels(), name)
+			workload.SetLabels(keys.addMergeLabels(workload.GetLabels(), name, svc))
+		}
+		workload.SetAnnotations(annotations)
+		if err := r.Update(ctx, workload); err != nil {
+			l.Error(err, "not able to update workload with a label", "workload", ref.String())
+			return false, err
+		}
+		updated = true
+	}
+
+	if resolver.rollsOutTemplate(workload) {
+		return updated, nil
+	}
+	// The running pods are not replaced, so they get the label directly
+	pods, err := r.workloadPods(ctx, ref, workload)
+	if err != nil {
+		l.Error(err, "not able to list pods of workload", "workload", ref.String())
+		return updated, err
+	}
+	for _, pod := range pods {
+		if keys.hasMergeLabels(pod.Labels, name, svc) {
+			continue
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations = keys.saveOriginalLabels(pod.Annotations, pod.Labels, name)
+		pod.Labels = keys.addMergeLabels(pod.Labels, name, svc)
+		if err := r.Update(ctx, pod); client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to label pod", "pod", pod.Name)
+			return updated, err
+		}
+		updated = true
+	}
+	return updated, nil
+}
+
+// workloadRollout checks whether the workload finished rolling out its pod template, see workloadResolver.rolloutStatus.
+// A workload that is gone has nothing left to roll out.
+func (r *SvcMergerObjReconciler) workloadRollout(ctx context.Context, namespace string, ref workloadRef) (bool, string, error) {
+	resolver, ok := workloadResolvers[ref.Kind]
+	if !ok {
+		return false, "", fmt.Errorf("unknown workload kind %s", ref.Kind)
+	}
+	workload := resolver.newObject()
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, workload)
+	if apierrors.IsNotFound(err) {
+		return true, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return resolver.rolloutStatus(workload)
+}
+
+// unlabelWorkload removes the merge label and annotations from a workload and, where they were set
+// directly, from its running pods. A workload that is gone is not an error. The keys are passed in, so that
+// merges made with the legacy keys can be cleaned up as well.
+func (r *SvcMergerObjReconciler) unlabelWorkload(ctx context.Context, obj *newprojv1.SvcMergerObj, ref workloadRef, keys Keys) error {
+	l := log.FromContext(ctx)
+	name := obj.Name
+	resolver, ok := workloadResolvers[ref.Kind]
+	if !ok {
+		return fmt.Errorf("unknown workload kind %s", ref.Kind)
+	}
+
+	workload := resolver.newObject()
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: obj.Namespace}, workload)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		l.Error(err, "not able to fetch workload", "workload", ref.String())
+		return err
+	}
+
+	// The labels get back the values they had before the merge
+	original := workload.DeepCopyObject()
+	annotations := workload.GetAnnotations()
+	if template := resolver.podTemplate(workload); template != nil {
+		template.Labels = keys.restoreOriginalLabels(annotations, template.Labels)
+	}
+	if _, is_pod := workload.(*corev1.Pod); is_pod {
+		workload.SetLabels(keys.restoreOriginalLabels(annotations, workload.GetLabels()))
+	}
+	delete(annotations, keys.MergedBy)
+	delete(annotations, keys.MemberAnnotation)
+	delete(annotations, keys.OriginalLabels)
+	workload.SetAnnotations(annotations)
+	if !equality.Semantic.DeepEqual(original, workload) {
+		if err := r.Update(ctx, workload); err != nil {
+			l.Error(err, "not able to delete label from workload", "workload", ref.String())
+			return err
+		}
+	}
+
+	if resolver.rollsOutTemplate(workload) {
+		return nil
+	}
+	pods, err := r.workloadPods(ctx, ref, workload)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Labels[keys.Group] != name {
+			continue
+		}
+		pod.Labels = keys.restoreOriginalLabels(pod.Annotations, pod.Labels)
+		delete(pod.Annotations, keys.OriginalLabels)
+		if err := r.Update(ctx, pod); client.IgnoreNotFound(err) != nil {
+			l.Error(err, "not able to delete label from pod", "pod", pod.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedWorkloadsIndexKey indexes workloads by the SvcMergerObjs named in their merge annotation or pod template label
+const mergedWorkloadsIndexKey = ".metadata.mergedBy"
+
+// indexMergedWorkloads returns the indexer function for mergedWorkloadsIndexKey, for the configured and the legacy keys
+func (r *SvcMergerObjReconciler) indexMergedWorkloads(resolver workloadResolver) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		var names []string
+		for _, keys := range []Keys{r.Keys, legacyKeys} {
+			if name := obj.GetAnnotations()[keys.MergedBy]; keys.MergedBy != "" && name != "" {
+				names = append(names, name)
+			}
+			if template := resolver.podTemplate(obj); template != nil && template.Labels[keys.Group] != "" {
+				names = append(names, template.Labels[keys.Group])
+			}
+		}
+		return names
+	}
+}
+
+// findMergedWorkloads finds every workload that takes part in the merge, either through its annotations
+// or, for merges made by older versions of the controller, through the merge label on its pod template.
+// The keys are passed in, so that merges made with the legacy keys can be found as well.
+func (r *SvcMergerObjReconciler) findMergedWorkloads(ctx context.Context, obj *newprojv1.SvcMergerObj, keys Keys) (map[workloadRef]string, error) {
+	name := obj.Name
+	workloads := make(map[workloadRef]string)
+	for _, kind := range workloadKinds() {
+		resolver := workloadResolvers[kind]
+		objs, err := resolver.listObjects(ctx, r.Client, client.InNamespace(obj.Namespace), client.MatchingFields{mergedWorkloadsIndexKey: name})
+		if err != nil {
+			return nil, fmt.Errorf("not able to list %s: %w", strings.ToLower(kind)+"s", err)
+		}
+		for _, workload := range objs {
+			ref := workloadRef{Kind: kind, Name: workload.GetName()}
+			if keys.MergedBy != "" && workload.GetAnnotations()[keys.MergedBy] == name {
+				workloads[ref] = workload.GetAnnotations()[keys.MemberAnnotation]
+			} else if template := resolver.podTemplate(workload); template != nil && template.Labels[keys.Group] == name {
+				workloads[ref] = template.Labels[keys.Member]
+			}
+		}
+	}
+	return workloads, nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package proxy is the proxy of the Proxy merge strategy. The controller writes its routing table as a Config
+// into a ConfigMap, the proxy (cmd/svcmerger-proxy) serves it and picks up changes while it runs.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ConfigKey is the key of the ConfigMap, and so the file name, the routing table is stored under
+const ConfigKey = "config.json"
+
+// Protocols a listener routes on
+const (
+	ProtocolTCP  = "TCP"
+	ProtocolHTTP = "HTTP"
+	ProtocolTLS  = "TLS"
+)
+
+// Config is the routing table of the proxy
+type Config struct {
+	Listeners []Listener `json:"listeners"`
+}
+
+// Listener is a port the proxy listens on
+type Listener struct {
+	Port     int32   `json:"port"`
+	Protocol string  `json:"protocol"`
+	Routes   []Route `json:"routes"`
+}
+
+// Route sends what it matches to a backend. An empty host matches any host, an empty path prefix any path.
+type Route struct {
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Backend is the host:port connections and requests are forwarded to
+	Backend string `json:"backend"`
+}
+
+// LoadConfig reads and checks a routing table written by the controller
+func LoadConfig(path string) (*Config, []byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return nil, nil, fmt.Errorf("not able to parse routing table %s: %w", path, err)
+	}
+	return config, raw, config.validate()
+}
+
+// validate checks that every listener has a valid port and protocol and is there only once
+func (c *Config) validate() error {
+	ports := make(map[int32]bool)
+	for _, listener := range c.Listeners {
+		if listener.Port < 1 || listener.Port > 65535 {
+			return fmt.Errorf("listener port %d is out of range", listener.Port)
+		}
+		if ports[listener.Port] {
+			return fmt.Errorf("port %d has more than one listener", listener.Port)
+		}
+		ports[listener.Port] = true
+		switch listener.Protocol {
+		case ProtocolTCP, ProtocolHTTP, ProtocolTLS:
+		default:
+			return fmt.Errorf("listener %d has unknown protocol %q", listener.Port, listener.Protocol)
+		}
+		for _, route := range listener.Routes {
+			if route.Backend == "" {
+				return fmt.Errorf("a route of listener %d has no backend", listener.Port)
+			}
+		}
+	}
+	return nil
+}
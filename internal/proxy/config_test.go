@@ -0,0 +1,79 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{name: "empty"},
+		{
+			name: "valid",
+			config: Config{Listeners: []Listener{
+				{Port: 80, Protocol: ProtocolHTTP, Routes: []Route{{PathPrefix: "/api", Backend: "api:80"}, {Backend: "web:80"}}},
+				{Port: 443, Protocol: ProtocolTLS, Routes: []Route{{Host: "a.example.com", Backend: "a:443"}}},
+				{Port: 5432, Protocol: ProtocolTCP, Routes: []Route{{Backend: "db:5432"}}},
+			}},
+		},
+		{
+			name:   "port out of range",
+			config: Config{Listeners: []Listener{{Port: 0, Protocol: ProtocolTCP}}},
+			err:    "out of range",
+		},
+		{
+			name:   "port above range",
+			config: Config{Listeners: []Listener{{Port: 65536, Protocol: ProtocolTCP}}},
+			err:    "out of range",
+		},
+		{
+			name:   "port twice",
+			config: Config{Listeners: []Listener{{Port: 80, Protocol: ProtocolTCP}, {Port: 80, Protocol: ProtocolHTTP}}},
+			err:    "more than one listener",
+		},
+		{
+			name:   "unknown protocol",
+			config: Config{Listeners: []Listener{{Port: 80, Protocol: "UDP"}}},
+			err:    "unknown protocol",
+		},
+		{
+			name:   "route without backend",
+			config: Config{Listeners: []Listener{{Port: 80, Protocol: ProtocolHTTP, Routes: []Route{{PathPrefix: "/"}}}}},
+			err:    "no backend",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
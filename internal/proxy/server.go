@@ -0,0 +1,255 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// dialTimeout bounds the connection to a backend
+	dialTimeout = 10 * time.Second
+	// helloTimeout bounds the wait for the ClientHello of a TLS connection
+	helloTimeout = 10 * time.Second
+	// readHeaderTimeout bounds the wait for the headers of an HTTP request
+	readHeaderTimeout = 30 * time.Second
+)
+
+// Server runs the listeners of a routing table. A new table is applied while connections keep flowing:
+// listeners are opened for new ports and closed for removed ones or when their protocol changes, the others
+// route by the new table from the next connection or request on. Connections in progress are left alone.
+type Server struct {
+	mu        sync.Mutex
+	listeners map[int32]*listener
+}
+
+// listener is one port of the proxy
+type listener struct {
+	ctx      context.Context
+	port     int32
+	protocol string
+	routes   atomic.Pointer[[]Route]
+	ln       net.Listener
+	http     *http.Server
+}
+
+// NewServer returns a server without listeners, see Apply
+func NewServer() *Server {
+	return &Server{listeners: make(map[int32]*listener)}
+}
+
+// Apply brings the listeners in line with the routing table. Ports that can't be listened on are reported,
+// the other listeners are set up anyway.
+func (s *Server) Apply(ctx context.Context, config *Config) error {
+	l := log.FromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int32]Listener)
+	for _, listener := range config.Listeners {
+		wanted[listener.Port] = listener
+	}
+	for port, running := range s.listeners {
+		if want, ok := wanted[port]; !ok || want.Protocol != running.protocol {
+			l.Info("closing listener", "port", port, "protocol", running.protocol)
+			running.close()
+			delete(s.listeners, port)
+		}
+	}
+
+	var errs []error
+	for port, want := range wanted {
+		routes := append([]Route(nil), want.Routes...)
+		if running, ok := s.listeners[port]; ok {
+			running.routes.Store(&routes)
+			continue
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("not able to listen on port %d: %w", port, err))
+			continue
+		}
+		running := &listener{ctx: ctx, port: port, protocol: want.Protocol, ln: ln}
+		running.routes.Store(&routes)
+		if want.Protocol == ProtocolHTTP {
+			running.http = &http.Server{Handler: running, ReadHeaderTimeout: readHeaderTimeout}
+		}
+		s.listeners[port] = running
+		l.Info("opening listener", "port", port, "protocol", want.Protocol)
+		go running.serve()
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every listener
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for port, running := range s.listeners {
+		running.close()
+		delete(s.listeners, port)
+	}
+}
+
+// serve accepts connections until the listener is closed
+func (ln *listener) serve() {
+	l := log.FromContext(ln.ctx).WithValues("port", ln.port)
+	if ln.http != nil {
+		if err := ln.http.Serve(ln.ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			l.Error(err, "listener stopped")
+		}
+		return
+	}
+	for {
+		conn, err := ln.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			l.Error(err, "not able to accept connection")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go ln.forward(conn)
+	}
+}
+
+// close stops accepting connections on the listener
+func (ln *listener) close() {
+	if ln.http != nil {
+		ln.http.Close()
+		return
+	}
+	ln.ln.Close()
+}
+
+// forward routes a TCP or TLS connection to its backend and copies the bytes both ways until both sides are done
+func (ln *listener) forward(conn net.Conn) {
+	l := log.FromContext(ln.ctx).WithValues("port", ln.port, "client", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	var server_name string
+	var reader io.Reader = conn
+	if ln.protocol == ProtocolTLS {
+		conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		var err error
+		server_name, reader, err = peekServerName(conn)
+		if err != nil {
+			l.V(1).Info("not able to read the TLS client hello", "error", err.Error())
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	route := matchRoute(*ln.routes.Load(), server_name, "")
+	if route == nil {
+		l.V(1).Info("no route for connection", "server_name", server_name)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", route.Backend, dialTimeout)
+	if err != nil {
+		l.Error(err, "not able to connect to backend", "backend", route.Backend)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, reader)
+		closeWrite(backend)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// ServeHTTP routes a request of an HTTP listener by its host and path
+func (ln *listener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	route := matchRoute(*ln.routes.Load(), host, req.URL.Path)
+	if route == nil {
+		http.Error(w, fmt.Sprintf("no route for host %q and path %q", host, req.URL.Path), http.StatusNotFound)
+		return
+	}
+	backend := route.Backend
+	proxy := &httputil.ReverseProxy{
+		// the Host header is passed on as it is, the member may serve several hosts itself
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = backend
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.FromContext(ln.ctx).Error(err, "not able to forward request", "port", ln.port, "backend", backend)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// matchRoute picks the route for a host and a path: routes for the host come before the ones for any host,
+// and among them the longest path prefix wins. It returns nil if no route matches.
+func matchRoute(routes []Route, host string, path string) *Route {
+	var best *Route
+	for i := range routes {
+		route := &routes[i]
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if !pathMatches(path, route.PathPrefix) {
+			continue
+		}
+		if best == nil || (route.Host != "" && best.Host == "") ||
+			((route.Host != "") == (best.Host != "") && len(route.PathPrefix) > len(best.PathPrefix)) {
+			best = route
+		}
+	}
+	return best
+}
+
+// pathMatches tells whether the path lies under the prefix by whole segments: /api (or /api/) matches /api and
+// /api/v1, but not /apis
+func pathMatches(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// closeWrite tells the other side of a TCP connection that nothing more is sent
+func closeWrite(conn net.Conn) {
+	if tcp_conn, ok := conn.(*net.TCPConn); ok {
+		tcp_conn.CloseWrite()
+	}
+}
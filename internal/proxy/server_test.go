@@ -0,0 +1,182 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchRoute(t *testing.T) {
+	routes := []Route{
+		{Backend: "default"},
+		{PathPrefix: "/api", Backend: "api"},
+		{PathPrefix: "/api/v2/", Backend: "api-v2"},
+		{Host: "a.example.com", Backend: "a"},
+		{Host: "a.example.com", PathPrefix: "/api", Backend: "a-api"},
+	}
+	tests := []struct {
+		name    string
+		routes  []Route
+		host    string
+		path    string
+		backend string
+	}{
+		{name: "any host, no prefix", routes: routes, host: "b.example.com", path: "/", backend: "default"},
+		{name: "prefix itself", routes: routes, host: "b.example.com", path: "/api", backend: "api"},
+		{name: "below the prefix", routes: routes, host: "b.example.com", path: "/api/v1/users", backend: "api"},
+		{name: "prefix is no path segment", routes: routes, host: "b.example.com", path: "/apis", backend: "default"},
+		{name: "longest prefix wins", routes: routes, host: "b.example.com", path: "/api/v2/users", backend: "api-v2"},
+		{name: "prefix with a trailing slash matches without it", routes: routes, host: "b.example.com", path: "/api/v2", backend: "api-v2"},
+		{name: "host comes before any host", routes: routes, host: "a.example.com", path: "/other", backend: "a"},
+		{name: "host comes before a longer prefix", routes: routes[:4], host: "a.example.com", path: "/api/v1", backend: "a"},
+		{name: "host and prefix", routes: routes, host: "a.example.com", path: "/api/v1", backend: "a-api"},
+		{name: "host is case insensitive", routes: routes, host: "A.Example.COM", path: "/", backend: "a"},
+		{name: "connection without host", routes: routes, backend: "default"},
+		{name: "no match", routes: routes[1:3], host: "b.example.com", path: "/web", backend: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := matchRoute(test.routes, test.host, test.path)
+			backend := ""
+			if route != nil {
+				backend = route.Backend
+			}
+			if backend != test.backend {
+				t.Errorf("matchRoute(%q, %q) = %q, want %q", test.host, test.path, backend, test.backend)
+			}
+		})
+	}
+}
+
+// freePort returns a port nothing listens on right now
+func freePort(t *testing.T) int32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// get sends a request for the path to the port and returns the body of the response
+func get(t *testing.T, port int32, path string) string {
+	t.Helper()
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+	if err != nil {
+		t.Fatalf("GET %s on port %d failed: %v", path, port, err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return string(body)
+}
+
+func TestServerApply(t *testing.T) {
+	backend := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	web, api := backend("web"), backend("api")
+	port := freePort(t)
+	ctx := context.Background()
+
+	s := NewServer()
+	defer s.Close()
+	config := &Config{Listeners: []Listener{{Port: port, Protocol: ProtocolHTTP, Routes: []Route{{Backend: web}}}}}
+	if err := s.Apply(ctx, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := s.listeners[port]
+	if body := get(t, port, "/api"); body != "web" {
+		t.Errorf("before the update /api reached %q, want web", body)
+	}
+
+	// new routes are picked up by the listener that runs already
+	config.Listeners[0].Routes = append(config.Listeners[0].Routes, Route{PathPrefix: "/api", Backend: api})
+	if err := s.Apply(ctx, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.listeners[port] != first {
+		t.Error("the listener was replaced although its protocol is the same")
+	}
+	if body := get(t, port, "/api"); body != "api" {
+		t.Errorf("after the update /api reached %q, want api", body)
+	}
+
+	// a change of protocol opens the port again
+	config.Listeners[0].Protocol = ProtocolTCP
+	config.Listeners[0].Routes = []Route{{Backend: api}}
+	if err := s.Apply(ctx, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.listeners[port] == first {
+		t.Error("the listener was kept although its protocol changed")
+	}
+	if body := get(t, port, "/"); body != "api" {
+		t.Errorf("the TCP listener forwarded to %q, want api", body)
+	}
+
+	// a port left out of the table is closed, and taken again by the next table that has it
+	if err := s.Apply(ctx, &Config{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.listeners) != 0 {
+		t.Errorf("%d listeners left running", len(s.listeners))
+	}
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("port %d still accepts connections", port)
+	}
+	if err := s.Apply(ctx, config); err != nil {
+		t.Fatalf("the closed port can't be opened again: %v", err)
+	}
+}
+
+func TestServerApplyReportsPortInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := int32(taken.Addr().(*net.TCPAddr).Port)
+	free := freePort(t)
+
+	s := NewServer()
+	defer s.Close()
+	err = s.Apply(context.Background(), &Config{Listeners: []Listener{
+		{Port: port, Protocol: ProtocolTCP, Routes: []Route{{Backend: "127.0.0.1:1"}}},
+		{Port: free, Protocol: ProtocolTCP, Routes: []Route{{Backend: "127.0.0.1:1"}}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint(port)) {
+		t.Errorf("expected an error for port %d, got %v", port, err)
+	}
+	if _, ok := s.listeners[free]; !ok {
+		t.Errorf("the listener on the free port %d was not opened", free)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errHelloRead stops the TLS handshake once the ClientHello is read
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello off the connection and returns the server name (SNI) the client
+// asks for, empty if it asks for none. TLS is not terminated: the returned reader replays the bytes read so
+// far, followed by the rest of the connection, so that the backend does the handshake.
+func peekServerName(conn net.Conn) (string, io.Reader, error) {
+	var peeked bytes.Buffer
+	var server_name string
+	read := false
+	err := tls.Server(helloConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			server_name = hello.ServerName
+			read = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !read {
+		return "", nil, err
+	}
+	return server_name, io.MultiReader(&peeked, conn), nil
+}
+
+// helloConn is the read only connection the ClientHello is parsed from. Nothing is ever written back to the
+// client, the alert the aborted handshake sends is dropped.
+type helloConn struct {
+	reader io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
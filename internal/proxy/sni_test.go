@@ -0,0 +1,84 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name        string
+		server_name string
+	}{
+		{name: "with server name", server_name: "a.example.com"},
+		{name: "without server name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			hello := make(chan []byte, 1)
+			// the client hello is recorded as the client sends it, to compare it against what is replayed
+			recorder := &recordingConn{Conn: client}
+			go func() {
+				tls.Client(recorder, &tls.Config{ServerName: test.server_name, InsecureSkipVerify: true}).Handshake()
+				hello <- recorder.written
+			}()
+
+			server_name, reader, err := peekServerName(server)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if server_name != test.server_name {
+				t.Errorf("server name = %q, want %q", server_name, test.server_name)
+			}
+			// nothing was written back to the client; closing the connection ends its handshake
+			server.Close()
+			sent := <-hello
+			replayed, _ := io.ReadAll(reader)
+			if len(sent) == 0 || string(replayed) != string(sent) {
+				t.Errorf("the reader replays %d bytes, the client sent %d", len(replayed), len(sent))
+			}
+		})
+	}
+}
+
+func TestPeekServerNameNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+		client.Close()
+	}()
+	if _, _, err := peekServerName(server); err == nil {
+		t.Fatal("expected an error for a connection that doesn't start with a TLS client hello")
+	}
+	server.Close()
+}
+
+// recordingConn keeps what is written to the connection
+type recordingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	return c.Conn.Write(p)
+}